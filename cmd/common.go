@@ -1,7 +1,97 @@
 package cmd
 
+import (
+	"fmt"
+	"log"
+	"path"
+	"sort"
+
+	"github.com/containerd/platforms"
+	"github.com/lf-edge/edge-containers/pkg/registry"
+	ecresolver "github.com/lf-edge/edge-containers/pkg/resolver"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/spf13/cobra"
+)
+
 var (
-	debug     bool
-	verbose   bool
-	blocksize int
+	debug       bool
+	verbose     bool
+	blocksize   int
+	platformStr string
+	// parallel the ranges of a large blob to pull at once, parallelThreshold the least size of such a blob, in MiB
+	parallel          int
+	parallelThreshold int64
 )
+
+// parallelFlags add the flags to pull large blobs in ranges at once
+func parallelFlags(cmd *cobra.Command) {
+	flags := cmd.Flags()
+	flags.IntVar(&parallel, "parallel", 1, "pull each large blob in this many ranges at once, each with its own request; 1 for a single request")
+	flags.Int64Var(&parallelThreshold, "parallel-threshold", 64, "least size in MiB of a blob to pull in ranges with --parallel")
+}
+
+// parallelOptions the options to pull large blobs in ranges at once, from the flags
+func parallelOptions() ecresolver.ParallelOptions {
+	if parallel < 2 {
+		return ecresolver.ParallelOptions{}
+	}
+	if parallelThreshold <= 0 {
+		log.Fatalf("invalid --parallel-threshold %d", parallelThreshold)
+	}
+	return ecresolver.ParallelOptions{Threshold: parallelThreshold << 20, Connections: parallel}
+}
+
+// parsePlatform convert a platform string, e.g. linux/arm64, to a Platform; blank returns nil,
+// i.e. the default
+func parsePlatform(s string) (*ocispec.Platform, error) {
+	if s == "" {
+		return nil, nil
+	}
+	platform, err := platforms.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid platform %s: %v", s, err)
+	}
+	return &platform, nil
+}
+
+// localDirectory the remote as a local directory, for commands that only work on one
+func localDirectory() *ecresolver.Directory {
+	dir, ok := remoteTarget.(*ecresolver.Directory)
+	if !ok {
+		log.Fatal("requires a local directory, use --remote /path")
+	}
+	return dir
+}
+
+// printServed print which of the mirrors, or the remote, served each blob, when pulling from a chain of them
+func printServed() {
+	chain, ok := remoteTarget.(*ecresolver.Chain)
+	if !ok {
+		return
+	}
+	sources := append(append([]string{}, mirrors...), remote)
+	served := chain.Served()
+	var digests []string
+	for dgst := range served {
+		digests = append(digests, dgst.String())
+	}
+	sort.Strings(digests)
+	fmt.Println("sources:")
+	for _, dgst := range digests {
+		source := sources[served[digest.Digest(dgst)]]
+		if source == "" {
+			source = "default registry"
+		}
+		fmt.Printf("	%s: %s\n", dgst, source)
+	}
+}
+
+// location where a part of a pulled artifact is, its path in the directory, or, for a file inside the tar layers
+// of the image, its path in the image
+func location(dir string, source registry.Source) string {
+	if l, ok := source.(*registry.LayerSource); ok {
+		return fmt.Sprintf("%s (in the image layers)", l.Path)
+	}
+	return path.Join(dir, source.GetPath())
+}
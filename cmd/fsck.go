@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	ecresolver "github.com/lf-edge/edge-containers/pkg/resolver"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	repair bool
+)
+
+var fsckCmd = &cobra.Command{
+	Use:   "fsck",
+	Short: "verify the integrity of a local directory",
+	Long: `verify the integrity of a local directory, given by --remote /path, re-hashing every blob and checking every
+	descriptor used by the images in it, and report missing, corrupt, unchecked and orphaned blobs. Exits non-zero if any are missing, corrupt or unchecked.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if debug {
+			logrus.SetLevel(logrus.DebugLevel)
+		}
+		if len(args) != 0 {
+			log.Fatal("takes no args, run help")
+		}
+		dir := localDirectory()
+		result, err := dir.Fsck(ecresolver.FsckOptions{Repair: repair})
+		if err != nil {
+			log.Fatalf("error checking directory: %v", err)
+		}
+		// orphaned blobs are harmless, and only reported
+		var failed int
+		for _, problem := range result.Problems {
+			fmt.Println(problem)
+			if problem.Kind != ecresolver.FsckOrphaned {
+				failed++
+			}
+		}
+		for _, dgst := range result.Repaired {
+			fmt.Printf("Removed corrupt blob %s, pull again to fetch it\n", dgst)
+		}
+		fmt.Printf("Checked %d blobs, found %d problems\n", result.Blobs, len(result.Problems))
+		if failed > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func fsckInit() {
+	fsckCmd.Flags().BoolVar(&repair, "repair", false, "remove corrupt blobs, so that they are fetched again on the next pull")
+	fsckCmd.Flags().BoolVar(&debug, "debug", false, "debug output")
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	ecresolver "github.com/lf-edge/edge-containers/pkg/resolver"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	keepTags    int
+	gracePeriod time.Duration
+	dryRun      bool
+)
+
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "remove unused content from a local directory",
+	Long: `remove every blob in a local directory, given by --remote /path, that is not used by any of the images in it,
+	optionally keeping only the last N images pushed to each repository`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if debug {
+			logrus.SetLevel(logrus.DebugLevel)
+		}
+		if len(args) != 0 {
+			log.Fatal("takes no args, run help")
+		}
+		dir := localDirectory()
+		// no grace period here is the library's negative one, as its zero is the default
+		if gracePeriod == 0 {
+			gracePeriod = -1
+		}
+		result, err := dir.GC(ecresolver.GCOptions{
+			KeepTags:    keepTags,
+			GracePeriod: gracePeriod,
+			DryRun:      dryRun,
+		})
+		if err != nil {
+			log.Fatalf("error collecting garbage: %v", err)
+		}
+		action := "Removed"
+		if dryRun {
+			action = "Would remove"
+		}
+		for _, image := range result.Images {
+			fmt.Printf("%s image %s\n", action, image)
+		}
+		if verbose {
+			for _, blob := range result.Blobs {
+				fmt.Printf("%s blob %s, %d bytes\n", action, blob.Digest, blob.Size)
+			}
+		}
+		if dryRun {
+			fmt.Printf("Would reclaim %d bytes from %d blobs\n", result.Reclaimed, len(result.Blobs))
+		} else {
+			fmt.Printf("Reclaimed %d bytes from %d blobs\n", result.Reclaimed, len(result.Blobs))
+		}
+	},
+}
+
+func gcInit() {
+	gcCmd.Flags().IntVar(&keepTags, "keep", 0, "keep only the last N images pushed to each repository, 0 to keep all")
+	gcCmd.Flags().DurationVar(&gracePeriod, "grace-period", ecresolver.DefaultGCGracePeriod, "keep content changed more recently than this, which may be part of a push in progress, 0 for none")
+	gcCmd.Flags().BoolVar(&dryRun, "dry-run", false, "report what would be removed, but remove nothing")
+	gcCmd.Flags().BoolVar(&debug, "debug", false, "debug output")
+	gcCmd.Flags().BoolVar(&verbose, "verbose", false, "list each blob removed")
+}
@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/containerd/platforms"
+	"github.com/lf-edge/edge-containers/pkg/registry"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	outputFormat string
+)
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect",
+	Short: "inspect an ECI without pulling its content",
+	Long:  `inspect an Edge Container Image (ECI), retrieving only its index, manifest and config, and describe its format, platform and contents`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if debug {
+			logrus.SetLevel(logrus.DebugLevel)
+		}
+		// must be exactly one arg, the URL to the manifest
+		if len(args) != 1 {
+			log.Fatal("must be exactly one arg, the name of the image to inspect")
+		}
+		image := args[0]
+		platform, err := parsePlatform(platformStr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		puller := registry.Puller{
+			Image:    image,
+			Platform: platform,
+			Retry:    retryOpts,
+		}
+		inspection, err := puller.Inspect(remoteTarget)
+		if err != nil {
+			log.Fatalf("error inspecting image: %v", err)
+		}
+		switch outputFormat {
+		case "json":
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(inspection); err != nil {
+				log.Fatalf("error converting to json: %v", err)
+			}
+		case "text":
+			printInspection(inspection)
+		default:
+			log.Fatalf("unknown output format: %s", outputFormat)
+		}
+	},
+}
+
+func inspectInit() {
+	inspectCmd.Flags().StringVarP(&outputFormat, "output", "o", "text", "output format, one of: text, json")
+	inspectCmd.Flags().StringVar(&platformStr, "platform", "", "platform to inspect when the image is an index, e.g. linux/arm64, defaults to the current platform")
+	inspectCmd.Flags().BoolVar(&debug, "debug", false, "debug output")
+}
+
+func printInspection(inspection *registry.Inspection) {
+	fmt.Printf("Image: %s\n", inspection.Image)
+	fmt.Printf("Digest: %s\n", inspection.Descriptor.Digest)
+	if inspection.Index != nil {
+		fmt.Printf("Manifest: %s\n", inspection.ManifestDescriptor.Digest)
+	}
+	if inspection.ECI {
+		fmt.Printf("Format: %s\n", inspection.Format)
+	} else {
+		fmt.Println("Format: not an ECI")
+	}
+	if inspection.Platform != nil {
+		fmt.Printf("Platform: %s\n", platforms.Format(*inspection.Platform))
+	}
+	if inspection.Config != nil && inspection.Config.ECI != nil {
+		settings := inspection.Config.ECI
+		fmt.Println("Settings:")
+		if settings.KernelCommandLine != "" {
+			fmt.Printf("\tkernel command line: %s\n", settings.KernelCommandLine)
+		}
+		if settings.BootMode != "" {
+			fmt.Printf("\tboot mode: %s\n", settings.BootMode)
+		}
+		if settings.VirtualizationMode != "" {
+			fmt.Printf("\tvirtualization mode: %s\n", settings.VirtualizationMode)
+		}
+		if settings.Resources != nil {
+			fmt.Printf("\tminimum vCPUs: %d\n", settings.Resources.MinVCPUs)
+			fmt.Printf("\tminimum memory: %d MiB\n", settings.Resources.MinMemoryMiB)
+		}
+	}
+
+	fmt.Println("Roles:")
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "\tROLE\tNAME\tDISK TYPE\tSIZE\tDIGEST")
+	for _, r := range inspection.Roles {
+		role := r.Role
+		if r.Role == registry.RoleAdditionalDisk || r.Role == registry.RoleOther {
+			role = fmt.Sprintf("%s %d", r.Role, r.Index)
+		}
+		size := ""
+		if r.Size > 0 {
+			size = fmt.Sprintf("%d", r.Size)
+		}
+		_, _ = fmt.Fprintf(w, "\t%s\t%s\t%s\t%s\t%s\n", role, r.Name, r.DiskType, size, r.Digest)
+	}
+	_ = w.Flush()
+
+	printMap("Annotations", inspection.Annotations)
+	for _, r := range inspection.Roles {
+		printMap(fmt.Sprintf("Annotations for %s", r.Name), r.Annotations)
+	}
+	printMap("Labels", inspection.Labels)
+}
+
+// printMap print the map sorted by key, if it is not empty
+func printMap(title string, m map[string]string) {
+	if len(m) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Printf("%s:\n", title)
+	for _, k := range keys {
+		fmt.Printf("\t%s: %s\n", k, m[k])
+	}
+}
@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	ecresolver "github.com/lf-edge/edge-containers/pkg/resolver"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var loginCmd = &cobra.Command{
+	Use:   "login",
+	Short: "log in to a registry",
+	Long: `log in to a registry, checking and storing the credentials given with --username and --password-stdin, or
+	ECI_USERNAME and ECI_PASSWORD, in the docker config, or its credential helper, for later use by eci and docker`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if debug {
+			logrus.SetLevel(logrus.DebugLevel)
+		}
+		if len(args) != 1 {
+			log.Fatal("must be exactly one arg, the registry to log in to")
+		}
+		if password == "" {
+			log.Fatal("requires a password or token, with --password-stdin or ECI_PASSWORD")
+		}
+		if err := ecresolver.Login(context.TODO(), args[0], username, password, registryOpts); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Login Succeeded")
+	},
+}
+
+var logoutCmd = &cobra.Command{
+	Use:   "logout",
+	Short: "log out of a registry",
+	Long:  `log out of a registry, removing the credentials stored for it by eci login or docker login`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if debug {
+			logrus.SetLevel(logrus.DebugLevel)
+		}
+		if len(args) != 1 {
+			log.Fatal("must be exactly one arg, the registry to log out of")
+		}
+		err := ecresolver.Logout(context.TODO(), args[0], registryOpts)
+		switch {
+		case errors.Is(err, ecresolver.ErrNotLoggedIn):
+			fmt.Printf("Not logged in to %s\n", args[0])
+		case err != nil:
+			log.Fatal(err)
+		default:
+			fmt.Printf("Removed login credentials for %s\n", args[0])
+		}
+	},
+}
+
+func loginInit() {
+	loginCmd.Flags().BoolVar(&debug, "debug", false, "debug output")
+	logoutCmd.Flags().BoolVar(&debug, "debug", false, "debug output")
+}
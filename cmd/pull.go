@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"path"
 
 	"github.com/lf-edge/edge-containers/pkg/registry"
 	"github.com/sirupsen/logrus"
@@ -29,25 +28,60 @@ var pullCmd = &cobra.Command{
 			log.Fatal("must be exactly one arg, the name of the image to download")
 		}
 		image := args[0]
+		platform, err := parsePlatform(platformStr)
+		if err != nil {
+			log.Fatal(err)
+		}
 		puller := registry.Puller{
-			Image: image,
+			Image:    image,
+			Platform: platform,
+			Retry:    retryOpts,
+			Parallel: parallelOptions(),
 		}
-		desc, artifact, err := puller.Pull(content.NewFile(pullDir), blocksize, verbose, os.Stdout, remoteTarget)
+		desc, artifact, err := puller.Pull(registry.NewFileStore(pullDir), blocksize, verbose, os.Stdout, remoteTarget)
 		if err != nil {
 			log.Fatalf("error pulling from registry: %v", err)
 		}
 		fmt.Printf("Pulled image %s with digest %s to directory %s\n", image, string(desc.Digest), pullDir)
 		fmt.Println("file locations and types:")
-		fmt.Printf("\tkernel: %s\n", path.Join(pullDir, artifact.Kernel.GetPath()))
-		fmt.Printf("\tinitrd: %s\n", path.Join(pullDir, artifact.Initrd.GetPath()))
+		if artifact.Kernel != nil {
+			fmt.Printf("\tkernel: %s\n", location(pullDir, artifact.Kernel))
+		}
+		if artifact.Initrd != nil {
+			fmt.Printf("\tinitrd: %s\n", location(pullDir, artifact.Initrd))
+		}
+		if artifact.DeviceTree != nil {
+			fmt.Printf("\tdevicetree: %s\n", location(pullDir, artifact.DeviceTree))
+		}
+		if artifact.Firmware != nil {
+			fmt.Printf("\tfirmware: %s\n", location(pullDir, artifact.Firmware))
+		}
+		if artifact.Bootloader != nil {
+			fmt.Printf("\tbootloader: %s\n", location(pullDir, artifact.Bootloader))
+		}
+		if artifact.KernelModules != nil {
+			fmt.Printf("\tkernel-modules: %s\n", location(pullDir, artifact.KernelModules))
+		}
 		rootDisk := artifact.Root
 		if rootDisk == nil {
 			fmt.Printf("\troot: \n")
 		} else {
-			fmt.Printf("\troot: %s %v\n", path.Join(pullDir, rootDisk.Source.GetPath()), rootDisk.Type)
+			fmt.Printf("\troot: %s %v\n", location(pullDir, rootDisk.Source), rootDisk.Type)
 		}
 		for i, d := range artifact.Disks {
-			fmt.Printf("\tadditional disk %d: %s %v\n", i, path.Join(pullDir, d.Source.GetPath()), d.Type)
+			if d == nil {
+				continue
+			}
+			fmt.Printf("\tadditional disk %d: %s %v\n", i, location(pullDir, d.Source), d.Type)
+		}
+		for i, o := range artifact.Other {
+			if o == nil {
+				continue
+			}
+			fmt.Printf("\tother %d: %s\n", i, location(pullDir, o))
+		}
+		if verbose {
+			printServed()
 		}
 	},
 }
@@ -60,6 +94,8 @@ func pullInit() {
 
 	pullCmd.Flags().StringVar(&pullDir, "dir", cwd, "directory where to install the ECI, optional")
 	pullCmd.Flags().IntVar(&blocksize, "blocksize", content.DefaultBlocksize, "blocksize to use for gunzip/untar")
+	pullCmd.Flags().StringVar(&platformStr, "platform", "", "platform to pull when the image is an index, e.g. linux/arm64, defaults to the current platform")
 	pullCmd.Flags().BoolVar(&debug, "debug", false, "debug output")
 	pullCmd.Flags().BoolVar(&verbose, "verbose", false, "verbose output")
+	parallelFlags(pullCmd)
 }
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
 
@@ -12,10 +13,15 @@ import (
 )
 
 var (
-	kernel   string
-	initrd   string
-	config   string
-	rootDisk string
+	kernel        string
+	initrd        string
+	deviceTree    string
+	firmware      string
+	bootloader    string
+	kernelModules string
+	config        string
+	rootDisk      string
+	otherFiles    []string
 )
 
 var pullFilesCmd = &cobra.Command{
@@ -31,8 +37,15 @@ var pullFilesCmd = &cobra.Command{
 			log.Fatal("must be exactly one arg, the name of the image to download")
 		}
 		image := args[0]
+		platform, err := parsePlatform(platformStr)
+		if err != nil {
+			log.Fatal(err)
+		}
 		puller := registry.Puller{
-			Image: image,
+			Image:    image,
+			Platform: platform,
+			Retry:    retryOpts,
+			Parallel: parallelOptions(),
 		}
 		target := &registry.FilesTarget{}
 		if kernel != "" {
@@ -62,6 +75,27 @@ var pullFilesCmd = &cobra.Command{
 			defer func() { _ = f.Close() }()
 			target.Initrd = f
 		}
+		for _, t := range []struct {
+			name   string
+			path   string
+			writer *io.Writer
+		}{
+			{"devicetree", deviceTree, &target.DeviceTree},
+			{"firmware", firmware, &target.Firmware},
+			{"bootloader", bootloader, &target.Bootloader},
+			{"kernel modules", kernelModules, &target.KernelModules},
+		} {
+			if t.path == "" {
+				continue
+			}
+			f, err := os.OpenFile(t.path,
+				os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				log.Fatalf("failed to open %s file %s for writing: %v", t.name, t.path, err)
+			}
+			defer func() { _ = f.Close() }()
+			*t.writer = f
+		}
 		if rootDisk != "" {
 			f, err := os.OpenFile(rootDisk,
 				os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
@@ -71,28 +105,65 @@ var pullFilesCmd = &cobra.Command{
 			defer func() { _ = f.Close() }()
 			target.Root = f
 		}
+		for _, o := range otherFiles {
+			// an empty path skips that item
+			if o == "" {
+				target.Other = append(target.Other, nil)
+				continue
+			}
+			f, err := os.OpenFile(o,
+				os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				log.Fatalf("failed to open other file %s for writing: %v", o, err)
+			}
+			defer func() { _ = f.Close() }()
+			target.Other = append(target.Other, f)
+		}
 		desc, artifact, err := puller.Pull(target, blocksize, verbose, os.Stdout, remoteTarget)
 		if err != nil {
 			log.Fatalf("error pulling from registry: %v", err)
 		}
 		fmt.Printf("Pulled image %s with digest %s\n", image, string(desc.Digest))
 		fmt.Println("file locations and types:")
-		if kernel != "" {
-			fmt.Printf("\tkernel: %v\n", artifact.Kernel.GetPath())
+		if kernel != "" && artifact.Kernel != nil {
+			fmt.Printf("\tkernel: %v\n", location("", artifact.Kernel))
 		}
-		if initrd != "" {
-			fmt.Printf("\tinitrd: %s\n", artifact.Initrd.GetPath())
+		if initrd != "" && artifact.Initrd != nil {
+			fmt.Printf("\tinitrd: %s\n", location("", artifact.Initrd))
+		}
+		if deviceTree != "" && artifact.DeviceTree != nil {
+			fmt.Printf("\tdevicetree: %s\n", location("", artifact.DeviceTree))
+		}
+		if firmware != "" && artifact.Firmware != nil {
+			fmt.Printf("\tfirmware: %s\n", location("", artifact.Firmware))
+		}
+		if bootloader != "" && artifact.Bootloader != nil {
+			fmt.Printf("\tbootloader: %s\n", location("", artifact.Bootloader))
+		}
+		if kernelModules != "" && artifact.KernelModules != nil {
+			fmt.Printf("\tkernel-modules: %s\n", location("", artifact.KernelModules))
 		}
 		if rootDisk != "" {
 			root := artifact.Root
 			if root == nil {
 				fmt.Printf("\troot: \n")
 			} else {
-				fmt.Printf("\troot: %s %v\n", root.Source.GetPath(), root.Type)
+				fmt.Printf("\troot: %s %v\n", location("", root.Source), root.Type)
 			}
 		}
 		for i, d := range artifact.Disks {
-			fmt.Printf("\tadditional disk %d: %s %v\n", i, d.Source.GetPath(), d.Type)
+			if d == nil {
+				continue
+			}
+			fmt.Printf("\tadditional disk %d: %s %v\n", i, location("", d.Source), d.Type)
+		}
+		for i, o := range artifact.Other {
+			if o != nil && i < len(otherFiles) && otherFiles[i] != "" {
+				fmt.Printf("\tother %d: %s\n", i, location("", o))
+			}
+		}
+		if verbose {
+			printServed()
 		}
 	},
 }
@@ -101,8 +172,15 @@ func pullFilesInit() {
 	pullFilesCmd.Flags().StringVar(&kernel, "kernel", "", "path to place kernel")
 	pullFilesCmd.Flags().StringVar(&config, "config", "", "path to place image config")
 	pullFilesCmd.Flags().StringVar(&initrd, "initrd", "", "path to place initrd")
+	pullFilesCmd.Flags().StringVar(&deviceTree, "devicetree", "", "path to place device tree blob")
+	pullFilesCmd.Flags().StringVar(&firmware, "firmware", "", "path to place firmware")
+	pullFilesCmd.Flags().StringVar(&bootloader, "bootloader", "", "path to place bootloader")
+	pullFilesCmd.Flags().StringVar(&kernelModules, "kernel-modules", "", "path to place kernel modules bundle")
 	pullFilesCmd.Flags().StringVar(&rootDisk, "root", "", "path to place root disk")
+	pullFilesCmd.Flags().StringArrayVar(&otherFiles, "other", []string{}, "path to place each other item, in order, may be invoked multiple times; an empty path skips that item")
 	pullFilesCmd.Flags().IntVar(&blocksize, "blocksize", content.DefaultBlocksize, "blocksize to use for gunzip/untar")
+	pullFilesCmd.Flags().StringVar(&platformStr, "platform", "", "platform to pull when the image is an index, e.g. linux/arm64, defaults to the current platform")
 	pullFilesCmd.Flags().BoolVar(&debug, "debug", false, "debug output")
 	pullFilesCmd.Flags().BoolVar(&verbose, "verbose", false, "verbose output")
+	parallelFlags(pullFilesCmd)
 }
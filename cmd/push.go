@@ -6,6 +6,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/containerd/platforms"
 	"github.com/lf-edge/edge-containers/pkg/registry"
 
 	"github.com/sirupsen/logrus"
@@ -13,15 +14,28 @@ import (
 )
 
 var (
-	kernelFile string
-	initrdFile string
-	rootFile   string
-	configFile string
-	formatStr  string
-	disks      []string
-	author     string
-	osname     string
-	arch       string
+	kernelFile        string
+	initrdFile        string
+	deviceTreeFile    string
+	firmwareFile      string
+	bootloaderFile    string
+	kernelModulesFile string
+	rootFile          string
+	configFile        string
+	formatStr         string
+	disks             []string
+	others            []string
+	author            string
+	osname            string
+	arch              string
+	// platformArtifacts one entry per platform, when pushing an index
+	platformArtifacts []string
+	// ECI settings for the generated config
+	kernelCmdline      string
+	bootMode           string
+	virtualizationMode string
+	minVCPUs           int
+	minMemory          int64
 )
 
 var pushCmd = &cobra.Command{
@@ -34,6 +48,44 @@ var pushCmd = &cobra.Command{
 			log.Fatal("must be exactly one arg, run help")
 		}
 		image := args[0]
+		if debug {
+			logrus.SetLevel(logrus.DebugLevel)
+		}
+		// convert the format string into a proper format
+		format, ok := registry.NameToFormat[formatStr]
+		if !ok {
+			log.Fatalf("unknown format: %v", formatStr)
+		}
+		location := ""
+		if remote != "" {
+			location = fmt.Sprintf("to %s ", remote)
+		}
+
+		// multiple platforms are pushed as an index
+		if len(platformArtifacts) > 0 {
+			if kernelFile != "" || initrdFile != "" || deviceTreeFile != "" || firmwareFile != "" || bootloaderFile != "" || kernelModulesFile != "" || rootFile != "" || configFile != "" || len(disks) > 0 || len(others) > 0 {
+				log.Fatal("cannot combine --platform-artifact with --kernel, --initrd, --devicetree, --firmware, --bootloader, --kernel-modules, --root, --config, --disk or --other")
+			}
+			artifacts := make([]registry.PlatformArtifact, 0, len(platformArtifacts))
+			for _, p := range platformArtifacts {
+				artifact, err := platformArtifactToStruct(p)
+				if err != nil {
+					log.Fatalf("unable to read platform artifact %s: %v", p, err)
+				}
+				artifacts = append(artifacts, *artifact)
+			}
+			pusher := registry.Pusher{
+				Image: image,
+				Retry: retryOpts,
+			}
+			hash, err := pusher.PushIndex(format, verbose, os.Stdout, artifacts, remoteTarget)
+			if err != nil {
+				log.Fatalf("error pushing to registry: %v", err)
+			}
+			fmt.Printf("Pushed index %s %swith digest %s\n", image, location, hash)
+			return
+		}
+
 		// convert the disks to Disk struct
 		var (
 			rootDisk *registry.Disk
@@ -53,48 +105,54 @@ var pushCmd = &cobra.Command{
 			}
 			addlDisks = append(addlDisks, disk)
 		}
-		if debug {
-			logrus.SetLevel(logrus.DebugLevel)
-		}
 
 		// construct and pass along
 		var config registry.Source
 		if configFile != "" {
 			config = &registry.FileSource{Path: configFile}
 		}
+		otherItems := make([]registry.Source, 0, len(others))
+		for _, o := range others {
+			otherItems = append(otherItems, &registry.FileSource{Path: o})
+		}
 		artifact := &registry.Artifact{
-			Kernel: &registry.FileSource{Path: kernelFile},
-			Initrd: &registry.FileSource{Path: initrdFile},
 			Root:   rootDisk,
 			Config: config,
 			Disks:  addlDisks,
+			Other:  otherItems,
+		}
+		if kernelFile != "" {
+			artifact.Kernel = &registry.FileSource{Path: kernelFile}
+		}
+		if initrdFile != "" {
+			artifact.Initrd = &registry.FileSource{Path: initrdFile}
+		}
+		if deviceTreeFile != "" {
+			artifact.DeviceTree = &registry.FileSource{Path: deviceTreeFile}
+		}
+		if firmwareFile != "" {
+			artifact.Firmware = &registry.FileSource{Path: firmwareFile}
+		}
+		if bootloaderFile != "" {
+			artifact.Bootloader = &registry.FileSource{Path: bootloaderFile}
+		}
+		if kernelModulesFile != "" {
+			artifact.KernelModules = &registry.FileSource{Path: kernelModulesFile}
 		}
 		pusher := registry.Pusher{
 			Artifact: artifact,
 			Image:    image,
-		}
-		// convert the format string into a proper format
-		var format registry.Format
-		switch formatStr {
-		case "artifacts":
-			format = registry.FormatArtifacts
-		case "legacy":
-			format = registry.FormatLegacy
-		default:
-			log.Fatalf("unknown format: %v", formatStr)
+			Retry:    retryOpts,
 		}
 		hash, err := pusher.Push(format, verbose, os.Stdout, registry.ConfigOpts{
 			Author:       author,
 			OS:           osname,
 			Architecture: arch,
+			ECI:          eciSettings(),
 		}, remoteTarget)
 		if err != nil {
 			log.Fatalf("error pushing to registry: %v", err)
 		}
-		location := ""
-		if remote != "" {
-			location = fmt.Sprintf("to %s ", remote)
-		}
 		fmt.Printf("Pushed image %s %swith digest %s\n", image, location, hash)
 	},
 }
@@ -102,13 +160,24 @@ var pushCmd = &cobra.Command{
 func pushInit() {
 	pushCmd.Flags().StringVar(&kernelFile, "kernel", "", "path to kernel file, optional")
 	pushCmd.Flags().StringVar(&initrdFile, "initrd", "", "path to initrd file, optional")
+	pushCmd.Flags().StringVar(&deviceTreeFile, "devicetree", "", "path to device tree blob, optional")
+	pushCmd.Flags().StringVar(&firmwareFile, "firmware", "", "path to firmware, e.g. UEFI firmware or OVMF vars, optional")
+	pushCmd.Flags().StringVar(&bootloaderFile, "bootloader", "", "path to bootloader, optional")
+	pushCmd.Flags().StringVar(&kernelModulesFile, "kernel-modules", "", "path to kernel modules bundle, optional")
 	pushCmd.Flags().StringVar(&rootFile, "root", "", "path to root disk file and type")
 	pushCmd.Flags().StringVar(&configFile, "config", "", "path to ECI manifest config")
 	pushCmd.Flags().StringVar(&author, "author", registry.DefaultAuthor, "author to use in generated config, if config not provided")
 	pushCmd.Flags().StringVar(&osname, "OS", registry.DefaultOS, "os to use in generated config, if config not provided")
 	pushCmd.Flags().StringVar(&arch, "arch", registry.DefaultArch, "arch to use in generated config, if config not provided")
 	pushCmd.Flags().StringSliceVar(&disks, "disk", []string{}, "path to additional disk and type, may be invoked multiple times")
-	pushCmd.Flags().StringVar(&formatStr, "format", "artifacts", "which format to use, one of: artifacts, legacy")
+	pushCmd.Flags().StringSliceVar(&others, "other", []string{}, "path to other file to include, e.g. a license or cloud-init data, may be invoked multiple times")
+	pushCmd.Flags().StringArrayVar(&platformArtifacts, "platform-artifact", []string{}, "artifact for a single platform, pushed together as an index, in the form platform=<os>/<arch>[/<variant>],kernel=<path>,initrd=<path>,devicetree=<path>,firmware=<path>,bootloader=<path>,kernel-modules=<path>,root=<path>:<type>,disk=<path>:<type>,other=<path>,config=<path>; all but platform are optional, disk and other may be repeated; may be invoked multiple times, once per platform")
+	pushCmd.Flags().StringVar(&kernelCmdline, "kernel-cmdline", "", "kernel command line to use in generated config, if config not provided")
+	pushCmd.Flags().StringVar(&bootMode, "boot-mode", "", "boot mode to use in generated config, if config not provided, one of: bios, uefi, direct-kernel")
+	pushCmd.Flags().StringVar(&virtualizationMode, "virtualization-mode", "", "virtualization mode to use in generated config, if config not provided, one of: hvm, pv, fml, none")
+	pushCmd.Flags().IntVar(&minVCPUs, "min-vcpus", 0, "minimum number of vCPUs to use in generated config, if config not provided")
+	pushCmd.Flags().Int64Var(&minMemory, "min-memory", 0, "minimum memory in MiB to use in generated config, if config not provided")
+	pushCmd.Flags().StringVar(&formatStr, "format", "artifacts", "which format to use, one of: artifacts, legacy, oci11, docker")
 	pushCmd.Flags().BoolVar(&debug, "debug", false, "debug output")
 	pushCmd.Flags().BoolVar(&verbose, "verbose", false, "verbose output")
 }
@@ -129,3 +198,77 @@ func diskToStruct(path string) (*registry.Disk, error) {
 		Type:   diskType,
 	}, nil
 }
+
+// eciSettings the ECI settings for the generated config from the flags, nil if none were set
+func eciSettings() *registry.ECISettings {
+	if kernelCmdline == "" && bootMode == "" && virtualizationMode == "" && minVCPUs == 0 && minMemory == 0 {
+		return nil
+	}
+	settings := &registry.ECISettings{
+		KernelCommandLine:  kernelCmdline,
+		BootMode:           registry.BootMode(bootMode),
+		VirtualizationMode: registry.VirtualizationMode(virtualizationMode),
+	}
+	if minVCPUs != 0 || minMemory != 0 {
+		settings.Resources = &registry.Resources{MinVCPUs: minVCPUs, MinMemoryMiB: minMemory}
+	}
+	return settings
+}
+
+// convert a "platform=<os>/<arch>,kernel=<path>,..." to a PlatformArtifact struct
+func platformArtifactToStruct(spec string) (*registry.PlatformArtifact, error) {
+	var (
+		platformSet bool
+		configOpts  = registry.ConfigOpts{Author: author, ECI: eciSettings()}
+		artifact    = &registry.Artifact{Disks: []*registry.Disk{}}
+	)
+	for _, part := range strings.Split(spec, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("expected structure <key>=<value>, got %s", part)
+		}
+		switch kv[0] {
+		case "platform":
+			platform, err := platforms.Parse(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid platform %s: %v", kv[1], err)
+			}
+			configOpts.OS, configOpts.Architecture, configOpts.Variant = platform.OS, platform.Architecture, platform.Variant
+			platformSet = true
+		case "kernel":
+			artifact.Kernel = &registry.FileSource{Path: kv[1]}
+		case "initrd":
+			artifact.Initrd = &registry.FileSource{Path: kv[1]}
+		case "devicetree":
+			artifact.DeviceTree = &registry.FileSource{Path: kv[1]}
+		case "firmware":
+			artifact.Firmware = &registry.FileSource{Path: kv[1]}
+		case "bootloader":
+			artifact.Bootloader = &registry.FileSource{Path: kv[1]}
+		case "kernel-modules":
+			artifact.KernelModules = &registry.FileSource{Path: kv[1]}
+		case "config":
+			artifact.Config = &registry.FileSource{Path: kv[1]}
+		case "root":
+			disk, err := diskToStruct(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid root disk %s: %v", kv[1], err)
+			}
+			artifact.Root = disk
+		case "disk":
+			disk, err := diskToStruct(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid disk %s: %v", kv[1], err)
+			}
+			artifact.Disks = append(artifact.Disks, disk)
+		case "other":
+			artifact.Other = append(artifact.Other, &registry.FileSource{Path: kv[1]})
+		default:
+			return nil, fmt.Errorf("unknown key %s", kv[0])
+		}
+	}
+	if !platformSet {
+		return nil, fmt.Errorf("must specify platform")
+	}
+	return &registry.PlatformArtifact{Artifact: artifact, ConfigOpts: configOpts}, nil
+}
@@ -0,0 +1,180 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/distribution/reference"
+	ecresolver "github.com/lf-edge/edge-containers/pkg/resolver"
+	"github.com/spf13/cobra"
+)
+
+// environment variables for the registry options, overridden by the flags
+const (
+	envRegistryConfig = "ECI_REGISTRY_CONFIG"
+	envPlainHTTP      = "ECI_PLAIN_HTTP"
+	envInsecure       = "ECI_INSECURE"
+	envCAFile         = "ECI_CA_FILE"
+	envCert           = "ECI_CERT"
+	envKey            = "ECI_KEY"
+	envAuthConfig     = "ECI_AUTH_CONFIG"
+	envUsername       = "ECI_USERNAME"
+	envPassword       = "ECI_PASSWORD" //nolint:gosec // name of the variable, not a credential
+	envRegistry       = "ECI_REGISTRY"
+	envChunkSize      = "ECI_CHUNK_SIZE"
+	envUploadState    = "ECI_UPLOAD_STATE"
+)
+
+var (
+	registryConfig string
+	registryFlags  ecresolver.RegistryOptions
+	// registryOpts the options from the flags, environment and config file
+	registryOpts  ecresolver.RegistryOptions
+	username      string
+	passwordStdin bool
+	// password the password given for this invocation, if any
+	password  string
+	retryOpts ecresolver.RetryOptions
+	// chunkSize the size of the chunks to upload blobs in, in MiB
+	chunkSize int64
+	// credentialsRegistry the registry host that the username and password are for
+	credentialsRegistry string
+)
+
+func registryInit() {
+	flags := rootCmd.PersistentFlags()
+	flags.StringVar(&registryConfig, "registry-config", os.Getenv(envRegistryConfig), fmt.Sprintf("json file of options to connect to the registry, e.g. {\"caFile\": \"/etc/eci/ca.pem\"}, overridden by the flags and environment variables, default $%s", envRegistryConfig))
+	flags.BoolVar(&registryFlags.PlainHTTP, "plain-http", false, fmt.Sprintf("use http rather than https for the registry, default $%s", envPlainHTTP))
+	flags.BoolVar(&registryFlags.Insecure, "insecure", false, fmt.Sprintf("do not verify the certificate of the registry, default $%s", envInsecure))
+	flags.StringVar(&registryFlags.CAFile, "ca-file", "", fmt.Sprintf("PEM file of certificate authorities to trust for the registry, default $%s", envCAFile))
+	flags.StringVar(&registryFlags.CertFile, "cert", "", fmt.Sprintf("PEM file of the client certificate for the registry, requires --key, default $%s", envCert))
+	flags.StringVar(&registryFlags.KeyFile, "key", "", fmt.Sprintf("PEM file of the key of the client certificate for the registry, default $%s", envKey))
+	flags.StringVar(&registryFlags.AuthConfig, "auth-config", "", fmt.Sprintf("docker config file to store and read the credentials for registries, default $%s, else that of docker", envAuthConfig))
+	flags.StringVar(&username, "username", "", fmt.Sprintf("username for the registry, instead of the stored credentials, default $%s", envUsername))
+	flags.IntVar(&retryOpts.Attempts, "retries", 5, "times to retry a transfer that fails with a transient error, e.g. a dropped connection or an http status 429 or 503, or stalls; 0 to never retry")
+	flags.DurationVar(&retryOpts.Backoff, "retry-backoff", ecresolver.DefaultRetryBackoff, "delay before the first retry, doubled for each retry after it, unless the registry asks for another with Retry-After")
+	flags.DurationVar(&retryOpts.MaxBackoff, "retry-max-backoff", ecresolver.DefaultRetryMaxBackoff, "longest delay between retries")
+	flags.DurationVar(&retryOpts.StallTimeout, "stall-timeout", time.Minute, "retry the transfer of a blob when no data arrives for this long, continuing from where it stopped; 0 to wait forever")
+	flags.Int64Var(&chunkSize, "chunk-size", 0, fmt.Sprintf("upload blobs in chunks of this many MiB, continuing an upload that stops partway from the last chunk the registry has, rather than in a single request; 0 for a single request, default $%s", envChunkSize))
+	flags.StringVar(&registryFlags.UploadState, "upload-state", "", fmt.Sprintf("directory to record the chunked uploads in progress, so that a push run again continues them, default $%s, else eci/uploads in the user cache directory", envUploadState))
+	flags.BoolVar(&passwordStdin, "password-stdin", false, fmt.Sprintf("read the password or token for the registry from stdin, instead of $%s", envPassword))
+	flags.StringVar(&credentialsRegistry, "registry", "", fmt.Sprintf("registry host that --username and the password are for, e.g. registry.example.com, default $%s, else that of the image; other registries, e.g. mirrors, get the stored credentials", envRegistry))
+}
+
+// registryOptions the options to connect to the registry, from the config file, then the environment,
+// then the flags, for the command run with the args
+func registryOptions(cmd *cobra.Command, args []string) (ecresolver.RegistryOptions, error) {
+	var opts ecresolver.RegistryOptions
+	if registryConfig != "" {
+		var err error
+		if opts, err = ecresolver.LoadRegistryOptions(registryConfig); err != nil {
+			return opts, err
+		}
+	}
+	for env, value := range map[string]*bool{envPlainHTTP: &opts.PlainHTTP, envInsecure: &opts.Insecure} {
+		if s := os.Getenv(env); s != "" {
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return opts, fmt.Errorf("invalid %s=%s: %v", env, s, err)
+			}
+			*value = b
+		}
+	}
+	for env, value := range map[string]*string{envCAFile: &opts.CAFile, envCert: &opts.CertFile, envKey: &opts.KeyFile, envAuthConfig: &opts.AuthConfig, envUploadState: &opts.UploadState} {
+		if s := os.Getenv(env); s != "" {
+			*value = s
+		}
+	}
+	if s := os.Getenv(envChunkSize); s != "" {
+		mib, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || mib < 0 {
+			return opts, fmt.Errorf("invalid %s=%s", envChunkSize, s)
+		}
+		opts.ChunkSize = mib << 20
+	}
+	flags := cmd.Flags()
+	if flags.Changed("plain-http") {
+		opts.PlainHTTP = registryFlags.PlainHTTP
+	}
+	if flags.Changed("insecure") {
+		opts.Insecure = registryFlags.Insecure
+	}
+	if flags.Changed("ca-file") {
+		opts.CAFile = registryFlags.CAFile
+	}
+	if flags.Changed("cert") {
+		opts.CertFile = registryFlags.CertFile
+	}
+	if flags.Changed("key") {
+		opts.KeyFile = registryFlags.KeyFile
+	}
+	if flags.Changed("auth-config") {
+		opts.AuthConfig = registryFlags.AuthConfig
+	}
+	if flags.Changed("chunk-size") {
+		if chunkSize < 0 {
+			return opts, fmt.Errorf("invalid --chunk-size %d", chunkSize)
+		}
+		opts.ChunkSize = chunkSize << 20
+	}
+	if flags.Changed("upload-state") {
+		opts.UploadState = registryFlags.UploadState
+	}
+	if opts.UploadState == "" {
+		if cache, err := os.UserCacheDir(); err == nil {
+			opts.UploadState = filepath.Join(cache, "eci", "uploads")
+		}
+	}
+
+	if !flags.Changed("username") {
+		username = os.Getenv(envUsername)
+	}
+	password = os.Getenv(envPassword)
+	if passwordStdin {
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return opts, fmt.Errorf("unable to read password from stdin: %v", err)
+		}
+		password = strings.TrimRight(string(b), "\r\n")
+	}
+	if username != "" && password == "" {
+		return opts, fmt.Errorf("--username requires a password, with --password-stdin or $%s", envPassword)
+	}
+	if password != "" {
+		host, err := credentialsHost(cmd, args)
+		if err != nil {
+			return opts, err
+		}
+		if host != "" {
+			opts.Credentials = ecresolver.StaticCredentials(host, username, password)
+		}
+	}
+	opts.Retry = retryOpts
+	return opts, nil
+}
+
+// credentialsHost the registry host that the username and password given for the command run with the args are for:
+// that of --registry, else of the image, or the host logged in to or out of; "" if the command has none
+func credentialsHost(cmd *cobra.Command, args []string) (string, error) {
+	if !cmd.Flags().Changed("registry") {
+		credentialsRegistry = os.Getenv(envRegistry)
+	}
+	switch {
+	case credentialsRegistry != "":
+		return credentialsRegistry, nil
+	case len(args) == 0:
+		return "", nil
+	case cmd == loginCmd || cmd == logoutCmd:
+		return args[0], nil
+	}
+	named, err := reference.ParseNormalizedNamed(args[0])
+	if err != nil {
+		return "", fmt.Errorf("unable to get the registry of %s for the password, give it with --registry or $%s: %v", args[0], envRegistry, err)
+	}
+	return reference.Domain(named), nil
+}
@@ -2,7 +2,9 @@ package cmd
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"net/url"
 	"strings"
 
 	ecresolver "github.com/lf-edge/edge-containers/pkg/resolver"
@@ -11,6 +13,7 @@ import (
 
 var (
 	remote       string
+	mirrors      []string
 	remoteTarget ecresolver.ResolverCloser
 	ctrNamespace string
 )
@@ -21,26 +24,40 @@ var rootCmd = &cobra.Command{
 	Long: `Utility to manage an ECI, either push to or pull from a registry. The registry can be the default based on
 	its tag, e.g. library/alpine:3.11 would go to docker hub, a local directory cache, or containerd. Use the --remote
 	flag to indicate where to go. Blank ("") is the default registry, /path or file:///path is for a local directory,
-	containerd:/path/to/socket is for containerd.`,
+	oci-archive:/path/file.tar is for a tar archive of a local directory, docker-archive:/path/file.tar is for a tar archive
+	as written by docker save and read by docker load, containerd:/path/to/socket is for containerd. Options are passed
+	as a query, e.g. containerd:///run/containerd/containerd.sock?namespace=eve. Other schemes can be added by tools
+	that embed the library. Use --mirror, which may be repeated, to pull from mirrors, e.g. a site registry, before
+	the remote, falling back to the next mirror, and finally the remote, for content one does not have. How to connect to a registry, e.g. with a custom CA, is set with the flags --plain-http,
+	--insecure, --ca-file, --cert and --key, their environment variables, or a --registry-config file. Credentials
+	are those stored by eci login, or docker login, unless given with --username and --password-stdin, or ECI_USERNAME
+	and ECI_PASSWORD, which are sent only to the registry of the image, or that given with --registry or ECI_REGISTRY.`,
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
-		var (
-			err error
-			ctx = context.TODO()
-		)
-		switch {
-		case remote == "":
-			_, remoteTarget, err = ecresolver.NewRegistry(ctx)
-		case strings.HasPrefix(remote, "containerd:"):
-			_, remoteTarget, err = ecresolver.NewContainerd(ctx, strings.Replace(remote, "containerd:", "", 1), ctrNamespace)
-		case strings.HasPrefix(remote, "file://"):
-			_, remoteTarget, err = ecresolver.NewDirectory(ctx, strings.Replace(remote, "file://", "", 1))
-		case strings.HasPrefix(remote, "/"):
-			_, remoteTarget, err = ecresolver.NewDirectory(ctx, remote)
-		default:
-			log.Fatalf("unknown remote: %s", remote)
-		}
+		var err error
+		registryOpts, err = registryOptions(cmd, args)
 		if err != nil {
-			log.Fatalf("unexpected error when created NewRegistry resolver: %v", err)
+			log.Fatal(err)
+		}
+		ctx := ecresolver.WithRegistryOptions(context.TODO(), registryOpts)
+		// the mirrors, in order, then the remote
+		var chain []ecresolver.ResolverCloser
+		for _, r := range append(append([]string{}, mirrors...), remote) {
+			uri, err := remoteURI(r)
+			if err != nil {
+				log.Fatal(err)
+			}
+			_, target, err := ecresolver.Open(ctx, uri)
+			if err != nil {
+				log.Fatalf("unable to open remote %s: %v", r, err)
+			}
+			chain = append(chain, target)
+		}
+		if len(chain) == 1 {
+			remoteTarget = chain[0]
+			return
+		}
+		if _, remoteTarget, err = ecresolver.NewChain(ctx, chain...); err != nil {
+			log.Fatal(err)
 		}
 	},
 }
@@ -52,10 +69,38 @@ func init() {
 	pullInit()
 	rootCmd.AddCommand(pullFilesCmd)
 	pullFilesInit()
+	rootCmd.AddCommand(inspectCmd)
+	inspectInit()
+	rootCmd.AddCommand(gcCmd)
+	gcInit()
+	rootCmd.AddCommand(fsckCmd)
+	fsckInit()
+	rootCmd.AddCommand(loginCmd)
+	loginInit()
+	rootCmd.AddCommand(logoutCmd)
+	registryInit()
 
 	rootCmd.PersistentFlags().StringVar(&remote, "remote", "", "remote to use for push/pull, leave blank to use default registry for image")
-	rootCmd.PersistentFlags().StringVar(&ctrNamespace, "namespace", "default", "namespace to use for containerd, ignored for all other remotes")
+	rootCmd.PersistentFlags().StringArrayVar(&mirrors, "mirror", []string{}, "mirror of the remote to pull from, tried in order before the remote, which is used when they do not have the content; may be repeated; pushes go only to the remote")
+	rootCmd.PersistentFlags().StringVar(&ctrNamespace, "namespace", "default", "namespace to use for containerd, unless the remote has a namespace option, ignored for all other remotes")
+
+}
 
+// remoteURI the remote, with the --namespace flag as the namespace of a containerd remote that has none
+func remoteURI(remote string) (string, error) {
+	if !strings.HasPrefix(remote, "containerd:") {
+		return remote, nil
+	}
+	u, err := url.Parse(remote)
+	if err != nil {
+		return "", fmt.Errorf("invalid remote %s: %v", remote, err)
+	}
+	query := u.Query()
+	if query.Get("namespace") == "" {
+		query.Set("namespace", ctrNamespace)
+		u.RawQuery = query.Encode()
+	}
+	return u.String(), nil
 }
 
 // Execute primary function for cobra
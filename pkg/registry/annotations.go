@@ -1,11 +1,19 @@
 package registry
 
 const (
-	AnnotationMediaType            = "org.lfedge.eci.mediaType"
-	AnnotationRole                 = "org.lfedge.eci.role"
-	AnnotationRootPath             = "org.lfedge.eci.artifact.root"
-	AnnotationInitrdPath           = "org.lfedge.eci.artifact.initrd"
-	AnnotationKernelPath           = "org.lfedge.eci.artifact.kernel"
-	AnnotationDiskIndexPathPattern = "org.lfedge.eci.artifact.disk-%d"
-	AnnotationOther                = "org.lfedge.eci.other"
+	AnnotationMediaType             = "org.lfedge.eci.mediaType"
+	AnnotationRole                  = "org.lfedge.eci.role"
+	AnnotationRootPath              = "org.lfedge.eci.artifact.root"
+	AnnotationInitrdPath            = "org.lfedge.eci.artifact.initrd"
+	AnnotationKernelPath            = "org.lfedge.eci.artifact.kernel"
+	AnnotationDiskIndexPathPattern  = "org.lfedge.eci.artifact.disk-%d"
+	AnnotationOtherIndexPathPattern = "org.lfedge.eci.artifact.other-%d"
+	AnnotationDeviceTreePath        = "org.lfedge.eci.artifact.devicetree"
+	AnnotationFirmwarePath          = "org.lfedge.eci.artifact.firmware"
+	AnnotationBootloaderPath        = "org.lfedge.eci.artifact.bootloader"
+	AnnotationKernelModulesPath     = "org.lfedge.eci.artifact.kernel-modules"
+	// AnnotationOther the single label formerly used for all other items.
+	//
+	// Deprecated: each other item has its own label, see AnnotationOtherIndexPathPattern
+	AnnotationOther = "org.lfedge.eci.other"
 )
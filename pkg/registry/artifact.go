@@ -1,6 +1,9 @@
 package registry
 
-import "path"
+import (
+	"path"
+	"strings"
+)
 
 type DiskType int
 
@@ -116,13 +119,21 @@ type Artifact struct {
 	Kernel Source
 	// Initrd path to the initrd file
 	Initrd Source
+	// DeviceTree path to the device tree blob
+	DeviceTree Source
+	// Firmware path to the firmware, e.g. UEFI firmware or OVMF vars
+	Firmware Source
+	// Bootloader path to the bootloader
+	Bootloader Source
+	// KernelModules path to the bundle of kernel modules
+	KernelModules Source
 	// Config path to the config
 	Config Source
 	// Root path to the root disk and its type
 	Root *Disk
-	// Disks paths and types for additional disks
+	// Disks paths and types for additional disks, by index; a nil entry is skipped
 	Disks []*Disk
-	// Other other items that did not have appropriate annotations
+	// Other other items that did not have appropriate annotations, by index; a nil entry is skipped
 	Other []Source
 }
 
@@ -156,3 +167,14 @@ var MimeToType = map[string]DiskType{
 	MimeTypeECIDiskOva:   Ova,
 	MimeTypeECIDiskVhdx:  Vhdx,
 }
+
+// DiskTypeFromName infer the type of a disk from the extension of its file name,
+// e.g. root.qcow2 is Qcow2. Returns false if the extension is not a known disk type.
+func DiskTypeFromName(name string) (DiskType, bool) {
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))
+	if ext == "img" {
+		return Raw, true
+	}
+	t, ok := NameToType[ext]
+	return t, ok
+}
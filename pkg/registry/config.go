@@ -1,7 +1,131 @@
 package registry
 
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
 type ConfigOpts struct {
 	Author       string
 	OS           string
 	Architecture string
+	Variant      string
+	// ECI settings to include in the generated config; if nil, none are included
+	ECI *ECISettings
+}
+
+// Platform the platform described by the ConfigOpts, using the defaults for any
+// OS or Architecture that are not set
+func (c ConfigOpts) Platform() ocispec.Platform {
+	platform := ocispec.Platform{
+		OS:           c.OS,
+		Architecture: c.Architecture,
+		Variant:      c.Variant,
+	}
+	if platform.OS == "" {
+		platform.OS = DefaultOS
+	}
+	if platform.Architecture == "" {
+		platform.Architecture = DefaultArch
+	}
+	return platform
+}
+
+// PlatformArtifact an Artifact to be placed in an index, along with the ConfigOpts
+// that describe the platform it is for
+type PlatformArtifact struct {
+	Artifact   *Artifact
+	ConfigOpts ConfigOpts
+}
+
+// ECIConfigVersion the version of the ECISettings written by this library
+const ECIConfigVersion = 1
+
+// BootMode how an ECI is booted
+type BootMode string
+
+const (
+	// BootModeBIOS boot via legacy BIOS firmware
+	BootModeBIOS BootMode = "bios"
+	// BootModeUEFI boot via UEFI firmware
+	BootModeUEFI BootMode = "uefi"
+	// BootModeDirectKernel boot the kernel and initrd directly, without firmware
+	BootModeDirectKernel BootMode = "direct-kernel"
+)
+
+// VirtualizationMode the kind of virtualization an ECI requires
+type VirtualizationMode string
+
+const (
+	// VirtualizationModeHVM hardware-assisted full virtualization
+	VirtualizationModeHVM VirtualizationMode = "hvm"
+	// VirtualizationModePV paravirtualization
+	VirtualizationModePV VirtualizationMode = "pv"
+	// VirtualizationModeFML full virtualization with device passthrough, e.g. for desktop OSes
+	VirtualizationModeFML VirtualizationMode = "fml"
+	// VirtualizationModeNone run without a hypervisor
+	VirtualizationModeNone VirtualizationMode = "none"
+)
+
+//go:embed schema/config.v1.json
+var configSchemaJSON string
+
+var (
+	configSchema     *jsonschema.Schema
+	configSchemaErr  error
+	configSchemaOnce sync.Once
+)
+
+// ECISettings the ECI-specific settings for booting and running an ECI
+type ECISettings struct {
+	// Version version of the settings; when generating a config, 0 is replaced with ECIConfigVersion
+	Version int `json:"version"`
+	// KernelCommandLine command line to pass to the kernel
+	KernelCommandLine string `json:"kernelCommandLine,omitempty"`
+	// BootMode how the ECI is booted
+	BootMode BootMode `json:"bootMode,omitempty"`
+	// VirtualizationMode the kind of virtualization the ECI requires
+	VirtualizationMode VirtualizationMode `json:"virtualizationMode,omitempty"`
+	// Resources minimum resources required to run the ECI
+	Resources *Resources `json:"resources,omitempty"`
+}
+
+// Resources minimum resources required to run an ECI
+type Resources struct {
+	// MinVCPUs minimum number of virtual CPUs
+	MinVCPUs int `json:"minVCPUs,omitempty"`
+	// MinMemoryMiB minimum memory, in MiB
+	MinMemoryMiB int64 `json:"minMemoryMiB,omitempty"`
+}
+
+// ECIConfig the config of an ECI, with media type MimeTypeECIConfig. It is a superset of the
+// OCI image config, so tools that only understand the latter still can read it.
+type ECIConfig struct {
+	ocispec.Image
+	// ECI the ECI-specific settings, nil if the config has none
+	ECI *ECISettings `json:"eci,omitempty"`
+}
+
+// ValidateConfig validate the contents of a config against the ECI config JSON schema,
+// which is at schema/config.v1.json
+func ValidateConfig(data []byte) error {
+	configSchemaOnce.Do(func() {
+		configSchema, configSchemaErr = jsonschema.CompileString("config.v1.json", configSchemaJSON)
+	})
+	if configSchemaErr != nil {
+		return fmt.Errorf("invalid config schema: %v", configSchemaErr)
+	}
+	var v interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil {
+		return fmt.Errorf("config is not valid json: %v", err)
+	}
+	return configSchema.Validate(v)
 }
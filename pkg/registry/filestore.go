@@ -0,0 +1,123 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	ctrcontent "github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/remotes"
+	ecresolver "github.com/lf-edge/edge-containers/pkg/resolver"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/pkg/content"
+)
+
+// FileStore the oras file store, which writes each blob to the file named by its title, that continues
+// the pull of a blob from where an earlier one stopped, rather than starting over. Its state is kept beside
+// the file until the blob is complete.
+//
+// Blobs that are unpacked into a directory, and all blobs when DisableOverwrite is set, are written by the
+// oras file store as is. The others are not added to it, so can be read only from their files.
+type FileStore struct {
+	*content.File
+	root string
+}
+
+// NewFileStore create a file store that writes to the root directory
+func NewFileStore(root string, opts ...content.WriterOpt) *FileStore {
+	return &FileStore{File: content.NewFile(root, opts...), root: root}
+}
+
+// Pusher get a pusher to push content
+func (s *FileStore) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	pusher, err := s.File.Pusher(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return fileStorePusher{store: s, pusher: pusher}, nil
+}
+
+type fileStorePusher struct {
+	store  *FileStore
+	pusher remotes.Pusher
+}
+
+func (p fileStorePusher) Push(ctx context.Context, desc ocispec.Descriptor) (ctrcontent.Writer, error) {
+	name, ok := content.ResolveName(desc)
+	if !ok || desc.Annotations[content.AnnotationUnpack] == "true" || p.store.DisableOverwrite {
+		return p.pusher.Push(ctx, desc)
+	}
+	filename := p.store.ResolvePath(name)
+	if !p.store.AllowPathTraversalOnWrite {
+		if err := withinRoot(p.store.root, filename); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return nil, fmt.Errorf("could not create directory for %s: %v", filename, err)
+	}
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open for writing %s: %v", filename, err)
+	}
+	w, err := ecresolver.NewPartialWriter(file, filename+ecresolver.PartialSuffix, desc, false)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return &fileStoreWriter{PartialWriter: w, file: file}, nil
+}
+
+// withinRoot check that the path is within the root, as the oras file store does
+func withinRoot(root, path string) error {
+	base, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	target, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(base, target)
+	if err != nil {
+		return content.ErrPathTraversalDisallowed
+	}
+	rel = filepath.ToSlash(rel)
+	if strings.HasPrefix(rel, "../") || rel == ".." {
+		return content.ErrPathTraversalDisallowed
+	}
+	return nil
+}
+
+// fileStoreWriter writer of a blob to its file, which it closes when done
+type fileStoreWriter struct {
+	*ecresolver.PartialWriter
+	file *os.File
+}
+
+func (w *fileStoreWriter) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.PartialWriter.Close()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	w.file = nil
+	return err
+}
+
+func (w *fileStoreWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...ctrcontent.Opt) error {
+	if w.file == nil {
+		return fmt.Errorf("writer for %s is closed", w.Digest())
+	}
+	err := w.PartialWriter.Commit(ctx, size, expected, opts...)
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	w.file = nil
+	return err
+}
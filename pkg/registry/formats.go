@@ -1,6 +1,7 @@
 package registry
 
 import (
+	"fmt"
 	"time"
 )
 
@@ -9,8 +10,54 @@ type Format int
 const (
 	FormatArtifacts Format = iota
 	FormatLegacy
+	// FormatOCI11 OCI image-spec v1.1 artifact, with the artifactType set on the manifest,
+	// the empty config, and the ECI config carried as a layer
+	FormatOCI11
+	// FormatDocker docker image manifest v2 schema 2, with the same layout as FormatLegacy
+	FormatDocker
 )
 
+func (f Format) String() string {
+	switch f {
+	case FormatArtifacts:
+		return "artifacts"
+	case FormatLegacy:
+		return "legacy"
+	case FormatOCI11:
+		return "oci11"
+	case FormatDocker:
+		return "docker"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// MarshalText the name of the format, e.g. for json
+func (f Format) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
+// UnmarshalText the format from its name
+func (f *Format) UnmarshalText(text []byte) error {
+	format, ok := NameToFormat[string(text)]
+	if !ok {
+		return fmt.Errorf("unknown format: %s", text)
+	}
+	*f = format
+	return nil
+}
+
+var NameToFormat = map[string]Format{
+	"artifacts": FormatArtifacts,
+	"legacy":    FormatLegacy,
+	"oci11":     FormatOCI11,
+	"docker":    FormatDocker,
+}
+
+// tarred whether the format places each file in a tar+gzip layer, like a container image filesystem
+func (f Format) tarred() bool {
+	return f == FormatLegacy || f == FormatDocker
+}
+
 type LegacyOpt func(*legacyInfo)
 
 type legacyInfo struct {
@@ -0,0 +1,259 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/containerd/containerd/remotes"
+	ecresolver "github.com/lf-edge/edge-containers/pkg/resolver"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// eciPrefix the prefix of all ECI annotations and labels
+const eciPrefix = "org.lfedge.eci."
+
+// Inspection the contents of an ECI, as described by its index, manifest and config
+type Inspection struct {
+	// Image the reference that was inspected
+	Image string `json:"image"`
+	// Descriptor the descriptor the reference resolved to, which may be for an index
+	Descriptor ocispec.Descriptor `json:"descriptor"`
+	// Index the index, if the reference resolved to one
+	Index *ocispec.Index `json:"index,omitempty"`
+	// ManifestDescriptor the descriptor of the manifest; if the reference resolved to an index,
+	// that of the manifest selected for the platform
+	ManifestDescriptor ocispec.Descriptor `json:"manifestDescriptor"`
+	// Manifest the manifest
+	Manifest ocispec.Manifest `json:"manifest"`
+	// ConfigDescriptor the descriptor of the config; for the oci11 format, that of the layer carrying it
+	ConfigDescriptor *ocispec.Descriptor `json:"configDescriptor,omitempty"`
+	// Config the config, nil if there is none
+	Config *ECIConfig `json:"config,omitempty"`
+	// ECI whether the image is an ECI, i.e. has any ECI media types, annotations or labels
+	ECI bool `json:"eci"`
+	// Format the format of the ECI. Images built with standard docker tools are FormatLegacy or FormatDocker.
+	Format Format `json:"format"`
+	// Platform the platform of the image, from the index or else from the config, if any
+	Platform *ocispec.Platform `json:"platform,omitempty"`
+	// Roles the parts of the ECI, in the order kernel, initrd, the other boot artifacts, root disk,
+	// additional disks, other items and config
+	Roles []RoleInspection `json:"roles"`
+	// Annotations the ECI annotations on the manifest
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Labels the ECI labels in the config
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// RoleInspection a single part of an ECI
+type RoleInspection struct {
+	// Role the role, e.g. RoleKernel
+	Role string `json:"role"`
+	// Index the index of additional disks and other items
+	Index int `json:"index,omitempty"`
+	// Name the name of the file when pulled, or its path in the image filesystem if from the config labels
+	Name string `json:"name"`
+	// DiskType the type of disk, for disks only
+	DiskType string `json:"diskType,omitempty"`
+	// Size the size of the layer, 0 if the file is somewhere inside a layer
+	Size int64 `json:"size,omitempty"`
+	// Digest the digest of the layer, blank if the file is somewhere inside a layer
+	Digest string `json:"digest,omitempty"`
+	// Annotations the ECI annotations on the layer
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Inspect retrieve only the index, manifest and config for the image, and describe the ECI in them. If the
+// image is an index, the manifest that best matches the Platform is inspected.
+//
+// The resolver provides the channel to connect to the target type. resolver.Registry just uses the default registry,
+// while resolver.Directory uses a local directory, etc.
+func (p *Puller) Inspect(resolver ecresolver.ResolverCloser) (*Inspection, error) {
+	// must have valid image ref
+	if p.Image == "" {
+		return nil, fmt.Errorf("must have valid image ref")
+	}
+	resolver = p.retrying(resolver)
+	// get the saved context; if nil, create a background one
+	ctx := resolver.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	_, root, err := resolver.Resolve(ctx, p.Image)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve %s: %v", p.Image, err)
+	}
+	fetcher, err := resolver.Fetcher(ctx, p.Image)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get fetcher for %s: %v", p.Image, err)
+	}
+	inspection := &Inspection{
+		Image:              p.Image,
+		Descriptor:         root,
+		ManifestDescriptor: root,
+		Roles:              []RoleInspection{},
+	}
+
+	// select the manifest from an index
+	if isIndexType(root.MediaType) {
+		var index ocispec.Index
+		if err := fetchJSON(ctx, fetcher, root, &index); err != nil {
+			return nil, fmt.Errorf("invalid index %s: %v", root.Digest, err)
+		}
+		if len(index.Manifests) == 0 {
+			return nil, fmt.Errorf("index %s has no manifests", root.Digest)
+		}
+		selected, err := selectManifest(index.Manifests, p.platform())
+		if err != nil {
+			return nil, fmt.Errorf("index %s: %v", root.Digest, err)
+		}
+		// not split by platform, so just take the first
+		if selected == nil {
+			selected = &index.Manifests[0]
+		}
+		inspection.Index = &index
+		inspection.ManifestDescriptor = *selected
+		inspection.Platform = selected.Platform
+	}
+	if err := fetchJSON(ctx, fetcher, inspection.ManifestDescriptor, &inspection.Manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %v", inspection.ManifestDescriptor.Digest, err)
+	}
+	manifest := &inspection.Manifest
+
+	// find the config, which is a layer in the oci11 format
+	configDesc := manifest.Config
+	for _, l := range manifest.Layers {
+		if l.Annotations[AnnotationRole] == RoleConfig {
+			configDesc = l
+			break
+		}
+	}
+	if IsConfigType(configDesc.MediaType) {
+		var config ECIConfig
+		if err := fetchJSON(ctx, fetcher, configDesc, &config); err != nil {
+			return nil, fmt.Errorf("invalid config %s: %v", configDesc.Digest, err)
+		}
+		inspection.ConfigDescriptor = &configDesc
+		inspection.Config = &config
+		inspection.Labels = eciOnly(config.Config.Labels)
+		if inspection.Platform == nil && config.OS != "" {
+			inspection.Platform = &config.Platform
+		}
+	}
+	inspection.Annotations = eciOnly(manifest.Annotations)
+
+	var image *ocispec.Image
+	if inspection.Config != nil {
+		image = &inspection.Config.Image
+	}
+	artifact, err := ArtifactFromManifest(manifest, image)
+	if err != nil {
+		return nil, err
+	}
+	inspection.Roles = inspectRoles(artifact, manifest.Layers)
+	inspection.Format, inspection.ECI = detectFormat(manifest, configDesc, len(inspection.Labels) > 0)
+
+	return inspection, nil
+}
+
+// fetchJSON fetch the content for desc and decode it into v
+func fetchJSON(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor, v interface{}) error {
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rc.Close() }()
+	return json.NewDecoder(rc).Decode(v)
+}
+
+// eciOnly the ECI annotations or labels from the map, nil if there are none
+func eciOnly(in map[string]string) map[string]string {
+	var out map[string]string
+	for k, v := range in {
+		if !strings.HasPrefix(k, eciPrefix) {
+			continue
+		}
+		if out == nil {
+			out = map[string]string{}
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// detectFormat the format of the ECI described by the manifest, and whether it is an ECI at all
+func detectFormat(manifest *ocispec.Manifest, configDesc ocispec.Descriptor, hasLabels bool) (Format, bool) {
+	var (
+		docker         = manifest.MediaType == MimeTypeDockerImageManifest || configDesc.MediaType == MimeTypeDockerImageConfig
+		eciMediaTypes  bool
+		eciAnnotations bool
+	)
+	for _, l := range manifest.Layers {
+		if strings.HasPrefix(l.MediaType, "application/vnd.lfedge.") {
+			eciMediaTypes = true
+		}
+		if l.Annotations[AnnotationRole] != "" {
+			eciAnnotations = true
+		}
+	}
+	switch {
+	case manifest.ArtifactType == MimeTypeECIArtifact:
+		return FormatOCI11, true
+	case configDesc.MediaType == MimeTypeECIConfig || eciMediaTypes:
+		return FormatArtifacts, true
+	case docker:
+		return FormatDocker, eciAnnotations || hasLabels
+	}
+	return FormatLegacy, eciAnnotations || hasLabels
+}
+
+// inspectRoles describe each part of the artifact, whose sources are HashSources
+func inspectRoles(artifact *Artifact, layers []ocispec.Descriptor) []RoleInspection {
+	var (
+		roles   = []RoleInspection{}
+		digests = map[string]ocispec.Descriptor{}
+	)
+	for _, l := range layers {
+		digests[l.Digest.String()] = l
+	}
+	add := func(role string, index int, source Source, disk *Disk) {
+		if source == nil {
+			return
+		}
+		r := RoleInspection{
+			Role:   role,
+			Index:  index,
+			Name:   source.GetName(),
+			Size:   source.GetSize(),
+			Digest: source.GetDigest(),
+		}
+		if disk != nil {
+			r.DiskType = strings.ToLower(disk.Type.String())
+		}
+		if l, ok := digests[r.Digest]; ok {
+			r.Annotations = eciOnly(l.Annotations)
+		}
+		roles = append(roles, r)
+	}
+	add(RoleKernel, 0, artifact.Kernel, nil)
+	add(RoleInitrd, 0, artifact.Initrd, nil)
+	add(RoleDeviceTree, 0, artifact.DeviceTree, nil)
+	add(RoleFirmware, 0, artifact.Firmware, nil)
+	add(RoleBootloader, 0, artifact.Bootloader, nil)
+	add(RoleKernelModules, 0, artifact.KernelModules, nil)
+	if artifact.Root != nil {
+		add(RoleRootDisk, 0, artifact.Root.Source, artifact.Root)
+	}
+	for i, d := range artifact.Disks {
+		if d != nil {
+			add(RoleAdditionalDisk, i, d.Source, d)
+		}
+	}
+	for i, o := range artifact.Other {
+		add(RoleOther, i, o, nil)
+	}
+	add(RoleConfig, 0, artifact.Config, nil)
+	return roles
+}
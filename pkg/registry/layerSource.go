@@ -0,0 +1,197 @@
+package registry
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/containerd/containerd/remotes"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// whiteoutPrefix the prefix of the name of an entry in a layer that removes the file of the rest
+	// of the name from the layers below
+	whiteoutPrefix = ".wh."
+	// whiteoutOpaque the name of an entry in a layer that hides the contents of its directory in the layers below
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+	// maxLayerLinks the most links followed to open a file in the layers, as with symlinks in linux
+	maxLayerLinks = 40
+)
+
+// LayerSource implements a Source for a regular file inside the tar layers of an image, e.g. one named
+// in the labels of an image built with standard docker tools. The file is not extracted when pulling;
+// Open reads it from the layers, as fetched by the Fetcher, following symlinks and hard links in them.
+type LayerSource struct {
+	// Path path to the file in the image filesystem
+	Path string
+	// Layers the layers of the image, from the bottom up; any that are not tar layers are ignored
+	Layers []ocispec.Descriptor
+	// Fetcher fetches the layers, e.g. from the resolver the image was pulled with
+	Fetcher remotes.Fetcher
+}
+
+func (l *LayerSource) GetPath() string {
+	return ""
+}
+func (l *LayerSource) GetContent() []byte {
+	return nil
+}
+func (l *LayerSource) GetName() string {
+	return path.Base(l.Path)
+}
+func (l *LayerSource) GetDigest() string {
+	return ""
+}
+func (l *LayerSource) GetSize() int64 {
+	return 0
+}
+
+// Open read the file, from the topmost layer that has it, following links to other files in the layers.
+// Returns an error that wraps fs.ErrNotExist if no layer has it, or a layer above the one that has it removes it.
+func (l *LayerSource) Open(ctx context.Context) (io.ReadCloser, error) {
+	name, top := layerPath(l.Path), len(l.Layers)-1
+	for links := 0; ; links++ {
+		if links > maxLayerLinks {
+			return nil, fmt.Errorf("%s: too many links in the layers", l.Path)
+		}
+		rc, link, layer, err := l.find(ctx, name, top)
+		if err != nil || link == nil {
+			return rc, err
+		}
+		switch link.Typeflag {
+		case tar.TypeSymlink:
+			// the target of a symlink is in the whole image filesystem, relative to the directory of the link
+			target := link.Linkname
+			if !path.IsAbs(target) {
+				target = path.Join(path.Dir(name), target)
+			}
+			name, top = layerPath(target), len(l.Layers)-1
+		case tar.TypeLink:
+			// that of a hard link is an earlier entry in the same layer
+			name, top = layerPath(link.Linkname), layer
+		}
+	}
+}
+
+// find the file of the name, from the top layer down. Returns a reader of the file, or, if it is a link,
+// its header and the layer it is in.
+func (l *LayerSource) find(ctx context.Context, name string, top int) (io.ReadCloser, *tar.Header, int, error) {
+	for i := top; i >= 0; i-- {
+		desc := l.Layers[i]
+		if !archived(desc.MediaType) {
+			continue
+		}
+		rc, err := l.Fetcher.Fetch(ctx, desc)
+		if err != nil {
+			return nil, nil, i, fmt.Errorf("unable to fetch layer %s: %v", desc.Digest, err)
+		}
+		r, link, hidden, err := layerEntry(rc, name)
+		if err != nil {
+			_ = rc.Close()
+			return nil, nil, i, fmt.Errorf("unable to read layer %s: %v", desc.Digest, err)
+		}
+		if r != nil {
+			return struct {
+				io.Reader
+				io.Closer
+			}{r, rc}, nil, i, nil
+		}
+		_ = rc.Close()
+		if link != nil {
+			return nil, link, i, nil
+		}
+		if hidden {
+			break
+		}
+	}
+	if name != layerPath(l.Path) {
+		return nil, nil, 0, fmt.Errorf("%s, linked from %s, not in the layers: %w", name, l.Path, fs.ErrNotExist)
+	}
+	return nil, nil, 0, fmt.Errorf("%s not in the layers: %w", l.Path, fs.ErrNotExist)
+}
+
+// layerEntry find the entry of the name in the layer, decompressing it if it is gzipped. If it is a regular file,
+// returns a reader of its contents; if it is a symlink or hard link, its header. If the layer does not have it,
+// returns whether the layer hides it in the layers below.
+func layerEntry(layer io.Reader, name string) (io.Reader, *tar.Header, bool, error) {
+	br := bufio.NewReader(layer)
+	r := io.Reader(br)
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		r = gz
+	}
+	var (
+		tr     = tar.NewReader(r)
+		hidden bool
+	)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, nil, hidden, nil
+		}
+		if err != nil {
+			return nil, nil, false, err
+		}
+		entry := layerPath(hdr.Name)
+		dir, base := path.Split(entry)
+		dir = strings.TrimSuffix(dir, "/")
+		switch {
+		case entry == name:
+			switch hdr.Typeflag {
+			case tar.TypeReg:
+				return tr, nil, false, nil
+			case tar.TypeSymlink, tar.TypeLink:
+				return nil, hdr, false, nil
+			}
+			return nil, nil, false, fmt.Errorf("%s is not a regular file", name)
+		case base == whiteoutOpaque && within(name, dir):
+			hidden = true
+		case strings.HasPrefix(base, whiteoutPrefix) && within(name, path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))):
+			hidden = true
+		}
+	}
+}
+
+// pulledFetcher fetcher of the blobs that were pulled from where they were pulled to, e.g. a FileStore or a
+// Directory, if they are there as they are, and otherwise from the remote
+type pulledFetcher struct {
+	pulled remotes.Fetcher
+	remote remotes.Fetcher
+}
+
+func (f pulledFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	if rc, err := f.pulled.Fetch(ctx, desc); err == nil {
+		// a file that was decompressed or unpacked when it was pulled is not the blob
+		file, ok := rc.(*os.File)
+		if !ok {
+			return rc, nil
+		}
+		if info, err := file.Stat(); err == nil && info.Mode().IsRegular() && info.Size() == desc.Size {
+			return rc, nil
+		}
+		_ = rc.Close()
+	}
+	return f.remote.Fetch(ctx, desc)
+}
+
+// layerPath the path of a file in a layer, relative to the root of the image filesystem, as the name of
+// its tar entry, which may be absolute or start with ./
+func layerPath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// within whether the path is the directory or file, or is within it; "" is the root of the image filesystem
+func within(p, dir string) bool {
+	return dir == "" || p == dir || strings.HasPrefix(p, dir+"/")
+}
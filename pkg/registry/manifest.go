@@ -5,24 +5,25 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
 	"path"
 	"time"
 
 	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/platforms"
 	"github.com/lf-edge/edge-containers/pkg/tgz"
 
 	"oras.land/oras-go/pkg/content"
 	"oras.land/oras-go/pkg/target"
 
 	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 // Manifest create the manifest for the given Artifact.
 func (a Artifact) Manifest(format Format, configOpts ConfigOpts, ref string, legacyOpts ...LegacyOpt) (*ocispec.Manifest, target.Target, error) {
 	var (
-		desc  ocispec.Descriptor
-		err   error
 		lOpts = legacyInfo{}
 	)
 
@@ -37,33 +38,165 @@ func (a Artifact) Manifest(format Format, configOpts ConfigOpts, ref string, leg
 	multiStore := content.MultiReader{}
 	multiStore.AddStore(fileStore, memStore)
 
+	manifest, manifestDesc, b, err := a.buildManifest(format, configOpts, lOpts, fileStore, memStore)
+	if err != nil {
+		return nil, nil, err
+	}
+	target := newMultiTarget(multiStore)
+	// It is a bit annoying that we need to store this twice, but the only oras structure
+	// that supports multiple backends is content.MultiReader, and that does not have
+	// support for Resolve(), only for Fetch().
+	_ = memStore.StoreManifest(ref, manifestDesc, b)
+	_ = target.StoreManifest(ref, manifestDesc, b)
+
+	return manifest, target, nil
+}
+
+// ArtifactFromManifest create the Artifact described by a manifest and its config, without retrieving
+// any of the content. Each part of the Artifact is a HashSource, with the digest and size of its layer,
+// and the name it would be given when pulled.
+//
+// The config is optional. If it is provided, its labels are used for any parts that are not in the
+// layer annotations, as for images built with standard docker tools. The name of such a part is its path
+// in the image filesystem. If no layer has that name, i.e. the part is somewhere inside one of the layers,
+// its HashSource has only the name.
+func ArtifactFromManifest(manifest *ocispec.Manifest, config *ocispec.Image) (*Artifact, error) {
+	if manifest == nil {
+		return nil, errors.New("must have valid manifest")
+	}
+	var labels map[string]string
+	if config != nil {
+		labels = config.Config.Labels
+	}
+	return artifactFromLayers(manifest.Layers, labels, func(desc *ocispec.Descriptor, path string) Source {
+		if desc == nil {
+			return &HashSource{Name: path}
+		}
+		return &HashSource{Hash: desc.Digest.String(), Name: path, Size: desc.Size}
+	}), nil
+}
+
+// Index create an index for the given artifacts, with one manifest per platform. The platform of
+// each manifest is taken from the ConfigOpts of its PlatformArtifact.
+func Index(artifacts []PlatformArtifact, format Format, ref string, legacyOpts ...LegacyOpt) (*ocispec.Index, target.Target, error) {
+	var (
+		lOpts = legacyInfo{}
+	)
+
+	for _, o := range legacyOpts {
+		o(&lOpts)
+	}
+
+	if len(artifacts) == 0 {
+		return nil, nil, errors.New("must have at least one platform artifact")
+	}
+
+	memStore := content.NewMemory()
+	multiStore := content.MultiReader{}
+	multiStore.AddStore(memStore)
+
+	var (
+		manifests = make([]ocispec.Descriptor, 0, len(artifacts))
+		seen      = map[string]bool{}
+	)
+	for i, p := range artifacts {
+		if p.Artifact == nil {
+			return nil, nil, fmt.Errorf("platform artifact %d does not have a valid Artifact", i)
+		}
+		platform := p.ConfigOpts.Platform()
+		platformName := platforms.Format(platform)
+		if seen[platformName] {
+			return nil, nil, fmt.Errorf("duplicate platform %s", platformName)
+		}
+		seen[platformName] = true
+
+		desc, err := p.platformManifest(i, format, lOpts, &multiStore, memStore)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error building manifest for %s: %v", platformName, err)
+		}
+		desc.Platform = &platform
+		manifests = append(manifests, desc)
+	}
+
+	mediaType := GetIndexMediaType(format)
+	index := &ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: mediaType,
+		Manifests: manifests,
+	}
+	b, err := json.Marshal(index)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to convert index to json: %v", err)
+	}
+	indexDesc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Size:      int64(len(b)),
+		Digest:    digest.FromBytes(b),
+	}
+	target := newMultiTarget(multiStore)
+	_ = memStore.StoreManifest(ref, indexDesc, b)
+	_ = target.StoreManifest(ref, indexDesc, b)
+
+	return index, target, nil
+}
+
+// platformManifest create the manifest for the i'th platform of an index, adding its content to the
+// provided stores. Returns the descriptor of the manifest.
+func (p PlatformArtifact) platformManifest(i int, format Format, lOpts legacyInfo, multiStore *content.MultiReader, memStore *content.Memory) (ocispec.Descriptor, error) {
+	// each platform gets its own file store, as the file store maps names to paths,
+	// and every platform has files with the same names, e.g. kernel
+	fileStore := content.NewFile("")
+	defer func() { _ = fileStore.Close() }()
+	multiStore.AddStore(fileStore)
+
+	// and its own temporary directory, for the same reason
+	if format.tarred() && lOpts.tmpdir != "" {
+		lOpts.tmpdir = path.Join(lOpts.tmpdir, fmt.Sprintf("%d", i))
+		if err := os.MkdirAll(lOpts.tmpdir, 0755); err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("could not create temporary directory: %v", err)
+		}
+	}
+
+	_, desc, b, err := p.Artifact.buildManifest(format, p.ConfigOpts, lOpts, fileStore, memStore)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	memStore.Set(desc, b)
+	return desc, nil
+}
+
+// buildManifest create the manifest for the Artifact, adding all of the content to the provided stores.
+// Returns the manifest, its descriptor and its raw bytes.
+func (a Artifact) buildManifest(format Format, configOpts ConfigOpts, lOpts legacyInfo, fileStore *content.File, memStore *content.Memory) (*ocispec.Manifest, ocispec.Descriptor, []byte, error) {
+	var (
+		desc ocispec.Descriptor
+		err  error
+	)
+
 	// if we have the container format, we need to create tgz layers
 	var (
 		tmpDir       string
 		labels       = map[string]string{}
 		pushContents = []ocispec.Descriptor{}
 		layers       = []digest.Digest{}
-		layerHash    digest.Digest
+		diffID       digest.Digest
 	)
 
-	if format == FormatLegacy {
+	if format.tarred() {
 		tmpDir = lOpts.tmpdir
 		if tmpDir == "" {
-			return nil, nil, fmt.Errorf("did not provide valid temporary directory for format legacy")
+			return nil, ocispec.Descriptor{}, nil, fmt.Errorf("did not provide valid temporary directory for format %s", format)
 		}
 	}
 
 	if a.Kernel != nil {
 		name := "kernel"
-		desc, err = createLayerAndDesc(RoleKernel, name, MimeTypeECIKernel, tmpDir, format, lOpts.timestamp, a.Kernel, fileStore, memStore)
+		desc, diffID, err = createLayerAndDesc(RoleKernel, name, MimeTypeECIKernel, tmpDir, format, lOpts.timestamp, a.Kernel, fileStore, memStore)
 		if err != nil {
-			return nil, nil, fmt.Errorf("error adding kernel: %v", err)
+			return nil, ocispec.Descriptor{}, nil, fmt.Errorf("error adding kernel: %v", err)
 		}
 		pushContents = append(pushContents, desc)
-		if layerHash == "" {
-			layerHash = desc.Digest
-		}
-		layers = append(layers, layerHash)
+		layers = append(layers, diffID)
 
 		labels[AnnotationKernelPath] = fmt.Sprintf("/%s", name)
 	}
@@ -71,41 +204,62 @@ func (a Artifact) Manifest(format Format, configOpts ConfigOpts, ref string, leg
 	if a.Initrd != nil {
 		role := RoleInitrd
 		name := "initrd"
-		layerHash = ""
 		customMediaType := MimeTypeECIInitrd
 
-		desc, err = createLayerAndDesc(role, name, customMediaType, tmpDir, format, lOpts.timestamp, a.Initrd, fileStore, memStore)
+		desc, diffID, err = createLayerAndDesc(role, name, customMediaType, tmpDir, format, lOpts.timestamp, a.Initrd, fileStore, memStore)
 		if err != nil {
-			return nil, nil, fmt.Errorf("error adding initrd: %v", err)
+			return nil, ocispec.Descriptor{}, nil, fmt.Errorf("error adding initrd: %v", err)
 		}
 
 		pushContents = append(pushContents, desc)
-		if layerHash == "" {
-			layerHash = desc.Digest
-		}
-		layers = append(layers, layerHash)
+		layers = append(layers, diffID)
 
 		labels[AnnotationInitrdPath] = fmt.Sprintf("/%s", name)
 	}
 
+	// the other boot artifacts all are handled the same way
+	for _, boot := range []struct {
+		source          Source
+		role            string
+		customMediaType string
+		label           string
+	}{
+		{a.DeviceTree, RoleDeviceTree, MimeTypeECIDeviceTree, AnnotationDeviceTreePath},
+		{a.Firmware, RoleFirmware, MimeTypeECIFirmware, AnnotationFirmwarePath},
+		{a.Bootloader, RoleBootloader, MimeTypeECIBootloader, AnnotationBootloaderPath},
+		{a.KernelModules, RoleKernelModules, MimeTypeECIKernelModules, AnnotationKernelModulesPath},
+	} {
+		if boot.source == nil {
+			continue
+		}
+		// the name is the same as the role
+		name := boot.role
+		desc, diffID, err = createLayerAndDesc(boot.role, name, boot.customMediaType, tmpDir, format, lOpts.timestamp, boot.source, fileStore, memStore)
+		if err != nil {
+			return nil, ocispec.Descriptor{}, nil, fmt.Errorf("error adding %s: %v", name, err)
+		}
+
+		pushContents = append(pushContents, desc)
+		layers = append(layers, diffID)
+
+		labels[boot.label] = fmt.Sprintf("/%s", name)
+	}
+
 	if disk := a.Root; disk != nil {
 		if disk.Source == nil {
-			return nil, nil, errors.New("root disk does not have valid source")
+			return nil, ocispec.Descriptor{}, nil, errors.New("root disk does not have valid source")
 		}
 		role := RoleRootDisk
 		name := fmt.Sprintf("disk-root-%s", disk.Source.GetName())
 		customMediaType := TypeToMime[disk.Type]
 
-		desc, err = createLayerAndDesc(role, name, customMediaType, tmpDir, format, lOpts.timestamp, disk.Source, fileStore, memStore)
+		desc, diffID, err = createLayerAndDesc(role, name, customMediaType, tmpDir, format, lOpts.timestamp, disk.Source, fileStore, memStore)
 		if err != nil {
-			return nil, nil, fmt.Errorf("error adding %s disk: %v", name, err)
+			return nil, ocispec.Descriptor{}, nil, fmt.Errorf("error adding %s disk: %v", name, err)
 		}
 
 		pushContents = append(pushContents, desc)
-		if layerHash == "" {
-			layerHash = desc.Digest
-		}
-		layers = append(layers, layerHash)
+		layers = append(layers, diffID)
 
 		labels[AnnotationRootPath] = fmt.Sprintf("/%s", name)
 	}
@@ -115,36 +269,31 @@ func (a Artifact) Manifest(format Format, configOpts ConfigOpts, ref string, leg
 			name := fmt.Sprintf("disk-%d-%s", i, disk.Source.GetName())
 			customMediaType := TypeToMime[disk.Type]
 
-			desc, err = createLayerAndDesc(role, name, customMediaType, tmpDir, format, lOpts.timestamp, disk.Source, fileStore, memStore)
+			desc, diffID, err = createLayerAndDesc(role, name, customMediaType, tmpDir, format, lOpts.timestamp, disk.Source, fileStore, memStore)
 			if err != nil {
-				return nil, nil, fmt.Errorf("error adding %s disk: %v", name, err)
+				return nil, ocispec.Descriptor{}, nil, fmt.Errorf("error adding %s disk: %v", name, err)
 			}
 
 			pushContents = append(pushContents, desc)
-			if layerHash == "" {
-				layerHash = desc.Digest
-			}
-			layers = append(layers, layerHash)
+			layers = append(layers, diffID)
 
 			labels[fmt.Sprintf(AnnotationDiskIndexPathPattern, i)] = fmt.Sprintf("/%s", name)
 		}
 	}
-	for _, other := range a.Other {
+	for i, other := range a.Other {
 		if other != nil {
+			role := RoleOther
 			customMediaType := MimeTypeECIOther
-			name := other.GetName()
+			name := fmt.Sprintf("other-%d-%s", i, other.GetName())
 
-			desc, err = createLayerAndDesc("", name, customMediaType, tmpDir, format, lOpts.timestamp, other, fileStore, memStore)
+			desc, diffID, err = createLayerAndDesc(role, name, customMediaType, tmpDir, format, lOpts.timestamp, other, fileStore, memStore)
 			if err != nil {
-				return nil, nil, fmt.Errorf("error adding other: %v", err)
+				return nil, ocispec.Descriptor{}, nil, fmt.Errorf("error adding other: %v", err)
 			}
 			pushContents = append(pushContents, desc)
-			if layerHash == "" {
-				layerHash = desc.Digest
-			}
-			layers = append(layers, layerHash)
+			layers = append(layers, diffID)
 
-			labels[AnnotationOther] = fmt.Sprintf("/%s", name)
+			labels[fmt.Sprintf(AnnotationOtherIndexPathPattern, i)] = fmt.Sprintf("/%s", name)
 		}
 	}
 
@@ -153,71 +302,124 @@ func (a Artifact) Manifest(format Format, configOpts ConfigOpts, ref string, leg
 		name := "config.json"
 		customMediaType := MimeTypeECIConfig
 
-		desc, err = createLayerAndDesc("", name, customMediaType, tmpDir, format, lOpts.timestamp, a.Config, fileStore, memStore)
+		// the config is used as is, never tarred
+		desc, err = createDesc("", name, customMediaType, GetConfigMediaType(customMediaType, format), a.Config, fileStore, memStore)
 		if err != nil {
-			return nil, nil, fmt.Errorf("error adding %s: %v", name, err)
+			return nil, ocispec.Descriptor{}, nil, fmt.Errorf("error adding %s: %v", name, err)
+		}
+		if err := validateSource(a.Config); err != nil {
+			return nil, ocispec.Descriptor{}, nil, fmt.Errorf("invalid %s: %v", name, err)
 		}
 	} else {
 		// for container format, we expect to have a specific config so docker can work with it
 		created := time.Now()
-		configAuthor, configOS, configArch := configOpts.Author, configOpts.OS, configOpts.Architecture
+		configAuthor := configOpts.Author
 		if configAuthor == "" {
 			configAuthor = DefaultAuthor
 		}
-		if configOS == "" {
-			configOS = DefaultOS
+		config := ECIConfig{
+			Image: ocispec.Image{
+				Created:  &created,
+				Author:   configAuthor,
+				Platform: configOpts.Platform(),
+				RootFS: ocispec.RootFS{
+					Type:    "layers",
+					DiffIDs: layers,
+				},
+				Config: ocispec.ImageConfig{
+					Labels: labels,
+				},
+			},
 		}
-		if configArch == "" {
-			configArch = DefaultArch
+		name := "config.json"
+		mediaType := MimeTypeOCIImageConfig
+		if format == FormatDocker {
+			mediaType = MimeTypeDockerImageConfig
 		}
-		config := ocispec.Image{
-			Created:  &created,
-			Author:   configAuthor,
-			Platform: ocispec.Platform{Architecture: configArch, OS: configOS},
-			RootFS: ocispec.RootFS{
-				Type:    "layers",
-				DiffIDs: layers,
-			},
-			Config: ocispec.ImageConfig{
-				Labels: labels,
-			},
+		// with ECI settings, it is a proper ECI config
+		if configOpts.ECI != nil {
+			settings := *configOpts.ECI
+			if settings.Version == 0 {
+				settings.Version = ECIConfigVersion
+			}
+			if settings.BootMode == BootModeDirectKernel && a.Kernel == nil {
+				return nil, ocispec.Descriptor{}, nil, fmt.Errorf("boot mode %s requires a kernel", settings.BootMode)
+			}
+			config.ECI = &settings
+			mediaType = GetConfigMediaType(MimeTypeECIConfig, format)
 		}
 		configBytes, err := json.Marshal(config)
 		if err != nil {
-			return nil, nil, fmt.Errorf("error marshaling config to json: %v", err)
+			return nil, ocispec.Descriptor{}, nil, fmt.Errorf("error marshaling config to json: %v", err)
+		}
+		if err := ValidateConfig(configBytes); err != nil {
+			return nil, ocispec.Descriptor{}, nil, fmt.Errorf("invalid config: %v", err)
 		}
 
-		name := "config.json"
-		mediaType := MimeTypeOCIImageConfig
 		desc, err = memStore.Add(name, mediaType, configBytes)
 		if err != nil {
-			return nil, nil, fmt.Errorf("error adding OCI config: %v", err)
+			return nil, ocispec.Descriptor{}, nil, fmt.Errorf("error adding OCI config: %v", err)
+		}
+	}
+	// OCI 1.1 artifacts have no custom config in the manifest, so the ECI config is carried
+	// as a layer, and the manifest gets the empty config
+	var artifactType string
+	if format == FormatOCI11 {
+		desc.MediaType = MimeTypeECIConfig
+		if desc.Annotations == nil {
+			desc.Annotations = map[string]string{}
 		}
+		desc.Annotations[AnnotationMediaType] = MimeTypeECIConfig
+		desc.Annotations[AnnotationRole] = RoleConfig
+		desc.Annotations[ocispec.AnnotationTitle] = "config.json"
+		pushContents = append(pushContents, desc)
+
+		desc = ocispec.DescriptorEmptyJSON
+		memStore.Set(desc, desc.Data)
+		artifactType = MimeTypeECIArtifact
 	}
 	// make our manifest
-	mediaType := ocispec.MediaTypeImageManifest
+	mediaType := GetArtifactMediaType(MimeTypeOCIImageManifest, format)
 	manifest := &ocispec.Manifest{
-		Config:    desc,
-		Layers:    pushContents,
-		MediaType: mediaType,
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		Config:       desc,
+		Layers:       pushContents,
+		MediaType:    mediaType,
+		ArtifactType: artifactType,
 	}
 	b, err := json.Marshal(manifest)
 	if err != nil {
-		return nil, nil, fmt.Errorf("unable to convert manifest to json: %v", err)
+		return nil, ocispec.Descriptor{}, nil, fmt.Errorf("unable to convert manifest to json: %v", err)
 	}
 	manifestDesc := ocispec.Descriptor{
-		MediaType: mediaType,
-		Size:      int64(len(b)),
-		Digest:    digest.FromBytes(b),
+		MediaType:    mediaType,
+		ArtifactType: artifactType,
+		Size:         int64(len(b)),
+		Digest:       digest.FromBytes(b),
 	}
-	target := newMultiTarget(multiStore)
-	// It is a bit annoying that we need to store this twice, but the only oras structure
-	// that supports multiple backends is content.MultiReader, and that does not have
-	// support for Resolve(), only for Fetch().
-	_ = memStore.StoreManifest(ref, manifestDesc, b)
-	_ = target.StoreManifest(ref, manifestDesc, b)
 
-	return manifest, target, nil
+	return manifest, manifestDesc, b, nil
+}
+
+// validateSource validate a provided config against the ECI config schema. Sources that
+// only have a hash cannot be read, and are not validated.
+func validateSource(source Source) error {
+	var (
+		data []byte
+		err  error
+	)
+	switch {
+	case source.GetPath() != "":
+		data, err = os.ReadFile(source.GetPath())
+		if err != nil {
+			return err
+		}
+	case source.GetContent() != nil:
+		data = source.GetContent()
+	default:
+		return nil
+	}
+	return ValidateConfig(data)
 }
 
 func getManifest(dig, name, mediaType string, size int64) (ocispec.Descriptor, error) {
@@ -248,23 +450,36 @@ func getManifest(dig, name, mediaType string, size int64) (ocispec.Descriptor, e
 	return desc, nil
 }
 
-func createLayerAndDesc(role, name, customMediaType, tmpDir string, format Format, timestamp *time.Time, source Source, fileStore *content.File, memStore *content.Memory) (ocispec.Descriptor, error) {
+// createLayerAndDesc create the descriptor for the layer of the source, tarred and compressed if the format is,
+// adding it to the appropriate store. Also returns the digest of the uncompressed layer, its diff ID.
+func createLayerAndDesc(role, name, customMediaType, tmpDir string, format Format, timestamp *time.Time, source Source, fileStore *content.File, memStore *content.Memory) (ocispec.Descriptor, digest.Digest, error) {
+	mediaType := GetLayerMediaType(customMediaType, format)
+	var diffID digest.Digest
+	if filepath := source.GetPath(); filepath != "" && format.tarred() {
+		tgzfile := path.Join(tmpDir, name)
+		tarSha, _, err := tgz.Compress(filepath, name, tgzfile, timestamp)
+		if err != nil {
+			return ocispec.Descriptor{}, "", fmt.Errorf("error creating tgz file for %s: %v", filepath, err)
+		}
+		source = &FileSource{Path: tgzfile}
+		diffID = digest.NewDigestFromBytes(digest.SHA256, tarSha)
+	}
+	desc, err := createDesc(role, name, customMediaType, mediaType, source, fileStore, memStore)
+	if diffID == "" {
+		diffID = desc.Digest
+	}
+	return desc, diffID, err
+}
+
+// createDesc create the descriptor for the source, with the given mediaType, adding it to the appropriate store
+func createDesc(role, name, customMediaType, mediaType string, source Source, fileStore *content.File, memStore *content.Memory) (ocispec.Descriptor, error) {
 	var (
 		desc ocispec.Descriptor
 		err  error
 	)
-	mediaType := GetLayerMediaType(customMediaType, format)
 	switch {
 	case source.GetPath() != "":
 		filepath := source.GetPath()
-		if format == FormatLegacy {
-			tgzfile := path.Join(tmpDir, name)
-			_, _, err := tgz.Compress(filepath, name, tgzfile, timestamp)
-			if err != nil {
-				return desc, fmt.Errorf("error creating tgz file for %s: %v", filepath, err)
-			}
-			filepath = tgzfile
-		}
 		desc, err = fileStore.Add(name, mediaType, filepath)
 		if err != nil {
 			return desc, fmt.Errorf("error adding %s from file at %s: %v", name, filepath, err)
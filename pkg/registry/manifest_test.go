@@ -1,6 +1,8 @@
 package registry_test
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
@@ -8,6 +10,7 @@ import (
 
 	"github.com/lf-edge/edge-containers/pkg/registry"
 
+	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -52,6 +55,12 @@ func TestManifest(t *testing.T) {
 		{MediaType: registry.MimeTypeOCIImageLayerGzip, Digest: inputs["root"].LegacyDigest(), Size: inputs["root"].LegacySize(), Annotations: map[string]string{registry.AnnotationMediaType: registry.MimeTypeECIDiskRaw, registry.AnnotationRole: registry.RoleRootDisk, ocispec.AnnotationTitle: "disk-root-" + inputs["root"].name}},
 		{MediaType: registry.MimeTypeOCIImageLayerGzip, Digest: inputs["disk1"].LegacyDigest(), Size: inputs["disk1"].LegacySize(), Annotations: map[string]string{registry.AnnotationMediaType: registry.MimeTypeECIDiskQcow2, registry.AnnotationRole: registry.RoleAdditionalDisk, ocispec.AnnotationTitle: "disk-0-" + inputs["disk1"].name}},
 	}
+	// expected descriptors to be returned in docker mode
+	expectedDescriptorsDocker := []ocispec.Descriptor{}
+	for _, d := range expectedDescriptorsLegacy {
+		d.MediaType = registry.MimeTypeDockerLayerTarGzip
+		expectedDescriptorsDocker = append(expectedDescriptorsDocker, d)
+	}
 
 	tests := []struct {
 		artifact *registry.Artifact
@@ -73,6 +82,8 @@ func TestManifest(t *testing.T) {
 		{validArtifact, registry.FormatArtifacts, expectedDescriptors, nil},
 		// normal with legacy
 		{validArtifact, registry.FormatLegacy, expectedDescriptorsLegacy, nil},
+		// normal with docker
+		{validArtifact, registry.FormatDocker, expectedDescriptorsDocker, nil},
 	}
 	for i, tt := range tests {
 		var (
@@ -81,7 +92,7 @@ func TestManifest(t *testing.T) {
 		)
 		legacyOpts = append(legacyOpts, registry.WithTimestamp(&initTime))
 
-		if tt.format == registry.FormatLegacy {
+		if tt.format == registry.FormatLegacy || tt.format == registry.FormatDocker {
 			manifestTmpDir, err = os.MkdirTemp("", "edge-containers")
 			if err != nil {
 				t.Fatalf("could not make temporary directory for tgz files: %v", err)
@@ -98,6 +109,10 @@ func TestManifest(t *testing.T) {
 			continue
 		case len(manifest.Layers) != len(tt.contents):
 			t.Errorf("%d: mismatched layers length, actual %v, expected %v", i, manifest.Layers, tt.contents)
+		case manifest.MediaType != registry.GetArtifactMediaType(registry.MimeTypeOCIImageManifest, tt.format):
+			t.Errorf("%d: mismatched manifest media type, actual %s", i, manifest.MediaType)
+		case manifest.Config.MediaType != registry.GetConfigMediaType(registry.MimeTypeOCIImageConfig, tt.format):
+			t.Errorf("%d: mismatched config media type, actual %s", i, manifest.Config.MediaType)
 		default:
 			for j, l := range manifest.Layers {
 				if !equalLayer(l, tt.contents[j]) {
@@ -124,3 +139,366 @@ func equalMapStringString(a, b map[string]string) bool {
 	}
 	return true
 }
+
+func TestIndex(t *testing.T) {
+	// create a temporary directory and install basic test files
+	tmpdir, err := os.MkdirTemp("", "eci-test")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+	inputs := map[string]TestInputFile{}
+	inputs["amd64"] = NewTestInputFile("kernel-amd64", "kernel", tmpdir)
+	inputs["arm64"] = NewTestInputFile("kernel-arm64", "kernel", tmpdir)
+	for _, v := range inputs {
+		err = os.WriteFile(v.Fullname(), v.Contents(), 0644)
+		if err != nil {
+			t.Fatalf("unable to create %s: %v", v.Fullname(), err)
+		}
+	}
+	amd64 := registry.PlatformArtifact{
+		Artifact:   &registry.Artifact{Kernel: &registry.FileSource{Path: inputs["amd64"].Fullname()}},
+		ConfigOpts: registry.ConfigOpts{OS: "linux", Architecture: "amd64"},
+	}
+	arm64 := registry.PlatformArtifact{
+		Artifact:   &registry.Artifact{Kernel: &registry.FileSource{Path: inputs["arm64"].Fullname()}},
+		ConfigOpts: registry.ConfigOpts{OS: "linux", Architecture: "arm64", Variant: "v8"},
+	}
+
+	tests := []struct {
+		artifacts []registry.PlatformArtifact
+		format    registry.Format
+		platforms []ocispec.Platform
+		err       error
+	}{
+		// no artifacts
+		{nil, registry.FormatArtifacts, nil, fmt.Errorf("must have at least one platform artifact")},
+		// missing artifact
+		{[]registry.PlatformArtifact{{ConfigOpts: amd64.ConfigOpts}}, registry.FormatArtifacts, nil, fmt.Errorf("platform artifact 0 does not have a valid Artifact")},
+		// duplicate platform
+		{[]registry.PlatformArtifact{amd64, amd64}, registry.FormatArtifacts, nil, fmt.Errorf("duplicate platform linux/amd64")},
+		// normal without legacy
+		{[]registry.PlatformArtifact{amd64, arm64}, registry.FormatArtifacts, []ocispec.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64", Variant: "v8"}}, nil},
+		// normal with legacy
+		{[]registry.PlatformArtifact{amd64, arm64}, registry.FormatLegacy, []ocispec.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64", Variant: "v8"}}, nil},
+	}
+	for i, tt := range tests {
+		var (
+			manifestTmpDir string
+			legacyOpts     []registry.LegacyOpt
+		)
+		legacyOpts = append(legacyOpts, registry.WithTimestamp(&initTime))
+
+		if tt.format == registry.FormatLegacy {
+			manifestTmpDir, err = os.MkdirTemp("", "edge-containers")
+			if err != nil {
+				t.Fatalf("could not make temporary directory for tgz files: %v", err)
+			}
+			legacyOpts = append(legacyOpts, registry.WithTmpDir(manifestTmpDir))
+			defer func() { _ = os.RemoveAll(manifestTmpDir) }()
+		}
+
+		index, from, err := registry.Index(tt.artifacts, tt.format, testImageName, legacyOpts...)
+		switch {
+		case (err != nil && tt.err == nil) || (err == nil && tt.err != nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())):
+			t.Errorf("%d: mismatched errors, actual %v expected %v", i, err, tt.err)
+		case err != nil:
+			continue
+		case index.MediaType != ocispec.MediaTypeImageIndex:
+			t.Errorf("%d: mismatched media type, actual %s expected %s", i, index.MediaType, ocispec.MediaTypeImageIndex)
+		case len(index.Manifests) != len(tt.platforms):
+			t.Errorf("%d: mismatched manifests length, actual %d, expected %d", i, len(index.Manifests), len(tt.platforms))
+		default:
+			for j, m := range index.Manifests {
+				if m.Platform == nil || m.Platform.OS != tt.platforms[j].OS || m.Platform.Architecture != tt.platforms[j].Architecture || m.Platform.Variant != tt.platforms[j].Variant {
+					t.Errorf("%d: %d: mismatched platform actual %v, expected %v", i, j, m.Platform, tt.platforms[j])
+				}
+			}
+			// the index must be resolvable, and each manifest retrievable, from the target
+			if _, desc, err := from.Resolve(context.TODO(), testImageName); err != nil || desc.MediaType != ocispec.MediaTypeImageIndex {
+				t.Errorf("%d: unable to resolve index: %v", i, err)
+			}
+			fetcher, err := from.Fetcher(context.TODO(), testImageName)
+			if err != nil {
+				t.Fatalf("%d: unable to get fetcher: %v", i, err)
+			}
+			for j, m := range index.Manifests {
+				rc, err := fetcher.Fetch(context.TODO(), m)
+				if err != nil {
+					t.Errorf("%d: %d: unable to fetch manifest: %v", i, j, err)
+					continue
+				}
+				var manifest ocispec.Manifest
+				err = json.NewDecoder(rc).Decode(&manifest)
+				_ = rc.Close()
+				if err != nil {
+					t.Errorf("%d: %d: unable to read manifest: %v", i, j, err)
+					continue
+				}
+				// each layer must be the one for its own platform
+				for _, l := range manifest.Layers {
+					rc, err := fetcher.Fetch(context.TODO(), l)
+					if err != nil {
+						t.Errorf("%d: %d: unable to fetch layer %s: %v", i, j, l.Digest, err)
+						continue
+					}
+					dig, err := digest.FromReader(rc)
+					_ = rc.Close()
+					if err != nil || dig != l.Digest {
+						t.Errorf("%d: %d: mismatched layer digest, actual %s expected %s", i, j, dig, l.Digest)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestManifestOCI11(t *testing.T) {
+	// create a temporary directory and install basic test files
+	tmpdir, err := os.MkdirTemp("", "eci-test")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+	kernel := NewTestInputFile("kernel", "kernel", tmpdir)
+	if err := os.WriteFile(kernel.Fullname(), kernel.Contents(), 0644); err != nil {
+		t.Fatalf("unable to create %s: %v", kernel.Fullname(), err)
+	}
+	config := []byte(`{"architecture":"arm64","os":"linux"}`)
+
+	tests := []struct {
+		artifact     *registry.Artifact
+		configDigest digest.Digest
+	}{
+		// generated config
+		{&registry.Artifact{Kernel: &registry.FileSource{Path: kernel.Fullname()}}, ""},
+		// provided config
+		{&registry.Artifact{Kernel: &registry.FileSource{Path: kernel.Fullname()}, Config: &registry.MemorySource{Content: config, Name: "config.json"}}, digest.FromBytes(config)},
+	}
+	for i, tt := range tests {
+		manifest, _, err := tt.artifact.Manifest(registry.FormatOCI11, registry.ConfigOpts{}, "")
+		if err != nil {
+			t.Errorf("%d: unexpected error: %v", i, err)
+			continue
+		}
+		if manifest.ArtifactType != registry.MimeTypeECIArtifact {
+			t.Errorf("%d: mismatched artifactType, actual %s expected %s", i, manifest.ArtifactType, registry.MimeTypeECIArtifact)
+		}
+		if manifest.SchemaVersion != 2 {
+			t.Errorf("%d: mismatched schemaVersion, actual %d expected 2", i, manifest.SchemaVersion)
+		}
+		if !equalLayer(manifest.Config, ocispec.DescriptorEmptyJSON) {
+			t.Errorf("%d: mismatched config, actual %v expected %v", i, manifest.Config, ocispec.DescriptorEmptyJSON)
+		}
+		if len(manifest.Layers) != 2 {
+			t.Errorf("%d: mismatched layers length, actual %d expected 2", i, len(manifest.Layers))
+			continue
+		}
+		expectedKernel := ocispec.Descriptor{MediaType: registry.MimeTypeECIKernel, Digest: kernel.Digest(), Size: kernel.Size(), Annotations: map[string]string{registry.AnnotationMediaType: registry.MimeTypeECIKernel, registry.AnnotationRole: registry.RoleKernel, ocispec.AnnotationTitle: "kernel"}}
+		if !equalLayer(manifest.Layers[0], expectedKernel) {
+			t.Errorf("%d: mismatched kernel layer actual %v, expected %v", i, manifest.Layers[0], expectedKernel)
+		}
+		configLayer := manifest.Layers[1]
+		if configLayer.MediaType != registry.MimeTypeECIConfig || configLayer.Annotations[registry.AnnotationRole] != registry.RoleConfig {
+			t.Errorf("%d: mismatched config layer %v", i, configLayer)
+		}
+		if tt.configDigest != "" && configLayer.Digest != tt.configDigest {
+			t.Errorf("%d: mismatched config layer digest, actual %s expected %s", i, configLayer.Digest, tt.configDigest)
+		}
+	}
+}
+
+func TestManifestECIConfig(t *testing.T) {
+	// create a temporary directory and install basic test files
+	tmpdir, err := os.MkdirTemp("", "eci-test")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+	kernel := NewTestInputFile("kernel", "kernel", tmpdir)
+	if err := os.WriteFile(kernel.Fullname(), kernel.Contents(), 0644); err != nil {
+		t.Fatalf("unable to create %s: %v", kernel.Fullname(), err)
+	}
+	withKernel := &registry.Artifact{Kernel: &registry.FileSource{Path: kernel.Fullname()}}
+	settings := &registry.ECISettings{
+		KernelCommandLine:  "console=ttyS0",
+		BootMode:           registry.BootModeDirectKernel,
+		VirtualizationMode: registry.VirtualizationModeHVM,
+		Resources:          &registry.Resources{MinVCPUs: 2, MinMemoryMiB: 512},
+	}
+
+	tests := []struct {
+		artifact  *registry.Artifact
+		format    registry.Format
+		settings  *registry.ECISettings
+		mediaType string
+		err       error
+	}{
+		{withKernel, registry.FormatArtifacts, settings, registry.MimeTypeECIConfig, nil},
+		{withKernel, registry.FormatLegacy, settings, registry.MimeTypeOCIImageConfig, nil},
+		{withKernel, registry.FormatDocker, settings, registry.MimeTypeDockerImageConfig, nil},
+		{withKernel, registry.FormatArtifacts, nil, registry.MimeTypeOCIImageConfig, nil},
+		// direct kernel boot without a kernel
+		{&registry.Artifact{}, registry.FormatArtifacts, &registry.ECISettings{BootMode: registry.BootModeDirectKernel}, "", fmt.Errorf("requires a kernel")},
+		// values not allowed by the schema
+		{withKernel, registry.FormatArtifacts, &registry.ECISettings{BootMode: "floppy"}, "", fmt.Errorf("invalid config")},
+		{withKernel, registry.FormatArtifacts, &registry.ECISettings{Version: 2}, "", fmt.Errorf("invalid config")},
+		{withKernel, registry.FormatArtifacts, &registry.ECISettings{Resources: &registry.Resources{MinVCPUs: -1}}, "", fmt.Errorf("invalid config")},
+		// provided config that does not match the schema
+		{&registry.Artifact{Config: &registry.MemorySource{Content: []byte(`{"eci":{"version":1,"bootMode":"floppy"}}`), Name: "config.json"}}, registry.FormatArtifacts, nil, "", fmt.Errorf("invalid config.json")},
+		{&registry.Artifact{Config: &registry.MemorySource{Content: []byte(`not json`), Name: "config.json"}}, registry.FormatArtifacts, nil, "", fmt.Errorf("invalid config.json")},
+	}
+	manifestTmpDir, err := os.MkdirTemp("", "edge-containers")
+	if err != nil {
+		t.Fatalf("could not make temporary directory for tgz files: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(manifestTmpDir) }()
+	for i, tt := range tests {
+		manifest, provider, err := tt.artifact.Manifest(tt.format, registry.ConfigOpts{ECI: tt.settings}, "", registry.WithTmpDir(manifestTmpDir))
+		switch {
+		case (err != nil && tt.err == nil) || (err == nil && tt.err != nil) || (err != nil && tt.err != nil && !strings.Contains(err.Error(), tt.err.Error())):
+			t.Errorf("%d: mismatched errors, actual %v expected %v", i, err, tt.err)
+			continue
+		case err != nil:
+			continue
+		case manifest.Config.MediaType != tt.mediaType:
+			t.Errorf("%d: mismatched config media type, actual %s expected %s", i, manifest.Config.MediaType, tt.mediaType)
+		}
+		fetcher, err := provider.Fetcher(context.TODO(), "")
+		if err != nil {
+			t.Fatalf("%d: unable to get fetcher: %v", i, err)
+		}
+		rc, err := fetcher.Fetch(context.TODO(), manifest.Config)
+		if err != nil {
+			t.Fatalf("%d: unable to fetch config: %v", i, err)
+		}
+		var config registry.ECIConfig
+		err = json.NewDecoder(rc).Decode(&config)
+		_ = rc.Close()
+		switch {
+		case err != nil:
+			t.Errorf("%d: invalid config: %v", i, err)
+		case tt.settings == nil && config.ECI != nil:
+			t.Errorf("%d: unexpected ECI settings %v", i, config.ECI)
+		case tt.settings != nil && config.ECI == nil:
+			t.Errorf("%d: missing ECI settings", i)
+		case tt.settings != nil && (config.ECI.Version != registry.ECIConfigVersion || config.ECI.KernelCommandLine != tt.settings.KernelCommandLine || config.ECI.BootMode != tt.settings.BootMode || *config.ECI.Resources != *tt.settings.Resources):
+			t.Errorf("%d: mismatched ECI settings, actual %v expected %v", i, config.ECI, tt.settings)
+		}
+	}
+}
+
+func TestArtifactFromManifest(t *testing.T) {
+	// create a temporary directory and install basic test files
+	tmpdir, err := os.MkdirTemp("", "eci-test")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+	inputs := map[string]TestInputFile{}
+	inputs["kernel"] = NewTestInputFile("kernel", "kernel", tmpdir)
+	inputs["root"] = NewTestInputFile("root.raw", "disk-root-root.raw", tmpdir)
+	inputs["disk0"] = NewTestInputFile("disk0.qcow2", "disk-0-disk0.qcow2", tmpdir)
+	inputs["disk2"] = NewTestInputFile("disk2.vmdk", "disk-2-disk2.vmdk", tmpdir)
+	for _, v := range inputs {
+		if err := os.WriteFile(v.Fullname(), v.Contents(), 0644); err != nil {
+			t.Fatalf("unable to create %s: %v", v.Fullname(), err)
+		}
+	}
+	artifact := &registry.Artifact{
+		Kernel: &registry.FileSource{Path: inputs["kernel"].Fullname()},
+		Root:   &registry.Disk{Source: &registry.FileSource{Path: inputs["root"].Fullname()}, Type: registry.Raw},
+		Disks: []*registry.Disk{
+			{Source: &registry.FileSource{Path: inputs["disk0"].Fullname()}, Type: registry.Qcow2},
+			nil,
+			{Source: &registry.FileSource{Path: inputs["disk2"].Fullname()}, Type: registry.Vmdk},
+		},
+	}
+	manifest, _, err := artifact.Manifest(registry.FormatArtifacts, registry.ConfigOpts{}, "")
+	if err != nil {
+		t.Fatalf("unable to create manifest: %v", err)
+	}
+	// reverse the layers, so that the order cannot be relied upon
+	for i, j := 0, len(manifest.Layers)-1; i < j; i, j = i+1, j-1 {
+		manifest.Layers[i], manifest.Layers[j] = manifest.Layers[j], manifest.Layers[i]
+	}
+
+	result, err := registry.ArtifactFromManifest(manifest, nil)
+	if err != nil {
+		t.Fatalf("unable to get artifact: %v", err)
+	}
+	checkHash := func(name string, source registry.Source, input TestInputFile) {
+		switch {
+		case source == nil:
+			t.Errorf("%s: missing", name)
+		case source.GetDigest() != input.Digest().String() || source.GetSize() != input.Size() || source.GetName() != input.processedName:
+			t.Errorf("%s: mismatched, actual %s %d %s, expected %s %d %s", name, source.GetDigest(), source.GetSize(), source.GetName(), input.Digest(), input.Size(), input.processedName)
+		}
+	}
+	checkHash("kernel", result.Kernel, inputs["kernel"])
+	if result.Root == nil || result.Root.Type != registry.Raw {
+		t.Fatalf("mismatched root %v", result.Root)
+	}
+	checkHash("root", result.Root.Source, inputs["root"])
+	if len(result.Disks) != 3 || result.Disks[0] == nil || result.Disks[1] != nil || result.Disks[2] == nil {
+		t.Fatalf("mismatched disks %v", result.Disks)
+	}
+	checkHash("disk 0", result.Disks[0].Source, inputs["disk0"])
+	checkHash("disk 2", result.Disks[2].Source, inputs["disk2"])
+	if result.Disks[0].Type != registry.Qcow2 || result.Disks[2].Type != registry.Vmdk {
+		t.Errorf("mismatched disk types %v %v", result.Disks[0].Type, result.Disks[2].Type)
+	}
+
+	// an index beyond the number of layers, as only could come from a name given in the image, is placed
+	// after the others, rather than sizing the disks by it
+	huge := ocispec.Descriptor{MediaType: registry.MimeTypeECIDiskRaw, Digest: inputs["disk0"].Digest(), Size: inputs["disk0"].Size(), Annotations: map[string]string{
+		registry.AnnotationRole: registry.RoleAdditionalDisk,
+		ocispec.AnnotationTitle: "disk-9000000000000000000-huge.raw",
+	}}
+	manifest.Layers = append(manifest.Layers, huge)
+	result, err = registry.ArtifactFromManifest(manifest, nil)
+	switch {
+	case err != nil:
+		t.Fatalf("unable to get artifact: %v", err)
+	case len(result.Disks) != 4 || result.Disks[1] != nil || result.Disks[3] == nil:
+		t.Fatalf("mismatched disks %v", result.Disks)
+	case result.Disks[3].Source.GetName() != "disk-9000000000000000000-huge.raw":
+		t.Errorf("mismatched disk with huge index %v", result.Disks[3].Source)
+	}
+
+	// an image with only config labels
+	layer := ocispec.Descriptor{MediaType: registry.MimeTypeDockerLayerTarGzip, Digest: inputs["root"].LegacyDigest(), Size: inputs["root"].LegacySize()}
+	config := &ocispec.Image{Config: ocispec.ImageConfig{Labels: map[string]string{
+		registry.AnnotationKernelPath: "/boot/kernel",
+		registry.AnnotationRootPath:   "/root.qcow2",
+	}}}
+	result, err = registry.ArtifactFromManifest(&ocispec.Manifest{Layers: []ocispec.Descriptor{layer}}, config)
+	switch {
+	case err != nil:
+		t.Fatalf("unable to get artifact from labels: %v", err)
+	case result.Kernel == nil || result.Kernel.GetName() != "boot/kernel" || result.Kernel.GetDigest() != "":
+		t.Errorf("mismatched kernel from labels %v", result.Kernel)
+	case result.Root == nil || result.Root.Source.GetName() != "root.qcow2" || result.Root.Type != registry.Qcow2:
+		t.Errorf("mismatched root from labels %v", result.Root)
+	}
+
+	if _, err := registry.ArtifactFromManifest(nil, nil); err == nil {
+		t.Errorf("no error for nil manifest")
+	}
+}
+
+func TestFormatString(t *testing.T) {
+	for name, format := range registry.NameToFormat {
+		if format.String() != name {
+			t.Errorf("mismatched name, actual %s expected %s", format.String(), name)
+		}
+	}
+	// a format that is not known does not panic, including when converted to json
+	b, err := json.Marshal(map[string]registry.Format{"format": registry.Format(42)})
+	if err != nil {
+		t.Fatalf("unable to convert to json: %v", err)
+	}
+	if expected := `{"format":"Format(42)"}`; string(b) != expected {
+		t.Errorf("mismatched json, actual %s expected %s", b, expected)
+	}
+}
@@ -10,6 +10,10 @@ const (
 	MimeTypeECIConfig           = "application/vnd.lfedge.eci.config.v1+json"
 	MimeTypeECIKernel           = "application/vnd.lfedge.eci.kernel.layer.v1+kernel"
 	MimeTypeECIInitrd           = "application/vnd.lfedge.eci.initrd.layer.v1+cpio"
+	MimeTypeECIDeviceTree       = "application/vnd.lfedge.eci.devicetree.layer.v1+dtb"
+	MimeTypeECIFirmware         = "application/vnd.lfedge.eci.firmware.layer.v1+bin"
+	MimeTypeECIBootloader       = "application/vnd.lfedge.eci.bootloader.layer.v1+bin"
+	MimeTypeECIKernelModules    = "application/vnd.lfedge.eci.kernel-modules.layer.v1+bin"
 	MimeTypeECIDiskRaw          = "application/vnd.lfedge.disk.layer.v1+raw"
 	MimeTypeECIDiskVhd          = "application/vnd.lfedge.disk.layer.v1+vhd"
 	MimeTypeECIDiskVmdk         = "application/vnd.lfedge.disk.layer.v1+vmdk"
@@ -24,6 +28,7 @@ const (
 	MimeTypeOCIImageLayerGzip   = ocispec.MediaTypeImageLayerGzip
 	MimeTypeOCIImageManifest    = ocispec.MediaTypeImageManifest
 	MimeTypeOCIImageIndex       = ocispec.MediaTypeImageIndex
+	MimeTypeOCIEmptyJSON        = ocispec.MediaTypeEmptyJSON
 	MimeTypeDockerImageConfig   = images.MediaTypeDockerSchema2Config
 	MimeTypeDockerImageManifest = images.MediaTypeDockerSchema2Manifest
 	MimeTypeDockerImageIndex    = images.MediaTypeDockerSchema2ManifestList
@@ -36,6 +41,10 @@ var allTypes = []string{
 	MimeTypeECIConfig,
 	MimeTypeECIKernel,
 	MimeTypeECIInitrd,
+	MimeTypeECIDeviceTree,
+	MimeTypeECIFirmware,
+	MimeTypeECIBootloader,
+	MimeTypeECIKernelModules,
 	MimeTypeECIDiskRaw,
 	MimeTypeECIDiskVhd,
 	MimeTypeECIDiskVmdk,
@@ -50,6 +59,7 @@ var allTypes = []string{
 	MimeTypeOCIImageLayerGzip,
 	MimeTypeOCIImageManifest,
 	MimeTypeOCIImageIndex,
+	MimeTypeOCIEmptyJSON,
 	MimeTypeDockerImageConfig,
 	MimeTypeDockerImageManifest,
 	MimeTypeDockerImageIndex,
@@ -64,25 +74,41 @@ func AllMimeTypes() []string {
 func GetLayerMediaType(actualType string, format Format) string {
 	var t string
 	switch format {
-	case FormatArtifacts:
+	case FormatArtifacts, FormatOCI11:
 		t = actualType
 	case FormatLegacy:
 		t = MimeTypeOCIImageLayerGzip
+	case FormatDocker:
+		t = MimeTypeDockerLayerTarGzip
 	}
 	return t
 }
 func GetConfigMediaType(actualType string, format Format) string {
-	if format == FormatArtifacts {
+	switch format {
+	case FormatArtifacts:
 		return actualType
+	case FormatOCI11:
+		return MimeTypeOCIEmptyJSON
+	case FormatDocker:
+		return MimeTypeDockerImageConfig
 	}
 	return MimeTypeOCIImageConfig
 }
 func GetArtifactMediaType(actualType string, format Format) string {
-	if format == FormatArtifacts {
+	switch format {
+	case FormatArtifacts:
 		return actualType
+	case FormatDocker:
+		return MimeTypeDockerImageManifest
 	}
 	return MimeTypeOCIImageManifest
 }
+func GetIndexMediaType(format Format) string {
+	if format == FormatDocker {
+		return MimeTypeDockerImageIndex
+	}
+	return MimeTypeOCIImageIndex
+}
 
 func IsConfigType(mediaType string) bool {
 	switch mediaType {
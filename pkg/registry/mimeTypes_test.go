@@ -12,6 +12,7 @@ func TestGetLayerMediaType(t *testing.T) {
 	}{
 		{FormatArtifacts, MimeTypeECIKernel, MimeTypeECIKernel},
 		{FormatLegacy, MimeTypeECIKernel, MimeTypeOCIImageLayer},
+		{FormatDocker, MimeTypeECIKernel, MimeTypeDockerLayerTarGzip},
 	}
 	for i, tt := range tests {
 		out := GetLayerMediaType(tt.input, tt.format)
@@ -28,6 +29,7 @@ func TestGetConfigMediaType(t *testing.T) {
 	}{
 		{FormatArtifacts, MimeTypeECIConfig, MimeTypeECIKernel},
 		{FormatLegacy, MimeTypeECIConfig, MimeTypeOCIImageConfig},
+		{FormatDocker, MimeTypeECIConfig, MimeTypeDockerImageConfig},
 	}
 	for i, tt := range tests {
 		out := GetConfigMediaType(tt.input, tt.format)
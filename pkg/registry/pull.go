@@ -5,27 +5,68 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
 	ctrcontent "github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/images"
+	"github.com/containerd/platforms"
 	ecresolver "github.com/lf-edge/edge-containers/pkg/resolver"
 	"oras.land/oras-go/pkg/content"
 	"oras.land/oras-go/pkg/oras"
 	"oras.land/oras-go/pkg/target"
 
+	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 type Puller struct {
 	// Image reference to image, e.g. docker.io/foo/bar:tagabc
 	Image string
+	// Platform the platform to select when the image is an index. Only the content for
+	// the manifest that best matches the platform is retrieved. Defaults to the platform of the current host.
+	Platform *ocispec.Platform
 	// Impl the OCI artifacts puller. Normally should be left blank, will be filled in to use oras. Override only for special cases like testing.
 	Impl func(ctx context.Context, from target.Target, fromRef string, to target.Target, toRef string, opts ...oras.CopyOpt) (ocispec.Descriptor, error)
+	// Retry how to retry fetches that fail, or stall, partway; each blob continues from where it stopped.
+	// The zero value does not retry.
+	Retry ecresolver.RetryOptions
+	// Parallel which large blobs to fetch in ranges at once, each written where it goes in the file, when pulled to a
+	// FilesTarget of regular files, a FileStore or a resolver.Directory. The zero value fetches each blob in a single request.
+	Parallel ecresolver.ParallelOptions
+}
+
+// retrying the resolver, retrying fetches as set in the Puller
+func (p *Puller) retrying(resolver ecresolver.ResolverCloser) ecresolver.ResolverCloser {
+	if p.Retry == (ecresolver.RetryOptions{}) {
+		return resolver
+	}
+	_, retry, _ := ecresolver.NewRetry(resolver.Context(), resolver, p.Retry)
+	return retry
+}
+
+// parallel the resolver, fetching large blobs in ranges as set in the Puller
+func (p *Puller) parallel(resolver ecresolver.ResolverCloser) (ecresolver.ResolverCloser, error) {
+	if p.Parallel.Threshold == 0 {
+		return resolver, nil
+	}
+	_, parallel, err := ecresolver.NewParallel(resolver.Context(), resolver, p.Parallel)
+	if err != nil {
+		return nil, err
+	}
+	return parallel, nil
 }
 
 // Pull pull the artifact from the appropriate registry and save it to a local directory.
 // Arguments are the dir where to write it, an io.Writer for logging output, and a target.
 //
+// Each part of the returned Artifact that was pulled as a layer of its own is a FileSource, with the title
+// of the layer as its path, e.g. relative to the directory of a FileStore. Parts that are files in the tar
+// layers of an image, e.g. one built with standard docker tools, are LayerSources, which read the file from
+// the layers as pulled to the target, where it has them as they are, or else with the resolver.
+//
 // The resolver provides the channel to connect to the target type. resolver.Registry just uses the default registry,
 // while resolver.Directory uses a local directory, etc.
 func (p *Puller) Pull(to target.Target, blocksize int, verbose bool, writer io.Writer, resolver ecresolver.ResolverCloser) (*ocispec.Descriptor, *Artifact, error) {
@@ -37,10 +78,10 @@ func (p *Puller) Pull(to target.Target, blocksize int, verbose bool, writer io.W
 	if p.Impl == nil {
 		p.Impl = oras.Copy
 	}
-
-	var (
-		err error
-	)
+	resolver, err := p.parallel(p.retrying(resolver))
+	if err != nil {
+		return nil, nil, err
+	}
 	// get the saved context; if nil, create a background one
 	ctx := resolver.Context()
 	if ctx == nil {
@@ -54,8 +95,14 @@ func (p *Puller) Pull(to target.Target, blocksize int, verbose bool, writer io.W
 		copyOpts = append(copyOpts, oras.WithPullStatusTrack(writer))
 	}
 
-	var layers []ocispec.Descriptor
+	var (
+		layers []ocispec.Descriptor
+		labels map[string]string
+	)
 	copyOpts = append(copyOpts,
+		oras.WithPullBaseHandler(platformHandler(resolver, p.Image, p.platform()), labelsHandler(resolver, p.Image, func(l map[string]string) {
+			labels = l
+		})),
 		oras.WithAllowedMediaTypes(allowedMediaTypes),
 		oras.WithPullEmptyNameAllowed(),
 		oras.WithPullByBFS,
@@ -70,12 +117,98 @@ func (p *Puller) Pull(to target.Target, blocksize int, verbose bool, writer io.W
 	if err != nil {
 		return nil, nil, err
 	}
+	fetcher, err := resolver.Fetcher(ctx, p.Image)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the layers just pulled are read from the target, where it has them
+	if pulled, err := to.Fetcher(ctx, p.Image); err == nil {
+		fetcher = pulledFetcher{pulled: pulled, remote: fetcher}
+	}
 	// process the layers to fill in our artifact
-	// these can be in the layers, or in the config
-	artifact := &Artifact{
-		Disks: []*Disk{},
+	// these can be in the layers, or in the config; files from the config that are not layers of their own
+	// are inside the tar layers, which are not extracted, so are read from there
+	artifact := artifactFromLayers(layers, labels, func(desc *ocispec.Descriptor, path string) Source {
+		if desc == nil {
+			return &LayerSource{Path: path, Layers: layers, Fetcher: fetcher}
+		}
+		return &FileSource{Path: path}
+	})
+
+	return &desc, artifact, nil
+}
+
+// labelsHandler returns a handler that retrieves each config it encounters from the resolver,
+// and passes its labels to save. The config still is retrieved normally as well.
+func labelsHandler(resolver ecresolver.ResolverCloser, ref string, save func(map[string]string)) images.HandlerFunc {
+	var lock sync.Mutex
+	return func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		if !IsConfigType(desc.MediaType) {
+			return nil, nil
+		}
+		fetcher, err := resolver.Fetcher(ctx, ref)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get fetcher for config %s: %v", desc.Digest, err)
+		}
+		rc, err := fetcher.Fetch(ctx, desc)
+		if err != nil {
+			return nil, fmt.Errorf("unable to fetch config %s: %v", desc.Digest, err)
+		}
+		defer func() { _ = rc.Close() }()
+		// a config that is not an image config has no labels, which is not an error
+		var image ocispec.Image
+		if err := json.NewDecoder(rc).Decode(&image); err != nil {
+			return nil, nil
+		}
+		if len(image.Config.Labels) == 0 {
+			return nil, nil
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		save(image.Config.Labels)
+		return nil, nil
 	}
-	for _, l := range layers {
+}
+
+// artifactFromLayers build an artifact from the role annotations on the layers. Anything not found there is
+// taken from the labels from the config, as used by images built with standard docker tools.
+//
+// source creates the Source for each part, given the layer and the path. For parts from the labels,
+// the path is the path to the file in the image filesystem, and the layer is the one with the same
+// title, or nil if there is none.
+//
+// Disk types are taken from the media type annotation, if any, else inferred from the file extension.
+// Additional disks and other items are placed at the index in their names, e.g. disk-2-foo.qcow2
+// at index 2, rather than in layer order, leaving nil for any missing ones, as pushed from an Artifact
+// with nil entries. An index that is not less than the number of layers cannot have been pushed that way,
+// so that item is placed after the others, as one without an index is.
+func artifactFromLayers(layers []ocispec.Descriptor, labels map[string]string, source func(desc *ocispec.Descriptor, path string) Source) *Artifact {
+	var (
+		artifact = &Artifact{
+			Disks: []*Disk{},
+		}
+		disks         = map[int]*Disk{}
+		unindexed     []*Disk
+		others        = map[int]Source{}
+		othersNoIndex []Source
+		titles        = map[string]*ocispec.Descriptor{}
+	)
+	// indexOf the index in the name, if it has one that is in range; the name comes from the image
+	indexOf := func(prefix, name string) (int, bool) {
+		i, ok := nameIndex(prefix, name)
+		return i, ok && i < len(layers)
+	}
+	diskType := func(l *ocispec.Descriptor, path string) DiskType {
+		if l != nil {
+			if t, ok := MimeToType[l.Annotations[AnnotationMediaType]]; ok {
+				return t
+			}
+		}
+		t, _ := DiskTypeFromName(path)
+		return t
+	}
+	for i := range layers {
+		l := &layers[i]
 		if l.Annotations == nil {
 			continue
 		}
@@ -83,27 +216,131 @@ func (p *Puller) Pull(to target.Target, blocksize int, verbose bool, writer io.W
 		if filepath == "" {
 			continue
 		}
-		mediaType := l.Annotations[AnnotationMediaType]
+		titles[filepath] = l
 		switch l.Annotations[AnnotationRole] {
 		case RoleKernel:
-			artifact.Kernel = &FileSource{Path: filepath}
+			artifact.Kernel = source(l, filepath)
 		case RoleInitrd:
-			artifact.Initrd = &FileSource{Path: filepath}
+			artifact.Initrd = source(l, filepath)
+		case RoleDeviceTree:
+			artifact.DeviceTree = source(l, filepath)
+		case RoleFirmware:
+			artifact.Firmware = source(l, filepath)
+		case RoleBootloader:
+			artifact.Bootloader = source(l, filepath)
+		case RoleKernelModules:
+			artifact.KernelModules = source(l, filepath)
 		case RoleRootDisk:
 			artifact.Root = &Disk{
-				Source: &FileSource{Path: filepath},
-				Type:   MimeToType[mediaType],
+				Source: source(l, filepath),
+				Type:   diskType(l, filepath),
 			}
 		case RoleAdditionalDisk:
-			artifact.Disks = append(artifact.Disks, &Disk{
-				Source: &FileSource{Path: filepath},
-				Type:   MimeToType[mediaType],
-			})
+			disk := &Disk{
+				Source: source(l, filepath),
+				Type:   diskType(l, filepath),
+			}
+			if index, ok := indexOf("disk", filepath); ok {
+				disks[index] = disk
+			} else {
+				unindexed = append(unindexed, disk)
+			}
+		case RoleConfig:
+			artifact.Config = source(l, filepath)
+		case RoleOther:
+			if index, ok := indexOf(RoleOther, filepath); ok {
+				others[index] = source(l, filepath)
+			} else {
+				othersNoIndex = append(othersNoIndex, source(l, filepath))
+			}
 		}
 	}
+	artifact.Disks = append(artifact.Disks, byIndex(disks, unindexed)...)
+	artifact.Other = byIndex(others, othersNoIndex)
+
 	// it might have been in the config
+	if len(labels) == 0 {
+		return artifact
+	}
+	// paths in the labels are absolute in the image filesystem, but relative for us
+	labelSource := func(p string) Source {
+		return source(titles[p], p)
+	}
+	labelDisk := func(p string) *Disk {
+		return &Disk{Source: labelSource(p), Type: diskType(titles[p], p)}
+	}
+	for _, s := range []struct {
+		field *Source
+		label string
+	}{
+		{&artifact.Kernel, AnnotationKernelPath},
+		{&artifact.Initrd, AnnotationInitrdPath},
+		{&artifact.DeviceTree, AnnotationDeviceTreePath},
+		{&artifact.Firmware, AnnotationFirmwarePath},
+		{&artifact.Bootloader, AnnotationBootloaderPath},
+		{&artifact.KernelModules, AnnotationKernelModulesPath},
+	} {
+		if p := strings.TrimPrefix(labels[s.label], "/"); *s.field == nil && p != "" {
+			*s.field = labelSource(p)
+		}
+	}
+	if p := strings.TrimPrefix(labels[AnnotationRootPath], "/"); artifact.Root == nil && p != "" {
+		artifact.Root = labelDisk(p)
+	}
+	if len(artifact.Disks) == 0 {
+		for _, p := range indexedLabels(labels, AnnotationDiskIndexPathPattern) {
+			artifact.Disks = append(artifact.Disks, labelDisk(p))
+		}
+	}
+	if len(artifact.Other) == 0 {
+		for _, p := range indexedLabels(labels, AnnotationOtherIndexPathPattern) {
+			artifact.Other = append(artifact.Other, labelSource(p))
+		}
+	}
+	return artifact
+}
 
-	return &desc, artifact, nil
+// byIndex place each of the indexed items at its index, leaving nil for any missing ones,
+// followed by the unindexed items. The indexes must be bounded, as the result is as long as the largest.
+func byIndex[T any](indexed map[int]T, unindexed []T) []T {
+	size := 0
+	for i := range indexed {
+		if i+1 > size {
+			size = i + 1
+		}
+	}
+	result := make([]T, size, size+len(unindexed))
+	for i, item := range indexed {
+		result[i] = item
+	}
+	return append(result, unindexed...)
+}
+
+// indexedLabels the relative paths from the labels that match the pattern, e.g. AnnotationDiskIndexPathPattern,
+// ordered by their index
+func indexedLabels(labels map[string]string, pattern string) []string {
+	var (
+		prefix  = strings.TrimSuffix(pattern, "%d")
+		indexes []int
+		paths   = map[int]string{}
+	)
+	for label, value := range labels {
+		if !strings.HasPrefix(label, prefix) || value == "" {
+			continue
+		}
+		index, err := strconv.Atoi(strings.TrimPrefix(label, prefix))
+		if err != nil || index < 0 {
+			continue
+		}
+		indexes = append(indexes, index)
+		paths[index] = strings.TrimPrefix(value, "/")
+	}
+	sort.Ints(indexes)
+	result := make([]string, 0, len(indexes))
+	for _, i := range indexes {
+		result = append(result, paths[i])
+	}
+	return result
 }
 
 // Config pull the config for the artifact from the appropriate registry and return it as an object
@@ -111,6 +348,19 @@ func (p *Puller) Pull(to target.Target, blocksize int, verbose bool, writer io.W
 // The resolver provides the channel to connect to the target type. resolver.Registry just uses the default registry,
 // while resolver.Directory uses a local directory, etc.
 func (p *Puller) Config(verbose bool, writer io.Writer, resolver ecresolver.ResolverCloser) (*ocispec.Descriptor, *ocispec.Image, error) {
+	desc, config, err := p.ECIConfig(verbose, writer, resolver)
+	if err != nil {
+		return nil, nil, err
+	}
+	return desc, &config.Image, nil
+}
+
+// ECIConfig pull the config for the artifact from the appropriate registry and return it parsed as an
+// ECIConfig. If the config has no ECI settings, the ECI field of the returned ECIConfig is nil.
+//
+// The resolver provides the channel to connect to the target type. resolver.Registry just uses the default registry,
+// while resolver.Directory uses a local directory, etc.
+func (p *Puller) ECIConfig(verbose bool, writer io.Writer, resolver ecresolver.ResolverCloser) (*ocispec.Descriptor, *ECIConfig, error) {
 	// must have valid image ref
 	if p.Image == "" {
 		return nil, nil, fmt.Errorf("must have valid image ref")
@@ -119,6 +369,7 @@ func (p *Puller) Config(verbose bool, writer io.Writer, resolver ecresolver.Reso
 	if p.Impl == nil {
 		p.Impl = oras.Copy
 	}
+	resolver = p.retrying(resolver)
 
 	// get the saved context; if nil, create a background one
 	ctx := resolver.Context()
@@ -130,12 +381,15 @@ func (p *Puller) Config(verbose bool, writer io.Writer, resolver ecresolver.Reso
 	store := content.NewMemory()
 
 	// we only pull indexes, manifests and configs
-	allowedMediaTypes := []string{ocispec.MediaTypeImageIndex, ocispec.MediaTypeImageManifest, ocispec.MediaTypeImageConfig, MimeTypeDockerImageConfig, MimeTypeDockerImageManifest, MimeTypeDockerImageIndex}
+	// the ECI config is included, as in OCI 1.1 artifacts it is a layer
+	allowedMediaTypes := []string{ocispec.MediaTypeImageIndex, ocispec.MediaTypeImageManifest, ocispec.MediaTypeImageConfig, MimeTypeDockerImageConfig, MimeTypeDockerImageManifest, MimeTypeDockerImageIndex, MimeTypeECIConfig, MimeTypeOCIEmptyJSON}
 
 	if verbose {
 		copyOpts = append(copyOpts, oras.WithPullStatusTrack(writer))
 	}
-	copyOpts = append(copyOpts, oras.WithAllowedMediaTypes(allowedMediaTypes), oras.WithPullEmptyNameAllowed(),
+	platform := p.platform()
+	copyOpts = append(copyOpts, oras.WithPullBaseHandler(platformHandler(resolver, p.Image, platform)),
+		oras.WithAllowedMediaTypes(allowedMediaTypes), oras.WithPullEmptyNameAllowed(),
 		oras.WithAdditionalCachedMediaTypes(ocispec.MediaTypeImageManifest, ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2Manifest, images.MediaTypeDockerSchema2ManifestList),
 	)
 
@@ -144,19 +398,121 @@ func (p *Puller) Config(verbose bool, writer io.Writer, resolver ecresolver.Reso
 	if err != nil {
 		return nil, nil, err
 	}
-	// walk the tree, looking for configs
+	// walk the tree, looking for configs; if we started with an index, only the manifest the
+	// platform handler selected was retrieved, so the config found is that of the manifest
 	ctx2 := context.TODO()
 	provider := oras.ProviderWrapper{Fetcher: store}
-	return findConfig(ctx2, &provider, "", "", []ocispec.Descriptor{root})
+	desc, config, err := findConfig(ctx2, &provider, []ocispec.Descriptor{root})
+	if err != nil {
+		return nil, nil, err
+	}
+	if desc == nil {
+		return nil, nil, fmt.Errorf("not found")
+	}
+	return desc, config, nil
+}
+
+// platform the platform to select from an index, defaulting to that of the current host
+func (p *Puller) platform() ocispec.Platform {
+	if p.Platform == nil {
+		return platforms.DefaultSpec()
+	}
+	return platforms.Normalize(*p.Platform)
+}
+
+// platformHandler returns a handler that, whenever it encounters an index, selects the single
+// manifest in it that best matches the platform, and stops processing all of the other manifests,
+// so that their content never is retrieved. The index itself is retrieved from the resolver.
+func platformHandler(resolver ecresolver.ResolverCloser, ref string, platform ocispec.Platform) images.HandlerFunc {
+	var (
+		lock    sync.Mutex
+		skipped = map[digest.Digest]bool{}
+	)
+	return func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		lock.Lock()
+		skip := skipped[desc.Digest]
+		lock.Unlock()
+		if skip {
+			return nil, images.ErrStopHandler
+		}
+		if !isIndexType(desc.MediaType) {
+			return nil, nil
+		}
+		fetcher, err := resolver.Fetcher(ctx, ref)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get fetcher for index %s: %v", desc.Digest, err)
+		}
+		rc, err := fetcher.Fetch(ctx, desc)
+		if err != nil {
+			return nil, fmt.Errorf("unable to fetch index %s: %v", desc.Digest, err)
+		}
+		defer func() { _ = rc.Close() }()
+		var index ocispec.Index
+		if err := json.NewDecoder(rc).Decode(&index); err != nil {
+			return nil, fmt.Errorf("invalid index %s: %v", desc.Digest, err)
+		}
+		selected, err := selectManifest(index.Manifests, platform)
+		if err != nil {
+			return nil, fmt.Errorf("index %s: %v", desc.Digest, err)
+		}
+		// nothing selected means that the index is not split by platform
+		if selected == nil {
+			return nil, nil
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		for _, m := range index.Manifests {
+			if m.Digest != selected.Digest {
+				skipped[m.Digest] = true
+			}
+		}
+		return nil, nil
+	}
 }
 
-func findConfig(ctx context.Context, provider ctrcontent.Provider, os, arch string, descs []ocispec.Descriptor) (desc *ocispec.Descriptor, config *ocispec.Image, err error) {
+// selectManifest select the manifest that best matches the platform. If none of the
+// manifests has a platform, returns nil. If some do, but none match, returns an error.
+func selectManifest(manifests []ocispec.Descriptor, platform ocispec.Platform) (*ocispec.Descriptor, error) {
+	var (
+		selected    *ocispec.Descriptor
+		hasPlatform bool
+		matcher     = platforms.Only(platform)
+	)
+	for i, m := range manifests {
+		if m.Platform == nil {
+			continue
+		}
+		hasPlatform = true
+		if !matcher.Match(*m.Platform) {
+			continue
+		}
+		if selected == nil || matcher.Less(*m.Platform, *selected.Platform) {
+			selected = &manifests[i]
+		}
+	}
+	if hasPlatform && selected == nil {
+		return nil, fmt.Errorf("no manifest for platform %s", platforms.Format(platform))
+	}
+	return selected, nil
+}
+
+func isIndexType(mediaType string) bool {
+	switch mediaType {
+	case ocispec.MediaTypeImageIndex, MimeTypeDockerImageIndex:
+		return true
+	}
+	return false
+}
+
+// findConfig walk the tree, as far as it was retrieved, to find the first config.
+// Returns nil desc and config, without an error, if none was found.
+func findConfig(ctx context.Context, provider ctrcontent.Provider, descs []ocispec.Descriptor) (desc *ocispec.Descriptor, config *ECIConfig, err error) {
 	// find the configs
 	for _, d := range descs {
 		switch d.MediaType {
-		case ocispec.MediaTypeImageConfig, MimeTypeDockerImageConfig:
+		case ocispec.MediaTypeImageConfig, MimeTypeDockerImageConfig, MimeTypeECIConfig:
 			var (
-				conf   ocispec.Image
+				conf   ECIConfig
 				reader ctrcontent.ReaderAt
 			)
 			reader, err = provider.ReaderAt(ctx, d)
@@ -171,10 +527,7 @@ func findConfig(ctx context.Context, provider ctrcontent.Provider, os, arch stri
 			if err := json.Unmarshal(data, &conf); err != nil {
 				return nil, nil, err
 			}
-			if (os != "" && conf.OS != os) || (arch != "" && conf.Architecture != arch) {
-				continue
-			}
-			// found a config with the right os and arch, so return it
+			// found a config, so return it
 			config = &conf
 			desc = &d
 			return
@@ -183,7 +536,7 @@ func findConfig(ctx context.Context, provider ctrcontent.Provider, os, arch stri
 			if err != nil {
 				continue
 			}
-			childDesc, childConfig, err := findConfig(ctx, provider, os, arch, children)
+			childDesc, childConfig, err := findConfig(ctx, provider, children)
 			if err != nil {
 				return nil, nil, err
 			}
@@ -193,5 +546,5 @@ func findConfig(ctx context.Context, provider ctrcontent.Provider, os, arch stri
 		}
 	}
 
-	return nil, nil, fmt.Errorf("not found")
+	return nil, nil, nil
 }
@@ -1,11 +1,23 @@
 package registry_test
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"testing"
 
+	"github.com/containerd/containerd/remotes"
 	"github.com/stretchr/testify/mock"
 
 	"github.com/lf-edge/edge-containers/pkg/registry"
@@ -14,6 +26,8 @@ import (
 	"oras.land/oras-go/pkg/oras"
 	"oras.land/oras-go/pkg/target"
 
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -65,3 +79,764 @@ func TestPull(t *testing.T) {
 		m.AssertExpectations(t)
 	}
 }
+
+func TestPullPlatform(t *testing.T) {
+	// create a temporary directory and install basic test files
+	tmpdir, err := os.MkdirTemp("", "eci-test")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+	inputs := map[string]TestInputFile{}
+	inputs["amd64"] = NewTestInputFile("kernel-amd64", "kernel", tmpdir)
+	inputs["arm64"] = NewTestInputFile("kernel-arm64", "kernel", tmpdir)
+	for _, v := range inputs {
+		err = os.WriteFile(v.Fullname(), v.Contents(), 0644)
+		if err != nil {
+			t.Fatalf("unable to create %s: %v", v.Fullname(), err)
+		}
+	}
+	artifacts := []registry.PlatformArtifact{
+		{Artifact: &registry.Artifact{Kernel: &registry.FileSource{Path: inputs["amd64"].Fullname()}}, ConfigOpts: registry.ConfigOpts{OS: "linux", Architecture: "amd64"}},
+		{Artifact: &registry.Artifact{Kernel: &registry.FileSource{Path: inputs["arm64"].Fullname()}}, ConfigOpts: registry.ConfigOpts{OS: "linux", Architecture: "arm64"}},
+	}
+	// push the index to a local directory
+	_, dirResolver, err := ecresolver.NewDirectory(context.TODO(), filepath.Join(tmpdir, "store"))
+	if err != nil {
+		t.Fatalf("unable to create directory resolver: %v", err)
+	}
+	pusher := registry.Pusher{Image: testImageName}
+	if _, err := pusher.PushIndex(registry.FormatArtifacts, false, nil, artifacts, dirResolver); err != nil {
+		t.Fatalf("unable to push index: %v", err)
+	}
+
+	tests := []struct {
+		platform *ocispec.Platform
+		kernel   []byte
+		err      error
+	}{
+		{&ocispec.Platform{OS: "linux", Architecture: "amd64"}, inputs["amd64"].Contents(), nil},
+		{&ocispec.Platform{OS: "linux", Architecture: "arm64"}, inputs["arm64"].Contents(), nil},
+		{&ocispec.Platform{OS: "linux", Architecture: "riscv64"}, nil, fmt.Errorf("index ")},
+	}
+	for i, tt := range tests {
+		pullDir := filepath.Join(tmpdir, fmt.Sprintf("pull-%d", i))
+		puller := registry.Puller{
+			Image:    testImageName,
+			Platform: tt.platform,
+		}
+		_, artifact, err := puller.Pull(content.NewFile(pullDir), 0, false, nil, dirResolver)
+		switch {
+		case (err != nil && tt.err == nil) || (err == nil && tt.err != nil) || (err != nil && tt.err != nil && !strings.Contains(err.Error(), tt.err.Error())):
+			t.Errorf("%d: mismatched errors, actual %v expected %v", i, err, tt.err)
+		case err != nil:
+			continue
+		case artifact.Kernel == nil:
+			t.Errorf("%d: no kernel pulled", i)
+		default:
+			b, err := os.ReadFile(filepath.Join(pullDir, artifact.Kernel.GetPath()))
+			if err != nil {
+				t.Errorf("%d: unable to read kernel: %v", i, err)
+			} else if !bytes.Equal(b, tt.kernel) {
+				t.Errorf("%d: mismatched kernel, actual %s expected %s", i, b, tt.kernel)
+			}
+		}
+		// the config must be for the selected platform
+		if tt.err == nil {
+			_, config, err := puller.Config(false, nil, dirResolver)
+			switch {
+			case err != nil:
+				t.Errorf("%d: unable to get config: %v", i, err)
+			case config.Architecture != tt.platform.Architecture:
+				t.Errorf("%d: mismatched config architecture, actual %s expected %s", i, config.Architecture, tt.platform.Architecture)
+			}
+			inspection, err := puller.Inspect(dirResolver)
+			switch {
+			case err != nil:
+				t.Errorf("%d: unable to inspect: %v", i, err)
+			case inspection.Index == nil || inspection.Platform == nil || inspection.Platform.Architecture != tt.platform.Architecture:
+				t.Errorf("%d: mismatched inspected platform %v", i, inspection.Platform)
+			}
+		}
+	}
+}
+
+func TestECIConfig(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "eci-test")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+	kernel := NewTestInputFile("kernel", "kernel", tmpdir)
+	if err := os.WriteFile(kernel.Fullname(), kernel.Contents(), 0644); err != nil {
+		t.Fatalf("unable to create %s: %v", kernel.Fullname(), err)
+	}
+	settings := &registry.ECISettings{
+		KernelCommandLine:  "console=ttyS0 root=/dev/vda",
+		BootMode:           registry.BootModeUEFI,
+		VirtualizationMode: registry.VirtualizationModePV,
+		Resources:          &registry.Resources{MinVCPUs: 4, MinMemoryMiB: 2048},
+	}
+
+	tests := []struct {
+		format   registry.Format
+		settings *registry.ECISettings
+	}{
+		{registry.FormatArtifacts, settings},
+		{registry.FormatOCI11, settings},
+		{registry.FormatLegacy, settings},
+		{registry.FormatArtifacts, nil},
+	}
+	for i, tt := range tests {
+		_, dirResolver, err := ecresolver.NewDirectory(context.TODO(), filepath.Join(tmpdir, fmt.Sprintf("store-%d", i)))
+		if err != nil {
+			t.Fatalf("%d: unable to create directory resolver: %v", i, err)
+		}
+		pusher := registry.Pusher{
+			Image:    testImageName,
+			Artifact: &registry.Artifact{Kernel: &registry.FileSource{Path: kernel.Fullname()}},
+		}
+		if _, err := pusher.Push(tt.format, false, nil, registry.ConfigOpts{ECI: tt.settings}, dirResolver); err != nil {
+			t.Fatalf("%d: unable to push: %v", i, err)
+		}
+		puller := registry.Puller{Image: testImageName}
+		_, config, err := puller.ECIConfig(false, nil, dirResolver)
+		switch {
+		case err != nil:
+			t.Errorf("%d: unable to get config: %v", i, err)
+		case config.OS != registry.DefaultOS:
+			t.Errorf("%d: mismatched os, actual %s expected %s", i, config.OS, registry.DefaultOS)
+		case tt.settings == nil && config.ECI != nil:
+			t.Errorf("%d: unexpected ECI settings %v", i, config.ECI)
+		case tt.settings == nil:
+		case config.ECI == nil:
+			t.Errorf("%d: missing ECI settings", i)
+		case config.ECI.KernelCommandLine != tt.settings.KernelCommandLine || config.ECI.BootMode != tt.settings.BootMode || config.ECI.VirtualizationMode != tt.settings.VirtualizationMode || *config.ECI.Resources != *tt.settings.Resources:
+			t.Errorf("%d: mismatched ECI settings, actual %v expected %v", i, config.ECI, tt.settings)
+		}
+	}
+
+	// the config of the manifest selected from an index, even if it has no os or architecture of its own
+	var artifacts []registry.PlatformArtifact
+	for _, arch := range []string{"amd64", "arm64"} {
+		configFile := filepath.Join(tmpdir, "config-"+arch+".json")
+		if err := os.WriteFile(configFile, []byte(`{"config":{"Labels":{"arch":"`+arch+`"}}}`), 0644); err != nil {
+			t.Fatalf("unable to create %s: %v", configFile, err)
+		}
+		artifacts = append(artifacts, registry.PlatformArtifact{
+			Artifact:   &registry.Artifact{Kernel: &registry.FileSource{Path: kernel.Fullname()}, Config: &registry.FileSource{Path: configFile}},
+			ConfigOpts: registry.ConfigOpts{OS: "linux", Architecture: arch},
+		})
+	}
+	_, dirResolver, err := ecresolver.NewDirectory(context.TODO(), filepath.Join(tmpdir, "store-index"))
+	if err != nil {
+		t.Fatalf("unable to create directory resolver: %v", err)
+	}
+	pusher := registry.Pusher{Image: testImageName}
+	if _, err := pusher.PushIndex(registry.FormatArtifacts, false, nil, artifacts, dirResolver); err != nil {
+		t.Fatalf("unable to push index: %v", err)
+	}
+	puller := registry.Puller{Image: testImageName, Platform: &ocispec.Platform{OS: "linux", Architecture: "arm64"}}
+	_, config, err := puller.ECIConfig(false, nil, dirResolver)
+	switch {
+	case err != nil:
+		t.Errorf("index: unable to get config: %v", err)
+	case config.Config.Labels["arch"] != "arm64":
+		t.Errorf("index: mismatched config, labels %v", config.Config.Labels)
+	}
+}
+
+func TestPullBootArtifacts(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "eci-test")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+	inputs := map[string]TestInputFile{}
+	for _, name := range []string{"kernel", "board.dtb", "OVMF_VARS.fd", "grubx64.efi", "modules.tar"} {
+		inputs[name] = NewTestInputFile(name, name, tmpdir)
+		if err := os.WriteFile(inputs[name].Fullname(), inputs[name].Contents(), 0644); err != nil {
+			t.Fatalf("unable to create %s: %v", inputs[name].Fullname(), err)
+		}
+	}
+	artifact := &registry.Artifact{
+		Kernel:        &registry.FileSource{Path: inputs["kernel"].Fullname()},
+		DeviceTree:    &registry.FileSource{Path: inputs["board.dtb"].Fullname()},
+		Firmware:      &registry.FileSource{Path: inputs["OVMF_VARS.fd"].Fullname()},
+		Bootloader:    &registry.FileSource{Path: inputs["grubx64.efi"].Fullname()},
+		KernelModules: &registry.FileSource{Path: inputs["modules.tar"].Fullname()},
+	}
+
+	for i, format := range []registry.Format{registry.FormatArtifacts, registry.FormatLegacy} {
+		_, dirResolver, err := ecresolver.NewDirectory(context.TODO(), filepath.Join(tmpdir, fmt.Sprintf("store-%d", i)))
+		if err != nil {
+			t.Fatalf("%d: unable to create directory resolver: %v", i, err)
+		}
+		pusher := registry.Pusher{Image: testImageName, Artifact: artifact}
+		if _, err := pusher.Push(format, false, nil, registry.ConfigOpts{}, dirResolver); err != nil {
+			t.Fatalf("%d: unable to push: %v", i, err)
+		}
+
+		// pull to a directory, which must repopulate the artifact
+		pullDir := filepath.Join(tmpdir, fmt.Sprintf("pull-%d", i))
+		puller := registry.Puller{Image: testImageName}
+		_, pulled, err := puller.Pull(content.NewFile(pullDir), 0, false, nil, dirResolver)
+		if err != nil {
+			t.Fatalf("%d: unable to pull: %v", i, err)
+		}
+		for _, tt := range []struct {
+			source registry.Source
+			input  string
+			name   string
+		}{
+			{pulled.DeviceTree, "board.dtb", "devicetree"},
+			{pulled.Firmware, "OVMF_VARS.fd", "firmware"},
+			{pulled.Bootloader, "grubx64.efi", "bootloader"},
+			{pulled.KernelModules, "modules.tar", "kernel-modules"},
+		} {
+			if tt.source == nil {
+				t.Errorf("%d: %s not pulled", i, tt.name)
+				continue
+			}
+			if tt.source.GetPath() != tt.name {
+				t.Errorf("%d: mismatched %s path, actual %s", i, tt.name, tt.source.GetPath())
+			}
+			// legacy format layers are tarred, so only check the contents for artifacts
+			if format != registry.FormatArtifacts {
+				continue
+			}
+			b, err := os.ReadFile(filepath.Join(pullDir, tt.source.GetPath()))
+			if err != nil {
+				t.Errorf("%d: unable to read %s: %v", i, tt.name, err)
+			} else if !bytes.Equal(b, inputs[tt.input].Contents()) {
+				t.Errorf("%d: mismatched %s, actual %s expected %s", i, tt.name, b, inputs[tt.input].Contents())
+			}
+		}
+
+		// pull to individual files
+		var deviceTree, firmware, bootloader, modules bytes.Buffer
+		target := &registry.FilesTarget{
+			DeviceTree:    &deviceTree,
+			Firmware:      &firmware,
+			Bootloader:    &bootloader,
+			KernelModules: &modules,
+		}
+		if _, _, err := puller.Pull(target, 0, false, nil, dirResolver); err != nil {
+			t.Fatalf("%d: unable to pull files: %v", i, err)
+		}
+		for _, tt := range []struct {
+			buf   *bytes.Buffer
+			input string
+		}{
+			{&deviceTree, "board.dtb"},
+			{&firmware, "OVMF_VARS.fd"},
+			{&bootloader, "grubx64.efi"},
+			{&modules, "modules.tar"},
+		} {
+			if !bytes.Equal(tt.buf.Bytes(), inputs[tt.input].Contents()) {
+				t.Errorf("%d: mismatched %s, actual %s expected %s", i, tt.input, tt.buf.Bytes(), inputs[tt.input].Contents())
+			}
+		}
+	}
+}
+
+func TestPullOther(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "eci-test")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+	names := []string{"LICENSE", "SHA256SUMS", "user-data"}
+	inputs := make([]TestInputFile, 0, len(names))
+	others := make([]registry.Source, 0, len(names))
+	for i, name := range names {
+		input := NewTestInputFile(name, fmt.Sprintf("other-%d-%s", i, name), tmpdir)
+		if err := os.WriteFile(input.Fullname(), input.Contents(), 0644); err != nil {
+			t.Fatalf("unable to create %s: %v", input.Fullname(), err)
+		}
+		inputs = append(inputs, input)
+		others = append(others, &registry.FileSource{Path: input.Fullname()})
+	}
+	artifact := &registry.Artifact{Other: others}
+
+	for i, format := range []registry.Format{registry.FormatArtifacts, registry.FormatLegacy} {
+		_, dirResolver, err := ecresolver.NewDirectory(context.TODO(), filepath.Join(tmpdir, fmt.Sprintf("store-%d", i)))
+		if err != nil {
+			t.Fatalf("%d: unable to create directory resolver: %v", i, err)
+		}
+		pusher := registry.Pusher{Image: testImageName, Artifact: artifact}
+		if _, err := pusher.Push(format, false, nil, registry.ConfigOpts{}, dirResolver); err != nil {
+			t.Fatalf("%d: unable to push: %v", i, err)
+		}
+
+		// pull to a directory, which must repopulate the other items in order
+		puller := registry.Puller{Image: testImageName}
+		_, pulled, err := puller.Pull(content.NewFile(filepath.Join(tmpdir, fmt.Sprintf("pull-%d", i))), 0, false, nil, dirResolver)
+		if err != nil {
+			t.Fatalf("%d: unable to pull: %v", i, err)
+		}
+		if len(pulled.Other) != len(inputs) {
+			t.Fatalf("%d: mismatched number of other items, actual %d expected %d", i, len(pulled.Other), len(inputs))
+		}
+		for j, name := range names {
+			expected := fmt.Sprintf("other-%d-%s", j, name)
+			if pulled.Other[j].GetPath() != expected {
+				t.Errorf("%d: mismatched other item %d, actual %s expected %s", i, j, pulled.Other[j].GetPath(), expected)
+			}
+		}
+
+		// pull to individual files, skipping the middle one
+		var first, last bytes.Buffer
+		target := &registry.FilesTarget{
+			Other: []io.Writer{&first, nil, &last},
+		}
+		if _, _, err := puller.Pull(target, 0, false, nil, dirResolver); err != nil {
+			t.Fatalf("%d: unable to pull files: %v", i, err)
+		}
+		if !bytes.Equal(first.Bytes(), inputs[0].Contents()) {
+			t.Errorf("%d: mismatched first other item, actual %s expected %s", i, first.Bytes(), inputs[0].Contents())
+		}
+		if !bytes.Equal(last.Bytes(), inputs[2].Contents()) {
+			t.Errorf("%d: mismatched last other item, actual %s expected %s", i, last.Bytes(), inputs[2].Contents())
+		}
+	}
+}
+
+// testLink a link in an image pushed by pushDockerImage, to the target path
+type testLink struct {
+	name   string
+	target string
+	// hard whether it is a hard link, in the layer of the file it links to, rather than a symlink in its own layer
+	hard bool
+}
+
+// pushDockerImage push an image as built by standard docker tools to the resolver, with each file in
+// its own layer, along with any hard links to it, and each symlink in its own layer, and no annotations;
+// only the config labels describe the files.
+func pushDockerImage(t *testing.T, resolver ecresolver.ResolverCloser, files map[string][]byte, links []testLink, labels map[string]string) {
+	t.Helper()
+	store := content.NewMemory()
+	var (
+		layers  []ocispec.Descriptor
+		diffIDs []digest.Digest
+		paths   []string
+	)
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	// layer the gzipped tar of the entries
+	layer := func(name string, entries func(tw *tar.Writer) error) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gz)
+		err := entries(tw)
+		if err == nil {
+			err = tw.Close()
+		}
+		if err == nil {
+			err = gz.Close()
+		}
+		if err != nil {
+			t.Fatalf("unable to create layer of %s: %v", name, err)
+		}
+		return buf.Bytes()
+	}
+	var blobs [][]byte
+	for _, p := range paths {
+		blobs = append(blobs, layer(p, func(tw *tar.Writer) error {
+			if err := addBytesToTarWriter(files[p], p, tw, initTime); err != nil {
+				return err
+			}
+			for _, l := range links {
+				if l.hard && l.target == p {
+					if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeLink, Name: l.name, Linkname: l.target, Mode: 0644, ModTime: initTime}); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}))
+	}
+	for _, l := range links {
+		if !l.hard {
+			blobs = append(blobs, layer(l.name, func(tw *tar.Writer) error {
+				return tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: l.name, Linkname: l.target, Mode: 0777, ModTime: initTime})
+			}))
+		}
+	}
+	for _, b := range blobs {
+		desc := ocispec.Descriptor{MediaType: registry.MimeTypeDockerLayerTarGzip, Digest: digest.FromBytes(b), Size: int64(len(b))}
+		store.Set(desc, b)
+		layers = append(layers, desc)
+		diffIDs = append(diffIDs, desc.Digest)
+	}
+	config, err := json.Marshal(ocispec.Image{
+		Platform: ocispec.Platform{OS: registry.DefaultOS, Architecture: registry.DefaultArch},
+		RootFS:   ocispec.RootFS{Type: "layers", DiffIDs: diffIDs},
+		Config:   ocispec.ImageConfig{Labels: labels},
+	})
+	if err != nil {
+		t.Fatalf("unable to marshal config: %v", err)
+	}
+	configDesc := ocispec.Descriptor{MediaType: registry.MimeTypeDockerImageConfig, Digest: digest.FromBytes(config), Size: int64(len(config))}
+	store.Set(configDesc, config)
+	manifest, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: registry.MimeTypeDockerImageManifest,
+		Config:    configDesc,
+		Layers:    layers,
+	})
+	if err != nil {
+		t.Fatalf("unable to marshal manifest: %v", err)
+	}
+	manifestDesc := ocispec.Descriptor{MediaType: registry.MimeTypeDockerImageManifest, Digest: digest.FromBytes(manifest), Size: int64(len(manifest))}
+	if err := store.StoreManifest(testImageName, manifestDesc, manifest); err != nil {
+		t.Fatalf("unable to store manifest: %v", err)
+	}
+	if _, err := oras.Copy(context.TODO(), store, testImageName, resolver, "", oras.WithPullEmptyNameAllowed(), oras.WithAdditionalCachedMediaTypes(registry.MimeTypeDockerImageManifest)); err != nil {
+		t.Fatalf("unable to push docker image: %v", err)
+	}
+	if err := resolver.Finalize(context.TODO()); err != nil {
+		t.Fatalf("unable to finalize: %v", err)
+	}
+}
+
+func TestPullLabels(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "eci-test")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+	files := map[string][]byte{
+		"boot/vmlinuz":        []byte("kernel"),
+		"boot/initrd.img-6.1": []byte("initrd"),
+		"disks/root.qcow2":    []byte("root"),
+		"disks/data-1.vmdk":   []byte("data"),
+		"disks/seed.iso":      []byte("seed"),
+	}
+	// as in images whose labels name links to the files
+	links := []testLink{
+		{name: "boot/initrd.img", target: "initrd.img-6.1"},
+		{name: "disks/data.vmdk", target: "disks/data-1.vmdk", hard: true},
+		{name: "boot/loop", target: "/boot/loop"},
+	}
+	labels := map[string]string{
+		registry.AnnotationKernelPath:                           "/boot/vmlinuz",
+		registry.AnnotationInitrdPath:                           "/boot/initrd.img",
+		registry.AnnotationRootPath:                             "/disks/root.qcow2",
+		fmt.Sprintf(registry.AnnotationDiskIndexPathPattern, 2): "/disks/seed.iso",
+		fmt.Sprintf(registry.AnnotationDiskIndexPathPattern, 1): "/disks/data.vmdk",
+	}
+	_, dirResolver, err := ecresolver.NewDirectory(context.TODO(), filepath.Join(tmpdir, "store"))
+	if err != nil {
+		t.Fatalf("unable to create directory resolver: %v", err)
+	}
+	pushDockerImage(t, dirResolver, files, links, labels)
+
+	puller := registry.Puller{Image: testImageName}
+	_, artifact, err := puller.Pull(content.NewFile(filepath.Join(tmpdir, "pull")), 0, false, nil, dirResolver)
+	if err != nil {
+		t.Fatalf("unable to pull: %v", err)
+	}
+	// each is a file in the layers, which is read from there, following links to the file
+	check := func(name string, source registry.Source, expected, file string) {
+		t.Helper()
+		l, ok := source.(*registry.LayerSource)
+		if !ok || l.Path != expected {
+			t.Errorf("mismatched %s %v, expected %s in the layers", name, source, expected)
+			return
+		}
+		rc, err := l.Open(context.TODO())
+		if err != nil {
+			t.Errorf("unable to open %s: %v", name, err)
+			return
+		}
+		defer func() { _ = rc.Close() }()
+		if b, err := io.ReadAll(rc); err != nil || !bytes.Equal(b, files[file]) {
+			t.Errorf("mismatched %s, actual %s expected %s: %v", name, b, files[file], err)
+		}
+	}
+	switch {
+	case artifact.Kernel == nil || artifact.Initrd == nil || artifact.Root == nil:
+		t.Fatalf("missing parts %v", artifact)
+	case len(artifact.Disks) != 2:
+		t.Fatalf("mismatched number of disks %d", len(artifact.Disks))
+	case artifact.Root.Type != registry.Qcow2 || artifact.Disks[0].Type != registry.Vmdk || artifact.Disks[1].Type != registry.ISO:
+		t.Errorf("mismatched disk types %v %v %v", artifact.Root.Type, artifact.Disks[0].Type, artifact.Disks[1].Type)
+	}
+	check("kernel", artifact.Kernel, "boot/vmlinuz", "boot/vmlinuz")
+	check("initrd", artifact.Initrd, "boot/initrd.img", "boot/initrd.img-6.1")
+	check("root", artifact.Root.Source, "disks/root.qcow2", "disks/root.qcow2")
+	check("disk 0", artifact.Disks[0].Source, "disks/data.vmdk", "disks/data-1.vmdk")
+	check("disk 1", artifact.Disks[1].Source, "disks/seed.iso", "disks/seed.iso")
+	missing := *artifact.Kernel.(*registry.LayerSource)
+	missing.Path = "/boot/missing"
+	if _, err := missing.Open(context.TODO()); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("mismatched error for missing file, actual %v expected %v", err, fs.ErrNotExist)
+	}
+	loop := *artifact.Kernel.(*registry.LayerSource)
+	loop.Path = "/boot/loop"
+	if _, err := loop.Open(context.TODO()); err == nil || errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("mismatched error for a symlink to itself: %v", err)
+	}
+
+	// pulled to a store that keeps the layers, they are read from there rather than fetched again
+	_, pulled, err := ecresolver.NewDirectory(context.TODO(), filepath.Join(tmpdir, "pulled"))
+	if err != nil {
+		t.Fatalf("unable to create directory resolver: %v", err)
+	}
+	counting := &interruptedResolver{ResolverCloser: dirResolver}
+	if _, artifact, err = puller.Pull(pulled, 0, false, nil, counting); err != nil {
+		t.Fatalf("unable to pull to directory: %v", err)
+	}
+	fetches := counting.fetches.Load()
+	check("kernel from the pulled layers", artifact.Kernel, "boot/vmlinuz", "boot/vmlinuz")
+	if n := counting.fetches.Load() - fetches; n != 0 {
+		t.Errorf("layers fetched again, %d times", n)
+	}
+
+	// the files themselves are extracted from the layers when pulling to individual files
+	var kernel, root bytes.Buffer
+	if _, _, err := puller.Pull(&registry.FilesTarget{Kernel: &kernel, Root: &root}, 0, false, nil, dirResolver); err != nil {
+		t.Fatalf("unable to pull files: %v", err)
+	}
+	if !bytes.Equal(kernel.Bytes(), files["boot/vmlinuz"]) {
+		t.Errorf("mismatched kernel, actual %s expected %s", kernel.Bytes(), files["boot/vmlinuz"])
+	}
+	if !bytes.Equal(root.Bytes(), files["disks/root.qcow2"]) {
+		t.Errorf("mismatched root, actual %s expected %s", root.Bytes(), files["disks/root.qcow2"])
+	}
+}
+
+func TestInspect(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "eci-test")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+	kernel := NewTestInputFile("kernel", "kernel", tmpdir)
+	root := NewTestInputFile("root.raw", "disk-root-root.raw", tmpdir)
+	for _, v := range []TestInputFile{kernel, root} {
+		if err := os.WriteFile(v.Fullname(), v.Contents(), 0644); err != nil {
+			t.Fatalf("unable to create %s: %v", v.Fullname(), err)
+		}
+	}
+	artifact := &registry.Artifact{
+		Kernel: &registry.FileSource{Path: kernel.Fullname()},
+		Root:   &registry.Disk{Source: &registry.FileSource{Path: root.Fullname()}, Type: registry.Raw},
+	}
+
+	for i, format := range []registry.Format{registry.FormatArtifacts, registry.FormatLegacy, registry.FormatOCI11, registry.FormatDocker} {
+		_, dirResolver, err := ecresolver.NewDirectory(context.TODO(), filepath.Join(tmpdir, fmt.Sprintf("store-%d", i)))
+		if err != nil {
+			t.Fatalf("%d: unable to create directory resolver: %v", i, err)
+		}
+		pusher := registry.Pusher{Image: testImageName, Artifact: artifact}
+		if _, err := pusher.Push(format, false, nil, registry.ConfigOpts{}, dirResolver); err != nil {
+			t.Fatalf("%d: unable to push: %v", i, err)
+		}
+		puller := registry.Puller{Image: testImageName}
+		inspection, err := puller.Inspect(dirResolver)
+		if err != nil {
+			t.Fatalf("%d: unable to inspect: %v", i, err)
+		}
+		if len(inspection.Roles) < 2 {
+			t.Fatalf("%d: mismatched roles %v", i, inspection.Roles)
+		}
+		switch {
+		case !inspection.ECI:
+			t.Errorf("%d: not detected as an ECI", i)
+		case inspection.Format != format:
+			t.Errorf("%d: mismatched format, actual %s expected %s", i, inspection.Format, format)
+		case inspection.Config == nil:
+			t.Errorf("%d: missing config", i)
+		case inspection.Platform == nil || inspection.Platform.OS != registry.DefaultOS:
+			t.Errorf("%d: mismatched platform %v", i, inspection.Platform)
+		case inspection.Labels[registry.AnnotationKernelPath] != "/kernel":
+			t.Errorf("%d: mismatched labels %v", i, inspection.Labels)
+		case inspection.Roles[0].Role != registry.RoleKernel || inspection.Roles[0].Name != "kernel":
+			t.Errorf("%d: mismatched kernel %v", i, inspection.Roles[0])
+		case inspection.Roles[1].Role != registry.RoleRootDisk || inspection.Roles[1].DiskType != "raw" || inspection.Roles[1].Annotations[registry.AnnotationRole] != registry.RoleRootDisk:
+			t.Errorf("%d: mismatched root disk %v", i, inspection.Roles[1])
+		}
+		// the layers in the formats that are not tarred are the files themselves
+		if (format == registry.FormatArtifacts || format == registry.FormatOCI11) && (inspection.Roles[0].Digest != kernel.Digest().String() || inspection.Roles[0].Size != kernel.Size()) {
+			t.Errorf("%d: mismatched kernel digest and size %v", i, inspection.Roles[0])
+		}
+	}
+
+	// an image built with standard docker tools
+	_, dirResolver, err := ecresolver.NewDirectory(context.TODO(), filepath.Join(tmpdir, "store-docker"))
+	if err != nil {
+		t.Fatalf("unable to create directory resolver: %v", err)
+	}
+	pushDockerImage(t, dirResolver, map[string][]byte{"boot/kernel": []byte("kernel")}, nil, map[string]string{registry.AnnotationKernelPath: "/boot/kernel"})
+	puller := registry.Puller{Image: testImageName}
+	inspection, err := puller.Inspect(dirResolver)
+	switch {
+	case err != nil:
+		t.Fatalf("unable to inspect docker image: %v", err)
+	case !inspection.ECI || inspection.Format != registry.FormatDocker:
+		t.Errorf("mismatched docker image format %v %s", inspection.ECI, inspection.Format)
+	case len(inspection.Roles) != 1 || inspection.Roles[0].Name != "boot/kernel" || inspection.Roles[0].Digest != "":
+		t.Errorf("mismatched docker image roles %v", inspection.Roles)
+	}
+}
+
+// interruptedResolver resolver that fails the fetch of one blob after a number of bytes, and records
+// where each fetch of it is moved to before reading
+type interruptedResolver struct {
+	ecresolver.ResolverCloser
+	digest digest.Digest
+	// limit the bytes of the blob read before failing; 0 does not fail
+	limit int64
+	seeks []int64
+	// fetches the number of fetches of any blob
+	fetches atomic.Int32
+}
+
+func (r *interruptedResolver) Fetcher(ctx context.Context, ref string) (remotes.Fetcher, error) {
+	fetcher, err := r.ResolverCloser.Fetcher(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return remotes.FetcherFunc(func(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+		r.fetches.Add(1)
+		rc, err := fetcher.Fetch(ctx, desc)
+		if err != nil || desc.Digest != r.digest {
+			return rc, err
+		}
+		return &interruptedReader{ReadCloser: rc, resolver: r}, nil
+	}), nil
+}
+
+type interruptedReader struct {
+	io.ReadCloser
+	resolver *interruptedResolver
+	offset   int64
+}
+
+func (r *interruptedReader) Read(p []byte) (int, error) {
+	limit := r.resolver.limit
+	if limit > 0 {
+		if r.offset >= limit {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if int64(len(p)) > limit-r.offset {
+			p = p[:limit-r.offset]
+		}
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *interruptedReader) Seek(offset int64, whence int) (int64, error) {
+	n, err := r.ReadCloser.(io.Seeker).Seek(offset, whence)
+	r.offset = n
+	r.resolver.seeks = append(r.resolver.seeks, n)
+	return n, err
+}
+
+func TestPullResume(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "eci-test")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+	kernel := []byte("kernel")
+	root := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	for name, b := range map[string][]byte{"kernel": kernel, "root.img": root} {
+		if err := os.WriteFile(filepath.Join(tmpdir, name), b, 0644); err != nil {
+			t.Fatalf("unable to create %s: %v", name, err)
+		}
+	}
+	artifact := &registry.Artifact{
+		Kernel: &registry.FileSource{Path: filepath.Join(tmpdir, "kernel")},
+		Root:   &registry.Disk{Source: &registry.FileSource{Path: filepath.Join(tmpdir, "root.img")}, Type: registry.Raw},
+	}
+	_, dirResolver, err := ecresolver.NewDirectory(context.TODO(), filepath.Join(tmpdir, "store"))
+	if err != nil {
+		t.Fatalf("unable to create directory resolver: %v", err)
+	}
+	pusher := registry.Pusher{Image: testImageName, Artifact: artifact}
+	if _, err := pusher.Push(registry.FormatArtifacts, false, nil, registry.ConfigOpts{}, dirResolver); err != nil {
+		t.Fatalf("unable to push: %v", err)
+	}
+	rootDigest := digest.FromBytes(root)
+
+	tests := []struct {
+		name string
+		// target the target to pull to, and the file the root disk is in, given the directory for both
+		target func(dir string) (target.Target, string)
+		// again whether pulling again, once complete, leaves the root disk as is
+		again bool
+	}{
+		{"file store", func(dir string) (target.Target, string) {
+			return registry.NewFileStore(dir), filepath.Join(dir, "disk-root-root.img")
+		}, true},
+		{"files", func(dir string) (target.Target, string) {
+			filename := filepath.Join(dir, "root.img")
+			// opened like eci pullfiles does, each pull opening it anew
+			f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				t.Fatalf("unable to open %s: %v", filename, err)
+			}
+			t.Cleanup(func() { _ = f.Close() })
+			return &registry.FilesTarget{Root: f}, filename
+		}, true},
+		{"directory", func(dir string) (target.Target, string) {
+			_, d, err := ecresolver.NewDirectory(context.TODO(), dir)
+			if err != nil {
+				t.Fatalf("unable to create directory resolver: %v", err)
+			}
+			return d, filepath.Join(dir, "blobs", "sha256", rootDigest.Encoded())
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(tmpdir, strings.ReplaceAll(tt.name, " ", "-"))
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Fatalf("unable to create directory: %v", err)
+			}
+			half := int64(len(root) / 2)
+			resolver := &interruptedResolver{ResolverCloser: dirResolver, digest: rootDigest, limit: half}
+			puller := registry.Puller{Image: testImageName}
+
+			to, _ := tt.target(dir)
+			if _, _, err := puller.Pull(to, 0, false, nil, resolver); err == nil {
+				t.Fatal("interrupted pull did not fail")
+			}
+			resolver.limit = 0
+			to, filename := tt.target(dir)
+			if _, _, err := puller.Pull(to, 0, false, nil, resolver); err != nil {
+				t.Fatalf("unable to pull: %v", err)
+			}
+			if len(resolver.seeks) != 1 || resolver.seeks[0] != half {
+				t.Errorf("mismatched resume offsets, actual %v expected [%d]", resolver.seeks, half)
+			}
+			b, err := os.ReadFile(filename)
+			switch {
+			case err != nil:
+				t.Fatalf("unable to read root disk: %v", err)
+			case !bytes.Equal(b, root):
+				t.Fatalf("mismatched root disk, %d bytes, expected %d", len(b), len(root))
+			}
+			if _, err := os.Stat(filename + ecresolver.PartialSuffix); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("partial state of the root disk not removed: %v", err)
+			}
+
+			if !tt.again {
+				return
+			}
+			to, _ = tt.target(dir)
+			if _, _, err := puller.Pull(to, 0, false, nil, resolver); err != nil {
+				t.Fatalf("unable to pull again: %v", err)
+			}
+			if b, err := os.ReadFile(filename); err != nil || !bytes.Equal(b, root) {
+				t.Errorf("mismatched root disk after pulling again, %d bytes, expected %d: %v", len(b), len(root), err)
+			}
+		})
+	}
+}
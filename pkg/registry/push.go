@@ -31,6 +31,9 @@ type Pusher struct {
 	Timestamp *time.Time
 	// Impl the OCI artifacts pusher. Normally should be left blank, will be filled in to use oras. Override only for special cases like testing.
 	Impl func(ctx context.Context, from target.Target, fromRef string, to target.Target, toRef string, opts ...oras.CopyOpt) (ocispec.Descriptor, error)
+	// Retry how to retry a push that fails partway with a transient error, e.g. a dropped connection.
+	// Blobs already in the target are not pushed again. The zero value does not retry.
+	Retry ecresolver.RetryOptions
 }
 
 // Push push the artifact to the appropriate registry. Arguments are the format to write,
@@ -40,16 +43,41 @@ type Pusher struct {
 // The target determines the target type. target.Registry just uses the default registry,
 // while target.Directory uses a local directory.
 func (p Pusher) Push(format Format, verbose bool, statusWriter io.Writer, configOpts ConfigOpts, to ecresolver.ResolverCloser) (string, error) {
+	// ensure the artifact is provided
+	if p.Artifact == nil {
+		return "", fmt.Errorf("must have valid Artifact")
+	}
+	return p.push(format, verbose, statusWriter, to, func(legacyOpts []LegacyOpt) (target.Target, error) {
+		_, from, err := p.Artifact.Manifest(format, configOpts, p.Image, legacyOpts...)
+		return from, err
+	})
+}
+
+// PushIndex push multiple artifacts, one per platform, to the appropriate registry as a single
+// image index under the image reference. The platform of each artifact is determined by
+// its ConfigOpts. The Artifact in the Pusher is ignored.
+//
+// Arguments otherwise are the same as for Push.
+func (p Pusher) PushIndex(format Format, verbose bool, statusWriter io.Writer, artifacts []PlatformArtifact, to ecresolver.ResolverCloser) (string, error) {
+	// ensure the artifacts are provided
+	if len(artifacts) == 0 {
+		return "", fmt.Errorf("must have at least one valid PlatformArtifact")
+	}
+	return p.push(format, verbose, statusWriter, to, func(legacyOpts []LegacyOpt) (target.Target, error) {
+		_, from, err := Index(artifacts, format, p.Image, legacyOpts...)
+		return from, err
+	})
+}
+
+// push the content created by build to the target.
+func (p Pusher) push(format Format, verbose bool, statusWriter io.Writer, to ecresolver.ResolverCloser, build func(legacyOpts []LegacyOpt) (target.Target, error)) (string, error) {
 	var (
 		desc     ocispec.Descriptor
 		err      error
 		copyOpts []oras.CopyOpt
 	)
 
-	// ensure the artifact and name are provided
-	if p.Artifact == nil {
-		return "", fmt.Errorf("must have valid Artifact")
-	}
+	// ensure the name is provided
 	if p.Image == "" {
 		return "", fmt.Errorf("must have valid image ref")
 	}
@@ -71,7 +99,7 @@ func (p Pusher) Push(format Format, verbose bool, statusWriter io.Writer, config
 	)
 	legacyOpts = append(legacyOpts, WithTimestamp(p.Timestamp))
 
-	if format == FormatLegacy {
+	if format.tarred() {
 		tmpDir, err = os.MkdirTemp("", "edge-containers")
 		if err != nil {
 			return "", fmt.Errorf("could not make temporary directory for tgz files: %v", err)
@@ -80,7 +108,7 @@ func (p Pusher) Push(format Format, verbose bool, statusWriter io.Writer, config
 		defer func() { _ = os.RemoveAll(tmpDir) }()
 	}
 
-	_, from, err := p.Artifact.Manifest(format, configOpts, p.Image, legacyOpts...)
+	from, err := build(legacyOpts)
 	if err != nil {
 		return "", fmt.Errorf("could not build manifest: %v", err)
 	}
@@ -88,9 +116,24 @@ func (p Pusher) Push(format Format, verbose bool, statusWriter io.Writer, config
 	if verbose {
 		copyOpts = append(copyOpts, oras.WithPullStatusTrack(statusWriter))
 	}
+	// oras only caches OCI manifests and indexes by default, which it needs in order to walk them
+	if format == FormatDocker {
+		copyOpts = append(copyOpts, oras.WithAdditionalCachedMediaTypes(MimeTypeDockerImageManifest, MimeTypeDockerImageIndex))
+	}
 
 	// push the data
-	desc, err = p.Impl(ctx, from, p.Image, to, "", copyOpts...)
+	for attempt := 1; ; attempt++ {
+		desc, err = p.Impl(ctx, from, p.Image, to, "", copyOpts...)
+		if err == nil || attempt > p.Retry.Attempts || !ecresolver.IsRetryable(err) {
+			break
+		}
+		if verbose {
+			_, _ = fmt.Fprintf(statusWriter, "retrying push, attempt %d of %d: %v\n", attempt, p.Retry.Attempts, err)
+		}
+		if err := p.Retry.Wait(ctx, attempt); err != nil {
+			return "", err
+		}
+	}
 	if err != nil {
 		return "", err
 	}
@@ -7,12 +7,15 @@ import (
 	"context"
 	"crypto/sha256"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
+	remoteserrors "github.com/containerd/containerd/remotes/errors"
 	"github.com/stretchr/testify/mock"
 
 	"github.com/lf-edge/edge-containers/pkg/registry"
@@ -195,6 +198,63 @@ func TestPush(t *testing.T) {
 	}
 }
 
+func TestPushRetry(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "eci-test")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+	kernel := NewTestInputFile("kernel", "kernel", tmpdir)
+	if err := os.WriteFile(kernel.Fullname(), kernel.Contents(), 0644); err != nil {
+		t.Fatalf("unable to create %s: %v", kernel.Fullname(), err)
+	}
+	_, resolver, err := ecresolver.NewRegistry(context.TODO())
+	if err != nil {
+		t.Fatalf("unexpected error when created NewRegistry resolver: %v", err)
+	}
+	unavailable := remoteserrors.ErrUnexpectedStatus{Status: "503 Service Unavailable", StatusCode: http.StatusServiceUnavailable}
+	denied := remoteserrors.ErrUnexpectedStatus{Status: "403 Forbidden", StatusCode: http.StatusForbidden}
+
+	tests := []struct {
+		failures []error
+		attempts int
+		calls    int
+		valid    bool
+	}{
+		{nil, 0, 1, true},
+		{[]error{unavailable}, 0, 1, false},
+		{[]error{unavailable, io.ErrUnexpectedEOF}, 2, 3, true},
+		{[]error{unavailable, unavailable, unavailable}, 2, 3, false},
+		{[]error{denied}, 2, 1, false},
+	}
+	for i, tt := range tests {
+		calls := 0
+		pusher := registry.Pusher{
+			Artifact:  &registry.Artifact{Kernel: &registry.FileSource{Path: kernel.Fullname()}},
+			Image:     testImageName,
+			Timestamp: &initTime,
+			Retry:     ecresolver.RetryOptions{Attempts: tt.attempts, Backoff: time.Millisecond},
+			Impl: func(ctx context.Context, from target.Target, fromRef string, to target.Target, toRef string, opts ...oras.CopyOpt) (ocispec.Descriptor, error) {
+				calls++
+				if calls <= len(tt.failures) {
+					return ocispec.Descriptor{}, tt.failures[calls-1]
+				}
+				return desc, nil
+			},
+		}
+		_, err := pusher.Push(registry.FormatArtifacts, false, nil, registry.ConfigOpts{}, resolver)
+		switch {
+		case tt.valid && err != nil:
+			t.Errorf("%d: unexpected error: %v", i, err)
+		case !tt.valid && err == nil:
+			t.Errorf("%d: push did not fail", i)
+		}
+		if calls != tt.calls {
+			t.Errorf("%d: mismatched pushes, actual %d expected %d", i, calls, tt.calls)
+		}
+	}
+}
+
 func compress(in []byte, name string, timestamp time.Time) (out []byte, err error) {
 	byteWriter := bytes.NewBuffer(nil)
 	gzipWriter := gzip.NewWriter(byteWriter)
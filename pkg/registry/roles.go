@@ -5,4 +5,10 @@ const (
 	RoleInitrd         = "initrd"
 	RoleRootDisk       = "disk-root"
 	RoleAdditionalDisk = "disk-additional"
+	RoleConfig         = "config"
+	RoleDeviceTree     = "devicetree"
+	RoleFirmware       = "firmware"
+	RoleBootloader     = "bootloader"
+	RoleKernelModules  = "kernel-modules"
+	RoleOther          = "other"
 )
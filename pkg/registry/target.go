@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
@@ -12,6 +13,7 @@ import (
 
 	ctrcontent "github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/remotes"
+	ecresolver "github.com/lf-edge/edge-containers/pkg/resolver"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"oras.land/oras-go/pkg/content"
@@ -31,12 +33,22 @@ type Target interface {
 }
 
 // FilesTarget provides targets for each file type. If a type is nil,
-// its content is ignored
+// its content is ignored. Content written to a regular file, i.e. an *os.File, as is, rather than
+// decompressed or unpacked, keeps its state beside it, so that a pull that stops partway continues
+// from there the next time.
 type FilesTarget struct {
 	// Kernel writer where to write the kernel
 	Kernel io.Writer
 	// Initrd writer where to write the initrd
 	Initrd io.Writer
+	// DeviceTree writer where to write the device tree blob
+	DeviceTree io.Writer
+	// Firmware writer where to write the firmware
+	Firmware io.Writer
+	// Bootloader writer where to write the bootloader
+	Bootloader io.Writer
+	// KernelModules writer where to write the kernel modules bundle
+	KernelModules io.Writer
 	// Config writer where to write the config
 	Config io.Writer
 	// Root writer where to write the root disk
@@ -47,7 +59,8 @@ type FilesTarget struct {
 	Other []io.Writer
 	// BlockSize how big a blocksize to use when reading/writing. Defaults to whatever io.Copy uses
 	BlockSize int
-	// AcceptHash if set to true, accept the hash in the descriptor as is, i.e. do not recalculate it
+	// AcceptHash if set to true, accept the hash in the descriptor as is, i.e. do not recalculate it.
+	// Such content starts over, rather than continuing from where an earlier pull stopped.
 	AcceptHash bool
 	// config stores the config annotations, if they exist
 	config map[string]string
@@ -100,7 +113,33 @@ func (f *FilesTarget) Pusher(ctx context.Context, ref string) (remotes.Pusher, e
 		ref:    tag,
 		hash:   hash,
 	}
-	return content.NewDecompress(pusher, content.WithMultiWriterIngester()), nil
+	return filesDecompress{Decompress: content.NewDecompress(pusher, content.WithMultiWriterIngester()), pusher: pusher}, nil
+}
+
+// filesDecompress decompresses and untars content on its way to the target, as needed. Content that is
+// neither compressed nor archived goes to the target as is, so that it can continue from where an
+// earlier pull of it stopped.
+type filesDecompress struct {
+	content.Decompress
+	pusher *filesPusher
+}
+
+func (d filesDecompress) Push(ctx context.Context, desc ocispec.Descriptor) (ctrcontent.Writer, error) {
+	if archived(desc.MediaType) {
+		return d.Decompress.Push(ctx, desc)
+	}
+	return d.pusher.push(ctx, desc, true)
+}
+
+// archived whether content of the media type is compressed or archived, and so is decompressed or untarred
+// on its way to the target
+func archived(mediaType string) bool {
+	for _, suffix := range []string{"+gzip", ".gzip", ".tar"} {
+		if strings.HasSuffix(mediaType, suffix) {
+			return true
+		}
+	}
+	return false
 }
 
 func (f *FilesTarget) Writer(ctx context.Context, opts ...ctrcontent.WriterOpt) (ctrcontent.Writer, error) {
@@ -157,6 +196,12 @@ type filesPusher struct {
 }
 
 func (f *filesPusher) Push(ctx context.Context, desc ocispec.Descriptor) (ctrcontent.Writer, error) {
+	return f.push(ctx, desc, false)
+}
+
+// push get a writer of the content to its target. If resumable, content written to a regular file is kept
+// when the pull stops partway, with its state beside it, so that a later pull continues from there.
+func (f *filesPusher) push(ctx context.Context, desc ocispec.Descriptor, resumable bool) (ctrcontent.Writer, error) {
 	writerOpts := []content.WriterOpt{}
 	if f.target.BlockSize > 0 {
 		writerOpts = append(writerOpts, content.WithBlocksize(f.target.BlockSize))
@@ -178,23 +223,54 @@ func (f *filesPusher) Push(ctx context.Context, desc ocispec.Descriptor) (ctrcon
 	switch desc.Annotations[AnnotationRole] {
 	case RoleKernel:
 		if f.target.Kernel != nil {
-			return content.NewIoContentWriter(f.target.Kernel, writerOpts...), nil
+			return f.writer(f.target.Kernel, desc, resumable, writerOpts)
 		}
 	case RoleInitrd:
 		if f.target.Initrd != nil {
-			return content.NewIoContentWriter(f.target.Initrd, writerOpts...), nil
+			return f.writer(f.target.Initrd, desc, resumable, writerOpts)
+		}
+	case RoleDeviceTree:
+		if f.target.DeviceTree != nil {
+			return f.writer(f.target.DeviceTree, desc, resumable, writerOpts)
+		}
+	case RoleFirmware:
+		if f.target.Firmware != nil {
+			return f.writer(f.target.Firmware, desc, resumable, writerOpts)
+		}
+	case RoleBootloader:
+		if f.target.Bootloader != nil {
+			return f.writer(f.target.Bootloader, desc, resumable, writerOpts)
+		}
+	case RoleKernelModules:
+		if f.target.KernelModules != nil {
+			return f.writer(f.target.KernelModules, desc, resumable, writerOpts)
 		}
 	case RoleRootDisk:
 		if f.target.Root != nil {
-			return content.NewIoContentWriter(f.target.Root, writerOpts...), nil
+			return f.writer(f.target.Root, desc, resumable, writerOpts)
 		}
 	case RoleAdditionalDisk:
+	case RoleOther:
+		if index, ok := nameIndex(RoleOther, desc.Annotations[ocispec.AnnotationTitle]); ok && index < len(f.target.Other) && f.target.Other[index] != nil {
+			return f.writer(f.target.Other[index], desc, resumable, writerOpts)
+		}
 	}
 
 	//return content.NewIoContentWriter(nil, writerOpts...), nil
 	return content.NewIoContentWriter(nil, writerOpts...), nil
 }
 
+// writer the writer of the content to w. Content written to a regular file, when resumable, is kept
+// when the pull stops partway, unless the hash is accepted as is, as it is verified when complete.
+func (f *filesPusher) writer(w io.Writer, desc ocispec.Descriptor, resumable bool, opts []content.WriterOpt) (ctrcontent.Writer, error) {
+	if file, ok := w.(*os.File); ok && resumable && !f.target.AcceptHash {
+		if info, err := file.Stat(); err == nil && info.Mode().IsRegular() {
+			return ecresolver.NewPartialWriter(file, file.Name()+ecresolver.PartialSuffix, desc, true)
+		}
+	}
+	return content.NewIoContentWriter(w, opts...), nil
+}
+
 func (f *filesPusher) Pushers(ctx context.Context, desc ocispec.Descriptor) (func(name string) (ctrcontent.Writer, error), error) {
 	writerOpts := []content.WriterOpt{}
 	if f.target.BlockSize > 0 {
@@ -266,6 +342,9 @@ func (c *configIngestor) Commit(ctx context.Context, size int64, expected digest
 	disksPattern := strings.ReplaceAll(AnnotationDiskIndexPathPattern, "%d", `([\d]+)`)
 	// we are ignoring errors for now, as that should never happen
 	re, _ := regexp.Compile(disksPattern)
+	// and other items
+	othersPattern := strings.ReplaceAll(AnnotationOtherIndexPathPattern, "%d", `([\d]+)`)
+	otherRe, _ := regexp.Compile(othersPattern)
 
 	for annotation, value := range c.target.config {
 		// ignore absolute oaths, because tar does
@@ -282,6 +361,23 @@ func (c *configIngestor) Commit(ctx context.Context, size int64, expected digest
 			c.target.pathWriters[value] = c.target.Initrd
 		case annotation == AnnotationRootPath && c.target.Root != nil:
 			c.target.pathWriters[value] = c.target.Root
+		case annotation == AnnotationDeviceTreePath && c.target.DeviceTree != nil:
+			c.target.pathWriters[value] = c.target.DeviceTree
+		case annotation == AnnotationFirmwarePath && c.target.Firmware != nil:
+			c.target.pathWriters[value] = c.target.Firmware
+		case annotation == AnnotationBootloaderPath && c.target.Bootloader != nil:
+			c.target.pathWriters[value] = c.target.Bootloader
+		case annotation == AnnotationKernelModulesPath && c.target.KernelModules != nil:
+			c.target.pathWriters[value] = c.target.KernelModules
+		case otherRe.MatchString(annotation):
+			matches := otherRe.FindStringSubmatch(annotation)
+			index, err := strconv.Atoi(matches[1])
+			if err != nil {
+				continue
+			}
+			if len(c.target.Other) > index && c.target.Other[index] != nil {
+				c.target.pathWriters[value] = c.target.Other[index]
+			}
 		default:
 			// didn't find it yet
 			matches := re.FindStringSubmatch(annotation)
@@ -309,3 +405,21 @@ func (c *configIngestor) Write(p []byte) (n int, err error) {
 	c.content = append(c.content, p...)
 	return len(p), nil
 }
+
+// nameIndex get the index from a name of the form <prefix>-<index>-<original_name>,
+// e.g. other-0-LICENSE. Returns false if the name is not of that form.
+func nameIndex(prefix, name string) (int, bool) {
+	rest := strings.TrimPrefix(name, prefix+"-")
+	if rest == name {
+		return 0, false
+	}
+	parts := strings.SplitN(rest, "-", 2)
+	if len(parts) != 2 {
+		return 0, false
+	}
+	index, err := strconv.Atoi(parts[0])
+	if err != nil || index < 0 {
+		return 0, false
+	}
+	return index, true
+}
@@ -0,0 +1,157 @@
+package resolver
+
+/*
+ Provides a github.com/containerd/containerd/remotes#Resolver that resolves
+ from an ordered chain of resolvers, e.g. a local directory, a site mirror and the upstream registry,
+ falling back to the next when one does not have, or cannot serve, an image or blob.
+
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Chain resolver that tries each of its resolvers in turn. Images are pushed to the last one, the upstream.
+type Chain struct {
+	resolvers []ResolverCloser
+	ctx       context.Context
+	lock      sync.Mutex
+	served    map[digest.Digest]int
+}
+
+// NewChain create a resolver from the resolvers, tried in the given order
+func NewChain(ctx context.Context, resolvers ...ResolverCloser) (context.Context, *Chain, error) {
+	if len(resolvers) == 0 {
+		return nil, nil, errors.New("chain requires at least one resolver")
+	}
+	return ctx, &Chain{resolvers: resolvers, ctx: ctx, served: map[digest.Digest]int{}}, nil
+}
+
+// Resolvers the resolvers in the chain, in order
+func (c *Chain) Resolvers() []ResolverCloser {
+	return c.resolvers
+}
+
+// Served the index of the resolver in the chain that served each manifest resolved, and each blob fetched
+func (c *Chain) Served() map[digest.Digest]int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	served := map[digest.Digest]int{}
+	for dgst, i := range c.served {
+		served[dgst] = i
+	}
+	return served
+}
+
+func (c *Chain) serve(dgst digest.Digest, i int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.served[dgst] = i
+}
+
+func (c *Chain) Resolve(ctx context.Context, ref string) (name string, desc ocispec.Descriptor, err error) {
+	var errs []error
+	for i, r := range c.resolvers {
+		name, desc, err := r.Resolve(memberContext(ctx, r), ref)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("resolver %d: %w", i, err))
+			continue
+		}
+		c.serve(desc.Digest, i)
+		return name, desc, nil
+	}
+	return "", ocispec.Descriptor{}, fmt.Errorf("unable to resolve %s: %w", ref, errors.Join(errs...))
+}
+
+func (c *Chain) Fetcher(ctx context.Context, ref string) (remotes.Fetcher, error) {
+	return &chainFetcher{chain: c, ref: ref, fetchers: make([]remotes.Fetcher, len(c.resolvers))}, nil
+}
+
+func (c *Chain) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	upstream := c.resolvers[len(c.resolvers)-1]
+	return upstream.Pusher(memberContext(ctx, upstream), ref)
+}
+
+func (c *Chain) Finalize(ctx context.Context) error {
+	var errs []error
+	for _, r := range c.resolvers {
+		if err := r.Finalize(memberContext(ctx, r)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *Chain) Context() context.Context {
+	return c.ctx
+}
+
+// chainFetcher fetcher that fetches each blob from the first resolver in the chain that has it
+type chainFetcher struct {
+	chain    *Chain
+	ref      string
+	lock     sync.Mutex
+	fetchers []remotes.Fetcher
+}
+
+// fetcher the fetcher of the i'th resolver, created on first use
+func (f *chainFetcher) fetcher(ctx context.Context, i int) (remotes.Fetcher, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.fetchers[i] == nil {
+		r := f.chain.resolvers[i]
+		fetcher, err := r.Fetcher(memberContext(ctx, r), f.ref)
+		if err != nil {
+			return nil, err
+		}
+		f.fetchers[i] = fetcher
+	}
+	return f.fetchers[i], nil
+}
+
+func (f *chainFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	var errs []error
+	for i, r := range f.chain.resolvers {
+		fetcher, err := f.fetcher(ctx, i)
+		if err == nil {
+			var rc io.ReadCloser
+			if rc, err = fetcher.Fetch(memberContext(ctx, r), desc); err == nil {
+				f.chain.serve(desc.Digest, i)
+				return rc, nil
+			}
+		}
+		errs = append(errs, fmt.Errorf("resolver %d: %w", i, err))
+	}
+	return nil, fmt.Errorf("unable to fetch %s: %w", desc.Digest, errors.Join(errs...))
+}
+
+// valuesContext a context with the deadline and cancellation of one context, and the values of another
+// as well, e.g. the namespace and lease of a containerd resolver
+type valuesContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c valuesContext) Value(key any) any {
+	if v := c.values.Value(key); v != nil {
+		return v
+	}
+	return c.Context.Value(key)
+}
+
+// memberContext the context to call the resolver in a chain with
+func memberContext(ctx context.Context, r ResolverCloser) context.Context {
+	values := r.Context()
+	if values == nil {
+		return ctx
+	}
+	return valuesContext{Context: ctx, values: values}
+}
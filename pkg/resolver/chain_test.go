@@ -0,0 +1,93 @@
+package resolver_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ecresolver "github.com/lf-edge/edge-containers/pkg/resolver"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestChain(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "edge-containers-chain")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+
+	var dirs []*ecresolver.Directory
+	var resolvers []ecresolver.ResolverCloser
+	for _, name := range []string{"down", "mirror", "upstream"} {
+		_, d, err := ecresolver.NewDirectory(context.TODO(), filepath.Join(tmpdir, name))
+		if err != nil {
+			t.Fatalf("unable to create directory resolver: %v", err)
+		}
+		dirs = append(dirs, d)
+		resolvers = append(resolvers, d)
+	}
+	// the mirror is stale: it has only the current image, and is missing its layer
+	pushImage(t, dirs[1], "docker.io/lfedge/eci:current", "current")
+	if err := os.RemoveAll(filepath.Join(tmpdir, "down")); err != nil {
+		t.Fatalf("unable to remove directory: %v", err)
+	}
+	_, c, err := ecresolver.NewChain(context.TODO(), resolvers...)
+	if err != nil {
+		t.Fatalf("unable to create chain: %v", err)
+	}
+
+	// pushes go to the upstream
+	current := pushImage(t, c, "docker.io/lfedge/eci:current", "current")
+	latest := pushImage(t, c, "docker.io/lfedge/eci:latest", "latest")
+	if _, _, err := dirs[1].Resolve(context.TODO(), "docker.io/lfedge/eci:latest"); err == nil {
+		t.Error("push went to the mirror")
+	}
+	layer := readManifest(t, dirs[2], "docker.io/lfedge/eci:current").Layers[0]
+	if err := os.Remove(filepath.Join(tmpdir, "mirror", "blobs", "sha256", layer.Digest.Encoded())); err != nil {
+		t.Fatalf("unable to remove layer from mirror: %v", err)
+	}
+
+	for _, tt := range []struct {
+		ref    string
+		source int
+	}{
+		{"docker.io/lfedge/eci:current", 1},
+		{"docker.io/lfedge/eci:latest", 2},
+	} {
+		_, desc, err := c.Resolve(context.TODO(), tt.ref)
+		if err != nil {
+			t.Fatalf("%s: unable to resolve: %v", tt.ref, err)
+		}
+		if served := c.Served()[desc.Digest]; served != tt.source {
+			t.Errorf("%s: mismatched source, actual %d expected %d", tt.ref, served, tt.source)
+		}
+	}
+	if _, _, err := c.Resolve(context.TODO(), "docker.io/lfedge/eci:missing"); err == nil {
+		t.Error("resolve of missing image did not fail")
+	}
+
+	manifest := readManifest(t, c, "docker.io/lfedge/eci:current")
+	if actual := fetchString(t, c, "docker.io/lfedge/eci:current", manifest.Layers[0].Digest); actual != "current" {
+		t.Errorf("mismatched layer, actual %s expected current", actual)
+	}
+	if actual := fetchString(t, c, "docker.io/lfedge/eci:current", manifest.Config.Digest); actual != "{}" {
+		t.Errorf("mismatched config, actual %s expected {}", actual)
+	}
+	served := c.Served()
+	for dgst, expected := range map[digest.Digest]int{
+		current.Digest:            1,
+		manifest.Config.Digest:    1,
+		manifest.Layers[0].Digest: 2,
+		latest.Digest:             2,
+	} {
+		if actual, ok := served[dgst]; !ok || actual != expected {
+			t.Errorf("%s: mismatched source, actual %d expected %d", dgst, actual, expected)
+		}
+	}
+
+	if _, _, err := ecresolver.NewChain(context.TODO()); err == nil {
+		t.Error("empty chain did not fail")
+	}
+}
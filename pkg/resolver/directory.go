@@ -7,15 +7,16 @@ package resolver
  The format in the directory is the OCI spec for an image layout,
  at https://github.com/opencontainers/image-spec/blob/master/image-layout.md
 
- The image reference name is stored in the root index.json, with the image name stored
- as the annotation for image name, i.e. org.opencontainers.image.ref.name
+ A single directory can hold many images. Each is a descriptor in the root index.json, with the image name
+ stored as the annotation for image name, i.e. org.opencontainers.image.ref.name, e.g. docker.io/foo/bar:1.0 .
+ Pushing an image whose name already is in index.json replaces it; all others are kept. An image is resolved by
+ its name, by its tag alone, or by its digest, in which case nested indexes are searched as well.
 
  The spec for annotations is available https://github.com/opencontainers/image-spec/blob/master/annotations.md
 */
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -23,8 +24,7 @@ import (
 	"time"
 
 	"github.com/containerd/containerd/content"
-	"github.com/containerd/containerd/images"
-	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/remotes"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -44,31 +44,26 @@ func NewDirectory(ctx context.Context, dir string) (context.Context, *Directory,
 }
 
 func (d *Directory) Resolve(ctx context.Context, ref string) (name string, desc ocispec.Descriptor, err error) {
-	refspec, err := reference.Parse(ref)
+	// shared, so that nothing is removed while walking the layout
+	unlock, err := lockLayout(d.dir, false)
 	if err != nil {
 		return "", ocispec.Descriptor{}, err
 	}
-
-	if refspec.Object == "" {
-		return "", ocispec.Descriptor{}, reference.ErrObjectRequired
-	}
-
-	// get the root manifest
-	// try to get it from the image reference file
-	indexFile := path.Join(d.dir, "index.json")
-	contents, err := os.ReadFile(indexFile)
+	defer func() { _ = unlock() }()
+	index, err := readIndex(d.dir)
 	if err != nil {
-		return "", ocispec.Descriptor{}, reference.ErrInvalid
+		return "", ocispec.Descriptor{}, err
 	}
-	var rootDesc ocispec.Index
-	if err := json.Unmarshal(contents, &rootDesc); err != nil {
-		return "", ocispec.Descriptor{}, fmt.Errorf("could not convert manifest description to json: %v", err)
+	found, err := findImage(index.Manifests, ref, func(desc ocispec.Descriptor) (*ocispec.Index, error) {
+		return readIndexBlob(d.dir, desc)
+	})
+	if err != nil {
+		return "", ocispec.Descriptor{}, err
 	}
-	if len(rootDesc.Manifests) < 1 {
-		return "", ocispec.Descriptor{}, fmt.Errorf("index %s did not have any manifests", indexFile)
+	if found == nil {
+		return "", ocispec.Descriptor{}, fmt.Errorf("%s not found in %s: %w", ref, d.dir, errdefs.ErrNotFound)
 	}
-
-	return ref, rootDesc.Manifests[0], nil
+	return ref, *found, nil
 }
 
 func (d Directory) Fetcher(ctx context.Context, ref string) (remotes.Fetcher, error) {
@@ -109,9 +104,20 @@ func (r rcWrapper) Read(b []byte) (int, error) {
 	return r.rc.Read(b)
 }
 
+// Seek move within the blob, so that a write that continues an earlier one need not read it all again
+func (r rcWrapper) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := r.rc.(io.Seeker)
+	if !ok {
+		return 0, fmt.Errorf("unsupported")
+	}
+	return seeker.Seek(offset, whence)
+}
+
 func (d directoryFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
-	blobsDir := path.Join(d.dir, "blobs", desc.Digest.Algorithm().String())
-	filename := path.Join(blobsDir, desc.Digest.Hex())
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid digest %s: %v", desc.Digest, err)
+	}
+	filename := blobPath(d.dir, desc.Digest)
 	file, err := os.Open(filename)
 	if err != nil {
 		return nil, fmt.Errorf("could not open for reading %s: %v", filename, err)
@@ -120,109 +126,197 @@ func (d directoryFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (i
 }
 
 func (d directoryPusher) Push(ctx context.Context, desc ocispec.Descriptor) (content.Writer, error) {
-	blobsDir := path.Join(d.dir, "blobs", desc.Digest.Algorithm().String())
-	if err := os.MkdirAll(blobsDir, 0755); err != nil {
-		return nil, fmt.Errorf("could not create directory %s: %v", blobsDir, err)
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid digest %s: %v", desc.Digest, err)
 	}
-	filename := path.Join(blobsDir, desc.Digest.Hex())
-	file, err := os.Create(filename)
+	// only the root of the image goes into the index.json
+	root := isRoot(d.ref, desc)
+
+	// a valid blob already in place need not be written again; one that is not is replaced
+	filename := blobPath(d.dir, desc.Digest)
+	existing, err := existingBlob(d.dir, filename, desc)
 	if err != nil {
-		return nil, fmt.Errorf("could not create for writing %s: %v", filename, err)
+		return nil, err
 	}
-	var isManifest bool
-	switch desc.MediaType {
-	case images.MediaTypeDockerSchema2Manifest, images.MediaTypeDockerSchema2ManifestList,
-		ocispec.MediaTypeImageManifest, ocispec.MediaTypeImageIndex:
-		isManifest = true
+	if existing {
+		if root {
+			if err := addToIndex(d.dir, desc, d.ref); err != nil {
+				return nil, err
+			}
+		}
+		return nil, fmt.Errorf("blob %s: %w", desc.Digest, errdefs.ErrAlreadyExists)
 	}
 
-	return directoryWriter{
-		file:       file,
-		desc:       desc,
-		isManifest: isManifest,
-		ref:        d.ref,
-		indexFile:  path.Join(d.dir, "index.json"),
+	// write to a file in the ingest directory, which is moved into place only when committed
+	blobsDir := path.Dir(filename)
+	ingestDir := path.Join(d.dir, ingestDirname)
+	for _, dir := range []string{blobsDir, ingestDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("could not create directory %s: %v", dir, err)
+		}
+	}
+	file, resumable, err := ingestFile(ingestDir, desc.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("could not create for writing %s: %v", filename, err)
+	}
+	stateFile := ""
+	if resumable {
+		stateFile = file.Name() + PartialSuffix
+	}
+	partial, err := NewPartialWriter(file, stateFile, desc, false)
+	if err != nil {
+		_ = file.Close()
+		if !resumable {
+			_ = os.Remove(file.Name())
+		}
+		return nil, err
+	}
+	return &directoryWriter{
+		PartialWriter: partial,
+		file:          file,
+		resumable:     resumable,
+		filename:      filename,
+		desc:          desc,
+		isRoot:        root,
+		ref:           d.ref,
+		dir:           d.dir,
 	}, nil
 }
 
-type directoryWriter struct {
-	file       *os.File
-	ref        string
-	isManifest bool
-	desc       ocispec.Descriptor
-	committed  bool
-	start      time.Time
-	updated    time.Time
-	total      int64
-	indexFile  string
+// existingBlob whether the valid blob already is in place at filename, in the layout in dir. If it is, it is touched,
+// so that a GC, which holds the layout lock, keeps it for the grace period, as the rest of the push continues.
+func existingBlob(dir, filename string, desc ocispec.Descriptor) (bool, error) {
+	unlock, err := lockLayout(dir, false)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = unlock() }()
+	if err := verifyBlob(filename, desc); err != nil {
+		return false, nil
+	}
+	// a blob owned by someone else, in a layout shared with them, cannot be touched, but still is used
+	now := time.Now()
+	_ = os.Chtimes(filename, now, now)
+	return true, nil
 }
 
-// Digest may return empty digest or panics until committed.
-func (d directoryWriter) Digest() digest.Digest {
-	return d.desc.Digest
+// ingestFile open the file in the ingest directory to write the blob to. It is the same file each time, so that
+// a write continues from where an earlier one of the same blob stopped, unless another writer has it, in which
+// case the blob is written to a temporary file of its own, which is not resumable. Either is locked while it is
+// written, so that GC leaves it, however long the write takes.
+func ingestFile(ingestDir string, dgst digest.Digest) (file *os.File, resumable bool, err error) {
+	filename := path.Join(ingestDir, dgst.Encoded())
+	if file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0600); err == nil {
+		// the file may have been committed, i.e. moved into place, between opening and locking it
+		locked, err := tryFlock(file)
+		if err == nil && locked && sameFile(file, filename) {
+			return file, true, nil
+		}
+		_ = file.Close()
+	}
+	file, err = os.CreateTemp(ingestDir, dgst.Encoded()+"-*")
+	if err != nil {
+		return nil, false, err
+	}
+	// no one else has a new temporary file, so the lock is available
+	if _, err := tryFlock(file); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return nil, false, err
+	}
+	return file, false, nil
+}
+
+// sameFile whether the open file still is the one at filename
+func sameFile(file *os.File, filename string) bool {
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(filename)
+	return err == nil && os.SameFile(info, current)
 }
 
-func (d directoryWriter) Close() error {
-	return d.file.Close()
+// directoryWriter writer of a blob to the ingest directory, which continues from where an earlier write
+// of the same blob stopped, and is moved into place when committed
+type directoryWriter struct {
+	*PartialWriter
+	file      *os.File
+	resumable bool
+	filename  string
+	ref       string
+	isRoot    bool
+	desc      ocispec.Descriptor
+	committed bool
+	dir       string
 }
 
-func (d directoryWriter) Write(p []byte) (n int, err error) {
-	n, err = d.file.Write(p)
-	d.total += int64(n) //nolint:staticcheck
-	return n, err
+// Close closes the writer; if it was not committed, whatever was written is kept, so that a later write
+// of the same blob continues from it, unless it was written to a temporary file, which is discarded.
+func (d *directoryWriter) Close() error {
+	if d.file == nil {
+		return nil
+	}
+	err := d.PartialWriter.Close()
+	if closeErr := d.file.Close(); err == nil {
+		err = closeErr
+	}
+	if !d.resumable {
+		_ = os.Remove(d.file.Name())
+	}
+	d.file = nil
+	return err
 }
 
-// Commit commits the blob (but no roll-back is guaranteed on an error).
+// Commit commits the blob, once it is verified to match the size and digest it was pushed with,
+// as well as those passed, if any. It is synced to disk and only then moved into place, so that a
+// blob in the directory always is complete.
 // size and expected can be zero-value when unknown.
 // Commit always closes the writer, even on error.
 // ErrAlreadyExists aborts the writer.
-func (d directoryWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+func (d *directoryWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
 	if d.committed {
 		return nil
 	}
-	if err := d.Close(); err != nil {
+	if d.file == nil {
+		return fmt.Errorf("writer for %s is closed", d.desc.Digest)
+	}
+	tmpfile := d.file.Name()
+	// the file is removed, unless it was moved into place
+	defer func() { _ = os.Remove(tmpfile) }()
+
+	err := d.PartialWriter.Commit(ctx, size, expected, opts...)
+	if closeErr := d.file.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("could not close %s: %v", tmpfile, closeErr)
+	}
+	d.file = nil
+	if err != nil {
 		return err
 	}
-	// when we commit, we also need to write the image file
-	if d.isManifest {
-		// ensure that the name annotation exists
-		if d.desc.Annotations == nil {
-			d.desc.Annotations = map[string]string{}
-		}
-		if value, ok := d.desc.Annotations[ocispec.AnnotationRefName]; !ok || value == "" {
-			d.desc.Annotations[ocispec.AnnotationRefName] = d.ref
-		}
-		// convert the manifest to json bytes and write it to the index.json
-		index := ocispec.Index{
-			Manifests: []ocispec.Descriptor{
-				d.desc,
-			},
-		}
-		b, err := json.Marshal(index)
-		if err != nil {
-			return fmt.Errorf("could not convert index to json: %v", err)
-		}
-		if err := os.WriteFile(d.indexFile, b, 0644); err != nil {
-			return fmt.Errorf("error writing index file %s: %v", d.indexFile, err)
+	// ingest files are created private, but blobs are readable by all, like any other file
+	if err := os.Chmod(tmpfile, 0644); err != nil {
+		return fmt.Errorf("could not set permissions on %s: %v", tmpfile, err)
+	}
+	if err := os.Rename(tmpfile, d.filename); err != nil {
+		return fmt.Errorf("could not move blob into place at %s: %v", d.filename, err)
+	}
+	if err := syncDir(path.Dir(d.filename)); err != nil {
+		return err
+	}
+	d.committed = true
+
+	// when we commit the root, we also need to add the image to the index
+	if d.isRoot {
+		if err := addToIndex(d.dir, d.desc, d.ref); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
 // Status returns the current state of write
-func (d directoryWriter) Status() (content.Status, error) {
-	status := content.Status{
-		Ref:       d.ref,
-		Offset:    d.total,
-		Total:     d.total,
-		Expected:  d.Digest(),
-		StartedAt: d.start,
-		UpdatedAt: d.updated,
-	}
-	return status, nil
-}
-
-// Truncate updates the size of the target blob
-func (d directoryWriter) Truncate(size int64) error {
-	return fmt.Errorf("unsupported")
+func (d *directoryWriter) Status() (content.Status, error) {
+	status, err := d.PartialWriter.Status()
+	status.Ref = d.ref
+	return status, err
 }
@@ -0,0 +1,413 @@
+package resolver_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	ctrcontent "github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	ecresolver "github.com/lf-edge/edge-containers/pkg/resolver"
+
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// pushBlob push a single blob to the resolver, as part of the image ref
+func pushBlob(t *testing.T, d ecresolver.ResolverCloser, ref, mediaType string, content []byte) ocispec.Descriptor {
+	t.Helper()
+	ctx := context.TODO()
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(content),
+		Size:      int64(len(content)),
+	}
+	pusher, err := d.Pusher(ctx, ref)
+	if err != nil {
+		t.Fatalf("unable to get pusher: %v", err)
+	}
+	w, err := pusher.Push(ctx, desc)
+	switch {
+	case errors.Is(err, errdefs.ErrAlreadyExists):
+		return desc
+	case err != nil:
+		t.Fatalf("unable to push %s: %v", desc.Digest, err)
+	}
+	if _, err := w.Write(content); err != nil {
+		t.Fatalf("unable to write %s: %v", desc.Digest, err)
+	}
+	if err := w.Commit(ctx, desc.Size, desc.Digest); err != nil {
+		t.Fatalf("unable to commit %s: %v", desc.Digest, err)
+	}
+	return desc
+}
+
+// pushImage push a manifest with a single layer to the resolver as the image ref, returning the manifest descriptor
+func pushImage(t *testing.T, d ecresolver.ResolverCloser, ref, layer string) ocispec.Descriptor {
+	t.Helper()
+	config := pushBlob(t, d, ref, ocispec.MediaTypeImageConfig, []byte("{}"))
+	layerDesc := pushBlob(t, d, ref, ocispec.MediaTypeImageLayer, []byte(layer))
+	manifest := ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layerDesc},
+	}
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatalf("unable to marshal manifest: %v", err)
+	}
+	return pushBlob(t, d, fmt.Sprintf("%s@%s", ref, digest.FromBytes(b)), ocispec.MediaTypeImageManifest, b)
+}
+
+func TestDirectoryMultipleImages(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "edge-containers-directory")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+	_, d, err := ecresolver.NewDirectory(context.TODO(), tmpdir)
+	if err != nil {
+		t.Fatalf("unable to create directory resolver: %v", err)
+	}
+
+	current := pushImage(t, d, "docker.io/lfedge/eci:current", "current")
+	fallback := pushImage(t, d, "docker.io/lfedge/eci:fallback", "fallback")
+	// an index holding another manifest, which is only reachable through the index
+	nested := pushImage(t, d, "docker.io/lfedge/other:1.0", "nested")
+	index := ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{nested},
+	}
+	b, err := json.Marshal(index)
+	if err != nil {
+		t.Fatalf("unable to marshal index: %v", err)
+	}
+	indexDesc := pushBlob(t, d, fmt.Sprintf("docker.io/lfedge/other:1.0@%s", digest.FromBytes(b)), ocispec.MediaTypeImageIndex, b)
+	// replace the fallback
+	replaced := pushImage(t, d, "docker.io/lfedge/eci:fallback", "fallback-2")
+	// the same content under another name, whose blobs all exist already
+	_ = pushImage(t, d, "docker.io/lfedge/eci:alias", "current")
+
+	// the index.json should have exactly the four images
+	contents, err := os.ReadFile(filepath.Join(tmpdir, "index.json"))
+	if err != nil {
+		t.Fatalf("unable to read index.json: %v", err)
+	}
+	var root ocispec.Index
+	if err := json.Unmarshal(contents, &root); err != nil {
+		t.Fatalf("invalid index.json: %v", err)
+	}
+	if len(root.Manifests) != 4 {
+		t.Errorf("expected 4 images in index.json, found %d", len(root.Manifests))
+	}
+	if _, err := os.Stat(filepath.Join(tmpdir, ocispec.ImageLayoutFile)); err != nil {
+		t.Errorf("missing %s: %v", ocispec.ImageLayoutFile, err)
+	}
+
+	tests := []struct {
+		ref    string
+		digest digest.Digest
+		err    error
+	}{
+		{"docker.io/lfedge/eci:current", current.Digest, nil},
+		{"docker.io/lfedge/eci:fallback", replaced.Digest, nil},
+		{"docker.io/lfedge/eci:alias", current.Digest, nil},
+		{"docker.io/lfedge/other:1.0", indexDesc.Digest, nil},
+		{fmt.Sprintf("docker.io/lfedge/eci@%s", current.Digest), current.Digest, nil},
+		{fmt.Sprintf("docker.io/lfedge/other@%s", nested.Digest), nested.Digest, nil},
+		{"docker.io/lfedge/eci:unknown", "", errdefs.ErrNotFound},
+		{fmt.Sprintf("docker.io/lfedge/eci@%s", fallback.Digest), "", errdefs.ErrNotFound},
+	}
+	for _, tt := range tests {
+		_, desc, err := d.Resolve(context.TODO(), tt.ref)
+		switch {
+		case tt.err != nil && !errors.Is(err, tt.err):
+			t.Errorf("%s: mismatched errors, actual %v expected %v", tt.ref, err, tt.err)
+		case tt.err == nil && err != nil:
+			t.Errorf("%s: unexpected error: %v", tt.ref, err)
+		case desc.Digest != tt.digest:
+			t.Errorf("%s: mismatched digest, actual %s expected %s", tt.ref, desc.Digest, tt.digest)
+		}
+	}
+}
+
+func TestDirectoryTagOnly(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "edge-containers-directory")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+	_, d, err := ecresolver.NewDirectory(context.TODO(), tmpdir)
+	if err != nil {
+		t.Fatalf("unable to create directory resolver: %v", err)
+	}
+	desc := pushImage(t, d, "docker.io/lfedge/eci:1.0", "layer")
+
+	// other tools store just the tag as the name
+	desc.Annotations = map[string]string{ocispec.AnnotationRefName: "1.0"}
+	b, err := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []ocispec.Descriptor{desc},
+	})
+	if err != nil {
+		t.Fatalf("unable to marshal index: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpdir, "index.json"), b, 0644); err != nil {
+		t.Fatalf("unable to write index.json: %v", err)
+	}
+	_, resolved, err := d.Resolve(context.TODO(), "docker.io/lfedge/eci:1.0")
+	if err != nil {
+		t.Fatalf("unable to resolve by tag: %v", err)
+	}
+	if resolved.Digest != desc.Digest {
+		t.Errorf("mismatched digest, actual %s expected %s", resolved.Digest, desc.Digest)
+	}
+}
+
+func TestDirectoryReadOnly(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can write to read-only directories")
+	}
+	tmpdir, err := os.MkdirTemp("", "edge-containers-directory")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() {
+		_ = os.Chmod(tmpdir, 0755)
+		_ = os.RemoveAll(tmpdir)
+	}()
+	_, d, err := ecresolver.NewDirectory(context.TODO(), tmpdir)
+	if err != nil {
+		t.Fatalf("unable to create directory resolver: %v", err)
+	}
+	desc := pushImage(t, d, "docker.io/lfedge/eci:1.0", "layer")
+
+	// with the lock file that cannot be written, and then without any, as when copied to read-only media
+	lockFile := filepath.Join(tmpdir, ".lock")
+	for i, prepare := range []func() error{
+		func() error { return os.Chmod(lockFile, 0444) },
+		func() error { return os.Remove(lockFile) },
+	} {
+		if err := os.Chmod(tmpdir, 0755); err != nil {
+			t.Fatalf("%d: unable to make directory writable: %v", i, err)
+		}
+		if err := prepare(); err != nil {
+			t.Fatalf("%d: unable to prepare lock file: %v", i, err)
+		}
+		if err := os.Chmod(tmpdir, 0555); err != nil {
+			t.Fatalf("%d: unable to make directory read-only: %v", i, err)
+		}
+		_, resolved, err := d.Resolve(context.TODO(), "docker.io/lfedge/eci:1.0")
+		if err != nil {
+			t.Fatalf("%d: unable to resolve read-only directory: %v", i, err)
+		}
+		if resolved.Digest != desc.Digest {
+			t.Errorf("%d: mismatched digest, actual %s expected %s", i, resolved.Digest, desc.Digest)
+		}
+	}
+}
+
+func TestDirectoryCommitVerify(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "edge-containers-directory")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+	_, d, err := ecresolver.NewDirectory(context.TODO(), tmpdir)
+	if err != nil {
+		t.Fatalf("unable to create directory resolver: %v", err)
+	}
+	ctx := context.TODO()
+	content := []byte("a layer")
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayer,
+		Digest:    digest.FromBytes(content),
+		Size:      int64(len(content)),
+	}
+	blob := filepath.Join(tmpdir, "blobs", "sha256", desc.Digest.Encoded())
+
+	tests := []struct {
+		written  []byte
+		size     int64
+		expected digest.Digest
+		err      error
+	}{
+		// truncated
+		{content[:3], desc.Size, desc.Digest, errdefs.ErrFailedPrecondition},
+		// corrupted
+		{[]byte("a lAyer"), desc.Size, desc.Digest, errdefs.ErrFailedPrecondition},
+		// mismatched expected digest
+		{content, desc.Size, digest.FromString("other"), errdefs.ErrFailedPrecondition},
+		// unknown size and digest
+		{content, 0, "", nil},
+	}
+	for i, tt := range tests {
+		_ = os.Remove(blob)
+		pusher, err := d.Pusher(ctx, "docker.io/lfedge/eci:1.0")
+		if err != nil {
+			t.Fatalf("unable to get pusher: %v", err)
+		}
+		w, err := pusher.Push(ctx, desc)
+		if err != nil {
+			t.Fatalf("%d: unable to push: %v", i, err)
+		}
+		if _, err := w.Write(tt.written); err != nil {
+			t.Fatalf("%d: unable to write: %v", i, err)
+		}
+		err = w.Commit(ctx, tt.size, tt.expected)
+		switch {
+		case tt.err != nil && !errors.Is(err, tt.err):
+			t.Errorf("%d: mismatched errors, actual %v expected %v", i, err, tt.err)
+		case tt.err == nil && err != nil:
+			t.Errorf("%d: unexpected error: %v", i, err)
+		}
+		_, statErr := os.Stat(blob)
+		if exists := statErr == nil; exists != (tt.err == nil) {
+			t.Errorf("%d: blob exists %v, expected %v", i, exists, tt.err == nil)
+		}
+	}
+	// nothing left behind
+	if entries, err := os.ReadDir(filepath.Join(tmpdir, "ingest")); err != nil || len(entries) != 0 {
+		t.Errorf("ingest directory not empty: %v %v", entries, err)
+	}
+
+	// a valid blob is not written again, a corrupt one is
+	pusher, err := d.Pusher(ctx, "docker.io/lfedge/eci:1.0")
+	if err != nil {
+		t.Fatalf("unable to get pusher: %v", err)
+	}
+	if _, err := pusher.Push(ctx, desc); !errors.Is(err, errdefs.ErrAlreadyExists) {
+		t.Errorf("existing blob: mismatched errors, actual %v expected %v", err, errdefs.ErrAlreadyExists)
+	}
+	if err := os.WriteFile(blob, content[:3], 0644); err != nil {
+		t.Fatalf("unable to truncate blob: %v", err)
+	}
+	w, err := pusher.Push(ctx, desc)
+	if err != nil {
+		t.Fatalf("corrupt blob: unable to push: %v", err)
+	}
+	_ = w.Close()
+}
+
+func TestDirectoryConcurrent(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "edge-containers-directory")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+
+	// each has its own Directory, as separate processes would, and all share the config blob
+	const count = 20
+	var (
+		wg      sync.WaitGroup
+		digests [count]digest.Digest
+	)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, d, err := ecresolver.NewDirectory(context.TODO(), tmpdir)
+			if err != nil {
+				t.Errorf("%d: unable to create directory resolver: %v", i, err)
+				return
+			}
+			digests[i] = pushImage(t, d, fmt.Sprintf("docker.io/lfedge/eci:%d", i), fmt.Sprintf("layer-%d", i)).Digest
+		}(i)
+	}
+	wg.Wait()
+
+	_, d, err := ecresolver.NewDirectory(context.TODO(), tmpdir)
+	if err != nil {
+		t.Fatalf("unable to create directory resolver: %v", err)
+	}
+	for i := 0; i < count; i++ {
+		ref := fmt.Sprintf("docker.io/lfedge/eci:%d", i)
+		_, desc, err := d.Resolve(context.TODO(), ref)
+		switch {
+		case err != nil:
+			t.Errorf("%s: unable to resolve: %v", ref, err)
+		case desc.Digest != digests[i]:
+			t.Errorf("%s: mismatched digest, actual %s expected %s", ref, desc.Digest, digests[i])
+		}
+	}
+}
+
+func TestDirectoryResume(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "edge-containers-directory")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+	_, d, err := ecresolver.NewDirectory(context.TODO(), tmpdir)
+	if err != nil {
+		t.Fatalf("unable to create directory resolver: %v", err)
+	}
+	ctx := context.TODO()
+	content := []byte("a layer written in two parts")
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayer,
+		Digest:    digest.FromBytes(content),
+		Size:      int64(len(content)),
+	}
+	pusher, err := d.Pusher(ctx, "docker.io/lfedge/eci:1.0")
+	if err != nil {
+		t.Fatalf("unable to get pusher: %v", err)
+	}
+	offset := func(w ctrcontent.Writer) int64 {
+		status, err := w.Status()
+		if err != nil {
+			t.Fatalf("unable to get status: %v", err)
+		}
+		return status.Offset
+	}
+
+	half := len(content) / 2
+	w, err := pusher.Push(ctx, desc)
+	if err != nil {
+		t.Fatalf("unable to push: %v", err)
+	}
+	if _, err := w.Write(content[:half]); err != nil {
+		t.Fatalf("unable to write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("unable to close: %v", err)
+	}
+
+	w, err = pusher.Push(ctx, desc)
+	if err != nil {
+		t.Fatalf("unable to push again: %v", err)
+	}
+	if actual := offset(w); actual != int64(half) {
+		t.Errorf("mismatched offset, actual %d expected %d", actual, half)
+	}
+	// another writer of the same blob at the same time starts over on its own
+	other, err := pusher.Push(ctx, desc)
+	if err != nil {
+		t.Fatalf("unable to push at the same time: %v", err)
+	}
+	if actual := offset(other); actual != 0 {
+		t.Errorf("mismatched offset of other writer, actual %d expected 0", actual)
+	}
+	_ = other.Close()
+
+	if _, err := w.Write(content[half:]); err != nil {
+		t.Fatalf("unable to write: %v", err)
+	}
+	if err := w.Commit(ctx, desc.Size, desc.Digest); err != nil {
+		t.Fatalf("unable to commit: %v", err)
+	}
+	if actual := fetchString(t, d, "docker.io/lfedge/eci:1.0", desc.Digest); actual != string(content) {
+		t.Errorf("mismatched blob, actual %s expected %s", actual, content)
+	}
+	if entries, err := os.ReadDir(filepath.Join(tmpdir, "ingest")); err != nil || len(entries) != 0 {
+		t.Errorf("ingest directory not empty: %v %v", entries, err)
+	}
+}
@@ -0,0 +1,333 @@
+package resolver
+
+/*
+ Provides a github.com/containerd/containerd/remotes#Resolver that resolves
+ to a single tar archive in the layout of docker save, so that images can be moved
+ to hosts that only have docker load.
+
+ Pushing writes each blob as in an OCI image layout, as docker save does since docker 25,
+ and on Finalize adds the manifest.json and repositories that docker load reads, as well as the
+ index.json. Only images that docker can load can be written: a single manifest, with an image
+ config and tar layers, as in the legacy and docker formats.
+
+ Pulling reads the manifest.json, as written by any version of docker save. As the archive
+ has no registry manifests, a docker manifest is made for each image from its config and layers.
+ The labels in the config, as for any docker image, give the role of each file in the layers.
+*/
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/remotes"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	dockerManifestFilename     = "manifest.json"
+	dockerRepositoriesFilename = "repositories"
+)
+
+// dockerArchiveManifest an image in the manifest.json of a docker save archive
+type dockerArchiveManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// DockerArchive resolver to push to/pull from a tar archive as written by docker save and read by docker load
+type DockerArchive struct {
+	archive *tarArchive
+	ctx     context.Context
+
+	// reading, set once by load
+	loaded    sync.Once
+	loadErr   error
+	images    []ocispec.Descriptor
+	blobs     map[digest.Digest]string
+	manifests map[digest.Digest][]byte
+
+	// writing, guarded by the archive lock
+	index    *ocispec.Index
+	contents map[digest.Digest][]byte
+}
+
+// NewDockerArchive create a resolver for the docker save archive in file. Nothing is opened until it is
+// first used, for pushing, which creates or replaces the archive, or for pulling, which requires it to exist.
+func NewDockerArchive(ctx context.Context, file string) (context.Context, *DockerArchive, error) {
+	if file == "" {
+		return ctx, nil, fmt.Errorf("must have an archive file")
+	}
+	return ctx, &DockerArchive{archive: &tarArchive{path: file}, ctx: ctx}, nil
+}
+
+func (a *DockerArchive) Resolve(ctx context.Context, ref string) (name string, desc ocispec.Descriptor, err error) {
+	if err := a.load(); err != nil {
+		return "", ocispec.Descriptor{}, err
+	}
+	found, err := findImage(a.images, ref, func(desc ocispec.Descriptor) (*ocispec.Index, error) {
+		return nil, fmt.Errorf("unexpected index %s in docker archive %s", desc.Digest, a.archive.path)
+	})
+	if err != nil {
+		return "", ocispec.Descriptor{}, err
+	}
+	if found == nil {
+		return "", ocispec.Descriptor{}, fmt.Errorf("%s not found in %s: %w", ref, a.archive.path, errdefs.ErrNotFound)
+	}
+	return ref, *found, nil
+}
+
+func (a *DockerArchive) Fetcher(ctx context.Context, ref string) (remotes.Fetcher, error) {
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	return dockerArchiveFetcher{a}, nil
+}
+
+func (a *DockerArchive) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	created, err := a.archive.openWriter()
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		a.archive.mu.Lock()
+		defer a.archive.mu.Unlock()
+		a.index = emptyIndex()
+		a.contents = map[digest.Digest][]byte{}
+		if err := a.archive.writeJSON(ocispec.ImageLayoutFile, ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion}); err != nil {
+			return nil, fmt.Errorf("could not add %s to archive: %v", ocispec.ImageLayoutFile, err)
+		}
+	}
+	return dockerArchivePusher{archive: a, ref: ref}, nil
+}
+
+// Finalize when pushing, add the manifest.json, repositories and index.json, close the archive and move it
+// into place; when pulling, close it.
+func (a *DockerArchive) Finalize(ctx context.Context) error {
+	return a.archive.close(a.writeManifests)
+}
+
+func (a *DockerArchive) Context() context.Context {
+	return a.ctx
+}
+
+// load open the archive for reading, and make the manifest of each image in it, once
+func (a *DockerArchive) load() error {
+	if err := a.archive.openReader(); err != nil {
+		return err
+	}
+	a.loaded.Do(func() {
+		a.loadErr = a.readManifests()
+	})
+	return a.loadErr
+}
+
+// readManifests make a docker manifest for each image in the manifest.json, named by each of its tags
+func (a *DockerArchive) readManifests() error {
+	var entries []dockerArchiveManifest
+	if err := a.archive.readJSON(dockerManifestFilename, &entries); err != nil {
+		return err
+	}
+	a.blobs = map[digest.Digest]string{}
+	a.manifests = map[digest.Digest][]byte{}
+	for _, entry := range entries {
+		config, err := a.blobDescriptor(entry.Config, images.MediaTypeDockerSchema2Config)
+		if err != nil {
+			return err
+		}
+		manifest := ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: images.MediaTypeDockerSchema2Manifest,
+			Config:    config,
+			Layers:    []ocispec.Descriptor{},
+		}
+		for _, layer := range entry.Layers {
+			desc, err := a.blobDescriptor(layer, "")
+			if err != nil {
+				return err
+			}
+			manifest.Layers = append(manifest.Layers, desc)
+		}
+		b, err := json.Marshal(manifest)
+		if err != nil {
+			return fmt.Errorf("could not convert manifest to json: %v", err)
+		}
+		desc := ocispec.Descriptor{
+			MediaType: manifest.MediaType,
+			Digest:    digest.FromBytes(b),
+			Size:      int64(len(b)),
+		}
+		a.manifests[desc.Digest] = b
+		if len(entry.RepoTags) == 0 {
+			a.images = append(a.images, desc)
+		}
+		for _, tag := range entry.RepoTags {
+			named, err := reference.ParseNormalizedNamed(tag)
+			if err != nil {
+				return fmt.Errorf("invalid tag %s in archive %s: %v", tag, a.archive.path, err)
+			}
+			tagged := desc
+			tagged.Annotations = map[string]string{ocispec.AnnotationRefName: reference.TagNameOnly(named).String()}
+			a.images = append(a.images, tagged)
+		}
+	}
+	return nil
+}
+
+// blobDescriptor the descriptor of the file name in the archive. Files in an OCI image layout are named by
+// their digest; anything else, as written by older versions of docker save, is hashed. Layers are compressed
+// or not, as found in the file.
+func (a *DockerArchive) blobDescriptor(name, mediaType string) (ocispec.Descriptor, error) {
+	name = cleanTarName(name)
+	r, err := a.archive.open(name)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	dir, encoded := path.Split(name)
+	dgst := digest.NewDigestFromEncoded(digest.Algorithm(path.Base(dir)), encoded)
+	if !strings.HasPrefix(name, "blobs/") || dgst.Validate() != nil {
+		if dgst, err = digest.FromReader(r); err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("could not read %s in archive %s: %v", name, a.archive.path, err)
+		}
+	}
+	if mediaType == "" {
+		magic := make([]byte, 2)
+		if _, err := r.ReadAt(magic, 0); err != nil && err != io.EOF {
+			return ocispec.Descriptor{}, fmt.Errorf("could not read %s in archive %s: %v", name, a.archive.path, err)
+		}
+		mediaType = images.MediaTypeDockerSchema2Layer
+		if magic[0] == 0x1f && magic[1] == 0x8b {
+			mediaType = images.MediaTypeDockerSchema2LayerGzip
+		}
+	}
+	a.blobs[dgst] = name
+	return ocispec.Descriptor{MediaType: mediaType, Digest: dgst, Size: r.Size()}, nil
+}
+
+// writeManifests add the manifest.json and repositories for each image in the index, and the index.json;
+// must hold the archive lock
+func (a *DockerArchive) writeManifests() error {
+	var (
+		entries      = []dockerArchiveManifest{}
+		repositories = map[string]map[string]string{}
+		byDigest     = map[digest.Digest]int{}
+	)
+	for _, desc := range a.index.Manifests {
+		name := desc.Annotations[ocispec.AnnotationRefName]
+		if !isManifest(desc.MediaType) {
+			return fmt.Errorf("%s is not a single manifest, docker archives can only hold one platform of an image", name)
+		}
+		i, ok := byDigest[desc.Digest]
+		if !ok {
+			entry, err := a.dockerManifest(desc)
+			if err != nil {
+				return fmt.Errorf("%s cannot be loaded by docker: %v", name, err)
+			}
+			i = len(entries)
+			byDigest[desc.Digest] = i
+			entries = append(entries, entry)
+		}
+		named, err := reference.ParseNormalizedNamed(name)
+		if err != nil {
+			continue
+		}
+		tagged, ok := named.(reference.NamedTagged)
+		if !ok {
+			continue
+		}
+		entries[i].RepoTags = append(entries[i].RepoTags, reference.FamiliarString(tagged))
+		repository := reference.FamiliarName(tagged)
+		if repositories[repository] == nil {
+			repositories[repository] = map[string]string{}
+		}
+		if layers := entries[i].Layers; len(layers) > 0 {
+			repositories[repository][tagged.Tag()] = path.Base(layers[len(layers)-1])
+		}
+	}
+	if err := a.archive.writeJSON(dockerManifestFilename, entries); err != nil {
+		return err
+	}
+	if err := a.archive.writeJSON(dockerRepositoriesFilename, repositories); err != nil {
+		return err
+	}
+	return a.archive.writeJSON(indexFilename, a.index)
+}
+
+// dockerManifest the entry in manifest.json for the manifest with the descriptor desc, which must have an
+// image config and tar layers
+func (a *DockerArchive) dockerManifest(desc ocispec.Descriptor) (dockerArchiveManifest, error) {
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(a.contents[desc.Digest], &manifest); err != nil {
+		return dockerArchiveManifest{}, fmt.Errorf("could not read manifest %s: %v", desc.Digest, err)
+	}
+	switch manifest.Config.MediaType {
+	case ocispec.MediaTypeImageConfig, images.MediaTypeDockerSchema2Config:
+	default:
+		return dockerArchiveManifest{}, fmt.Errorf("config has media type %s, only the legacy and docker formats are supported", manifest.Config.MediaType)
+	}
+	entry := dockerArchiveManifest{
+		Config:   blobName(manifest.Config.Digest),
+		RepoTags: []string{},
+		Layers:   []string{},
+	}
+	for _, layer := range manifest.Layers {
+		if !strings.Contains(layer.MediaType, ".tar") {
+			return dockerArchiveManifest{}, fmt.Errorf("layer has media type %s, only the legacy and docker formats are supported", layer.MediaType)
+		}
+		entry.Layers = append(entry.Layers, blobName(layer.Digest))
+	}
+	return entry, nil
+}
+
+type dockerArchiveFetcher struct {
+	archive *DockerArchive
+}
+
+func (f dockerArchiveFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	a := f.archive
+	if b, ok := a.manifests[desc.Digest]; ok {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+	if name, ok := a.blobs[desc.Digest]; ok {
+		r, err := a.archive.open(name)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(r), nil
+	}
+	return a.archive.fetch(desc)
+}
+
+type dockerArchivePusher struct {
+	archive *DockerArchive
+	ref     string
+}
+
+// Push start writing the blob, which is added to the archive when committed. Any number of blobs may be
+// written at once.
+func (p dockerArchivePusher) Push(ctx context.Context, desc ocispec.Descriptor) (content.Writer, error) {
+	a := p.archive
+	add := func() {
+		if isRoot(p.ref, desc) {
+			addImage(a.index, desc, p.ref)
+		}
+	}
+	return a.archive.push(p.ref, desc, add, func(b []byte) {
+		if b != nil {
+			a.contents[desc.Digest] = b
+		}
+		add()
+	})
+}
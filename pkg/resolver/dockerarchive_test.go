@@ -0,0 +1,289 @@
+package resolver_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/images"
+	"github.com/lf-edge/edge-containers/pkg/registry"
+	ecresolver "github.com/lf-edge/edge-containers/pkg/resolver"
+
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// readManifest resolve ref in the resolver, and fetch its manifest
+func readManifest(t *testing.T, r ecresolver.ResolverCloser, ref string) ocispec.Manifest {
+	t.Helper()
+	_, desc, err := r.Resolve(context.TODO(), ref)
+	if err != nil {
+		t.Fatalf("unable to resolve %s: %v", ref, err)
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal([]byte(fetchString(t, r, ref, desc.Digest)), &manifest); err != nil {
+		t.Fatalf("unable to read manifest for %s: %v", ref, err)
+	}
+	return manifest
+}
+
+func TestDockerArchive(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "edge-containers-archive")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+	archive := filepath.Join(tmpdir, "images.tar")
+
+	_, w, err := ecresolver.NewDockerArchive(context.TODO(), archive)
+	if err != nil {
+		t.Fatalf("unable to create archive resolver: %v", err)
+	}
+	pushImage(t, w, "docker.io/lfedge/eci:current", "current")
+	pushImage(t, w, "docker.io/library/alpine:3.11", "alpine")
+	if err := w.Finalize(context.TODO()); err != nil {
+		t.Fatalf("unable to finalize archive: %v", err)
+	}
+
+	// what docker load reads
+	f, err := os.Open(archive)
+	if err != nil {
+		t.Fatalf("unable to open archive: %v", err)
+	}
+	defer func() { _ = f.Close() }()
+	var entries []struct {
+		Config   string
+		RepoTags []string
+		Layers   []string
+	}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("manifest.json not found in archive: %v", err)
+		}
+		if hdr.Name != "manifest.json" {
+			continue
+		}
+		if err := json.NewDecoder(tr).Decode(&entries); err != nil {
+			t.Fatalf("unable to read manifest.json: %v", err)
+		}
+		break
+	}
+	tags := map[string]string{}
+	for _, entry := range entries {
+		if len(entry.RepoTags) != 1 || len(entry.Layers) != 1 {
+			t.Fatalf("mismatched manifest.json entry %v", entry)
+		}
+		tags[entry.RepoTags[0]] = entry.Layers[0]
+	}
+	expected := map[string]string{
+		"lfedge/eci:current": "blobs/sha256/" + digest.FromString("current").Encoded(),
+		"alpine:3.11":        "blobs/sha256/" + digest.FromString("alpine").Encoded(),
+	}
+	for tag, layer := range expected {
+		if tags[tag] != layer {
+			t.Errorf("%s: mismatched layer, actual %q expected %q", tag, tags[tag], layer)
+		}
+	}
+
+	// and pulled back
+	_, r, err := ecresolver.NewDockerArchive(context.TODO(), archive)
+	if err != nil {
+		t.Fatalf("unable to create archive resolver: %v", err)
+	}
+	defer func() { _ = r.Finalize(context.TODO()) }()
+	for ref, layer := range map[string]string{"docker.io/lfedge/eci:current": "current", "docker.io/library/alpine:3.11": "alpine"} {
+		manifest := readManifest(t, r, ref)
+		if manifest.Config.MediaType != images.MediaTypeDockerSchema2Config || fetchString(t, r, ref, manifest.Config.Digest) != "{}" {
+			t.Errorf("%s: mismatched config %v", ref, manifest.Config)
+		}
+		if len(manifest.Layers) != 1 || manifest.Layers[0].Digest != digest.FromString(layer) {
+			t.Fatalf("%s: mismatched layers %v", ref, manifest.Layers)
+		}
+		if actual := fetchString(t, r, ref, manifest.Layers[0].Digest); actual != layer {
+			t.Errorf("%s: mismatched layer, actual %q expected %q", ref, actual, layer)
+		}
+	}
+
+	// an ECI in the legacy format, whose diff_ids docker load checks against the uncompressed layers
+	kernel := filepath.Join(tmpdir, "kernel")
+	if err := os.WriteFile(kernel, []byte("kernel"), 0644); err != nil {
+		t.Fatalf("unable to write kernel: %v", err)
+	}
+	legacy := filepath.Join(tmpdir, "legacy.tar")
+	_, lw, err := ecresolver.NewDockerArchive(context.TODO(), legacy)
+	if err != nil {
+		t.Fatalf("unable to create archive resolver: %v", err)
+	}
+	pusher := registry.Pusher{Image: "docker.io/lfedge/eci:legacy", Artifact: &registry.Artifact{Kernel: &registry.FileSource{Path: kernel}}}
+	if _, err := pusher.Push(registry.FormatLegacy, false, nil, registry.ConfigOpts{}, lw); err != nil {
+		t.Fatalf("unable to push legacy image: %v", err)
+	}
+	files := map[string][]byte{}
+	lf, err := os.Open(legacy)
+	if err != nil {
+		t.Fatalf("unable to open archive: %v", err)
+	}
+	defer func() { _ = lf.Close() }()
+	tr = tar.NewReader(lf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unable to read archive: %v", err)
+		}
+		if files[hdr.Name], err = io.ReadAll(tr); err != nil {
+			t.Fatalf("unable to read %s: %v", hdr.Name, err)
+		}
+	}
+	entries = nil
+	if err := json.Unmarshal(files["manifest.json"], &entries); err != nil || len(entries) != 1 {
+		t.Fatalf("mismatched manifest.json %s: %v", files["manifest.json"], err)
+	}
+	var config ocispec.Image
+	if err := json.Unmarshal(files[entries[0].Config], &config); err != nil {
+		t.Fatalf("unable to read config %s: %v", entries[0].Config, err)
+	}
+	if len(config.RootFS.DiffIDs) != len(entries[0].Layers) || len(entries[0].Layers) == 0 {
+		t.Fatalf("mismatched diff_ids %v for layers %v", config.RootFS.DiffIDs, entries[0].Layers)
+	}
+	for i, layer := range entries[0].Layers {
+		zr, err := gzip.NewReader(bytes.NewReader(files[layer]))
+		if err != nil {
+			t.Fatalf("unable to decompress layer %s: %v", layer, err)
+		}
+		diffID, err := digest.FromReader(zr)
+		if err != nil {
+			t.Fatalf("unable to decompress layer %s: %v", layer, err)
+		}
+		if config.RootFS.DiffIDs[i] != diffID {
+			t.Errorf("layer %s: mismatched diff_id, actual %s expected %s", layer, config.RootFS.DiffIDs[i], diffID)
+		}
+	}
+}
+
+func TestDockerArchiveUnsupported(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "edge-containers-archive")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+	archive := filepath.Join(tmpdir, "images.tar")
+
+	_, w, err := ecresolver.NewDockerArchive(context.TODO(), archive)
+	if err != nil {
+		t.Fatalf("unable to create archive resolver: %v", err)
+	}
+	ref := "docker.io/lfedge/eci:artifact"
+	config := pushBlob(t, w, ref, "application/vnd.lfedge.eci.config.v1+json", []byte("{}"))
+	kernel := pushBlob(t, w, ref, "application/vnd.lfedge.eci.kernel.layer.v1+kernel", []byte("kernel"))
+	b, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{kernel},
+	})
+	if err != nil {
+		t.Fatalf("unable to marshal manifest: %v", err)
+	}
+	pushBlob(t, w, ref, ocispec.MediaTypeImageManifest, b)
+	if err := w.Finalize(context.TODO()); err == nil {
+		t.Errorf("finalize of an artifact that docker cannot load did not fail")
+	}
+	if _, err := os.Stat(archive); err == nil {
+		t.Errorf("archive exists after failed finalize")
+	}
+}
+
+func TestDockerArchiveFromSave(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "edge-containers-archive")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+
+	// as written by docker save before docker 25, with an uncompressed and a compressed layer
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	if _, err := zw.Write([]byte("compressed")); err != nil {
+		t.Fatalf("unable to compress layer: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("unable to compress layer: %v", err)
+	}
+	config := []byte(`{"config":{"Labels":{"org.lfedge.eci.artifact.kernel":"/kernel"}}}`)
+	files := []struct {
+		name    string
+		content []byte
+	}{
+		{"manifest.json", []byte(`[{"Config":"abc.json","RepoTags":["lfedge/eci:1.0"],"Layers":["111/layer.tar","222/layer.tar"]}]`)},
+		{"repositories", []byte(`{"lfedge/eci":{"1.0":"222"}}`)},
+		{"abc.json", config},
+		{"111/layer.tar", []byte("uncompressed")},
+		{"222/layer.tar", gz.Bytes()},
+	}
+	archive := filepath.Join(tmpdir, "save.tar")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatalf("unable to create archive: %v", err)
+	}
+	tw := tar.NewWriter(f)
+	for _, file := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.content))}); err != nil {
+			t.Fatalf("unable to write archive: %v", err)
+		}
+		if _, err := tw.Write(file.content); err != nil {
+			t.Fatalf("unable to write archive: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("unable to close archive: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("unable to close archive: %v", err)
+	}
+
+	_, r, err := ecresolver.NewDockerArchive(context.TODO(), archive)
+	if err != nil {
+		t.Fatalf("unable to create archive resolver: %v", err)
+	}
+	defer func() { _ = r.Finalize(context.TODO()) }()
+	ref := "docker.io/lfedge/eci:1.0"
+	manifest := readManifest(t, r, ref)
+	if manifest.Config.Digest != digest.FromBytes(config) || fetchString(t, r, ref, manifest.Config.Digest) != string(config) {
+		t.Errorf("mismatched config %v", manifest.Config)
+	}
+	expected := []ocispec.Descriptor{
+		{MediaType: images.MediaTypeDockerSchema2Layer, Digest: digest.FromString("uncompressed"), Size: int64(len("uncompressed"))},
+		{MediaType: images.MediaTypeDockerSchema2LayerGzip, Digest: digest.FromBytes(gz.Bytes()), Size: int64(gz.Len())},
+	}
+	if len(manifest.Layers) != len(expected) {
+		t.Fatalf("mismatched layers, actual %v expected %v", manifest.Layers, expected)
+	}
+	for i, layer := range manifest.Layers {
+		if layer.MediaType != expected[i].MediaType || layer.Digest != expected[i].Digest || layer.Size != expected[i].Size {
+			t.Errorf("layer %d: mismatched descriptor, actual %v expected %v", i, layer, expected[i])
+		}
+	}
+	if actual := fetchString(t, r, ref, digest.FromString("uncompressed")); actual != "uncompressed" {
+		t.Errorf("mismatched layer, actual %q expected %q", actual, "uncompressed")
+	}
+	// by the digest of the manifest made for it
+	_, desc, err := r.Resolve(context.TODO(), ref)
+	if err != nil {
+		t.Fatalf("unable to resolve: %v", err)
+	}
+	if _, byDigest, err := r.Resolve(context.TODO(), "docker.io/lfedge/eci@"+desc.Digest.String()); err != nil || byDigest.Digest != desc.Digest {
+		t.Errorf("unable to resolve by digest %s: %v", desc.Digest, err)
+	}
+}
@@ -0,0 +1,227 @@
+package resolver
+
+/*
+ Integrity checking of the OCI image layout used by Directory.
+
+ Every blob is re-hashed and compared to the digest that is its filename. Every descriptor reachable from
+ the root index.json must have a blob with the right size, and, for manifests and indexes, the right media type.
+ The children of a manifest or index that is corrupt, or has the wrong media type, still are checked, as far as it
+ can be read. Blobs that are not reachable are reported as orphaned; they are harmless, and removed by GC. If some
+ manifest or index could not be read at all, they might be its children, so are reported as unchecked instead.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// FsckKind the kind of problem found by Fsck
+type FsckKind string
+
+const (
+	// FsckMissing a blob that is referenced does not exist
+	FsckMissing FsckKind = "missing"
+	// FsckCorrupt the content of a blob does not match its digest
+	FsckCorrupt FsckKind = "corrupt"
+	// FsckSize a blob does not have the size in the descriptor that references it
+	FsckSize FsckKind = "size"
+	// FsckMediaType a manifest or index does not have the media type in the descriptor that references it
+	FsckMediaType FsckKind = "media-type"
+	// FsckOrphaned a blob is not referenced
+	FsckOrphaned FsckKind = "orphaned"
+	// FsckUnchecked a blob is not referenced by any manifest or index that could be read, but might be by one
+	// that could not, so is neither known to be orphaned nor checked against a descriptor
+	FsckUnchecked FsckKind = "unchecked"
+)
+
+// FsckOptions options for checking a Directory
+type FsckOptions struct {
+	// Repair remove corrupt blobs, so that they are fetched again on the next pull
+	Repair bool
+}
+
+// FsckProblem a single problem found by Fsck
+type FsckProblem struct {
+	Kind       FsckKind
+	Descriptor ocispec.Descriptor
+	Message    string
+}
+
+func (p FsckProblem) String() string {
+	return fmt.Sprintf("%s blob %s: %s", p.Kind, p.Descriptor.Digest, p.Message)
+}
+
+// FsckResult the result of checking a Directory
+type FsckResult struct {
+	// Blobs the number of blobs checked
+	Blobs int
+	// Problems every problem found
+	Problems []FsckProblem
+	// Repaired the corrupt blobs that were removed
+	Repaired []digest.Digest
+}
+
+// Fsck check the integrity of every blob in the directory, and of every descriptor reachable from its index,
+// reporting missing, corrupt and orphaned blobs. With Repair, corrupt blobs are removed.
+func (d *Directory) Fsck(opts FsckOptions) (result *FsckResult, err error) {
+	// shared, unless repairing, so that nothing is removed while checking
+	unlock, err := lockLayout(d.dir, opts.Repair)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if unlockErr := unlock(); err == nil {
+			err = unlockErr
+		}
+	}()
+	index, err := readIndex(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	result = &FsckResult{}
+
+	// re-hash every blob
+	var (
+		blobs   = map[digest.Digest]int64{}
+		corrupt = map[digest.Digest]bool{}
+	)
+	blobsDir := path.Join(d.dir, "blobs")
+	algorithms, err := os.ReadDir(blobsDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("could not read blobs directory %s: %v", blobsDir, err)
+	}
+	for _, algorithm := range algorithms {
+		if !algorithm.IsDir() {
+			continue
+		}
+		algorithmDir := path.Join(blobsDir, algorithm.Name())
+		entries, err := os.ReadDir(algorithmDir)
+		if err != nil {
+			return nil, fmt.Errorf("could not read blobs directory %s: %v", algorithmDir, err)
+		}
+		for _, entry := range entries {
+			dgst := digest.NewDigestFromEncoded(digest.Algorithm(algorithm.Name()), entry.Name())
+			if entry.IsDir() || dgst.Validate() != nil {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return nil, fmt.Errorf("could not get info for blob %s: %v", dgst, err)
+			}
+			result.Blobs++
+			blobs[dgst] = info.Size()
+			filename := path.Join(algorithmDir, entry.Name())
+			if err := verifyBlob(filename, ocispec.Descriptor{Digest: dgst}); err != nil {
+				corrupt[dgst] = true
+				result.Problems = append(result.Problems, FsckProblem{
+					Kind:       FsckCorrupt,
+					Descriptor: ocispec.Descriptor{Digest: dgst, Size: info.Size()},
+					Message:    err.Error(),
+				})
+			}
+		}
+	}
+
+	// check everything that is referenced
+	var (
+		reachable = map[digest.Digest]bool{}
+		descs     = index.Manifests
+		// unreadable whether some manifest or index could not be read, so its children are not known
+		unreadable bool
+	)
+	for len(descs) > 0 {
+		desc := descs[0]
+		descs = descs[1:]
+		if reachable[desc.Digest] {
+			continue
+		}
+		reachable[desc.Digest] = true
+		size, ok := blobs[desc.Digest]
+		switch {
+		case !ok:
+			result.Problems = append(result.Problems, FsckProblem{Kind: FsckMissing, Descriptor: desc, Message: "referenced but not found"})
+			continue
+		case corrupt[desc.Digest]:
+			// reported already; its children still are checked, if it can be read
+		case size != desc.Size:
+			result.Problems = append(result.Problems, FsckProblem{
+				Kind:       FsckSize,
+				Descriptor: desc,
+				Message:    fmt.Sprintf("has size %d, expected %d", size, desc.Size),
+			})
+		}
+		if !isIndex(desc.MediaType) && !isManifest(desc.MediaType) {
+			continue
+		}
+		mediaType, err := blobMediaType(d.dir, desc)
+		switch {
+		case err != nil && corrupt[desc.Digest]:
+		case err != nil:
+			result.Problems = append(result.Problems, FsckProblem{Kind: FsckMediaType, Descriptor: desc, Message: err.Error()})
+		case mediaType != "" && mediaType != desc.MediaType:
+			result.Problems = append(result.Problems, FsckProblem{
+				Kind:       FsckMediaType,
+				Descriptor: desc,
+				Message:    fmt.Sprintf("has media type %s, expected %s", mediaType, desc.MediaType),
+			})
+		}
+		refs, err := children(d.dir, desc)
+		if err != nil {
+			unreadable = true
+			continue
+		}
+		descs = append(descs, refs...)
+	}
+
+	// report anything not referenced
+	var orphans []digest.Digest
+	for dgst := range blobs {
+		if !reachable[dgst] && !corrupt[dgst] {
+			orphans = append(orphans, dgst)
+		}
+	}
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i] < orphans[j] })
+	for _, dgst := range orphans {
+		problem := FsckProblem{Kind: FsckOrphaned, Descriptor: ocispec.Descriptor{Digest: dgst, Size: blobs[dgst]}, Message: "not referenced"}
+		if unreadable {
+			problem.Kind, problem.Message = FsckUnchecked, "not referenced, unless by a manifest or index that could not be read"
+		}
+		result.Problems = append(result.Problems, problem)
+	}
+
+	if opts.Repair {
+		for _, problem := range result.Problems {
+			if problem.Kind != FsckCorrupt {
+				continue
+			}
+			dgst := problem.Descriptor.Digest
+			if err := os.Remove(blobPath(d.dir, dgst)); err != nil {
+				return nil, fmt.Errorf("could not remove corrupt blob %s: %v", dgst, err)
+			}
+			result.Repaired = append(result.Repaired, dgst)
+		}
+	}
+	return result, nil
+}
+
+// blobMediaType the media type in the manifest or index with the descriptor desc, blank if it has none
+func blobMediaType(dir string, desc ocispec.Descriptor) (string, error) {
+	contents, err := os.ReadFile(blobPath(dir, desc.Digest))
+	if err != nil {
+		return "", err
+	}
+	var versioned struct {
+		MediaType string `json:"mediaType"`
+	}
+	if err := json.Unmarshal(contents, &versioned); err != nil {
+		return "", fmt.Errorf("could not convert from json: %v", err)
+	}
+	return versioned.MediaType, nil
+}
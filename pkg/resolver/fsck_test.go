@@ -0,0 +1,165 @@
+package resolver_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ecresolver "github.com/lf-edge/edge-containers/pkg/resolver"
+
+	"github.com/containerd/containerd/images"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestDirectoryFsck(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "edge-containers-directory")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+	_, d, err := ecresolver.NewDirectory(context.TODO(), tmpdir)
+	if err != nil {
+		t.Fatalf("unable to create directory resolver: %v", err)
+	}
+	blob := func(dgst digest.Digest) string {
+		return filepath.Join(tmpdir, "blobs", dgst.Algorithm().String(), dgst.Encoded())
+	}
+
+	pushImage(t, d, "docker.io/lfedge/eci:1", "layer-1")
+	pushImage(t, d, "docker.io/lfedge/eci:2", "layer-2")
+	orphan := pushBlob(t, d, "docker.io/lfedge/eci:3", ocispec.MediaTypeImageLayer, []byte("orphan"))
+
+	// a clean directory only has the orphan
+	result, err := d.Fsck(ecresolver.FsckOptions{})
+	if err != nil {
+		t.Fatalf("unable to fsck: %v", err)
+	}
+	if len(result.Problems) != 1 || result.Problems[0].Kind != ecresolver.FsckOrphaned || result.Problems[0].Descriptor.Digest != orphan.Digest {
+		t.Errorf("clean: mismatched problems, actual %v expected orphaned %s", result.Problems, orphan.Digest)
+	}
+	// config, 3 layers and 2 manifests
+	if result.Blobs != 6 {
+		t.Errorf("clean: checked %d blobs, expected %d", result.Blobs, 6)
+	}
+
+	// corrupt one layer, as flash might, and lose another
+	corrupt, missing := digest.FromString("layer-1"), digest.FromString("layer-2")
+	if err := os.WriteFile(blob(corrupt), []byte("layer-X"), 0644); err != nil {
+		t.Fatalf("unable to corrupt blob: %v", err)
+	}
+	if err := os.Remove(blob(missing)); err != nil {
+		t.Fatalf("unable to remove blob: %v", err)
+	}
+
+	for _, repair := range []bool{false, true} {
+		result, err := d.Fsck(ecresolver.FsckOptions{Repair: repair})
+		if err != nil {
+			t.Fatalf("repair %v: unable to fsck: %v", repair, err)
+		}
+		kinds := map[ecresolver.FsckKind]digest.Digest{}
+		for _, p := range result.Problems {
+			kinds[p.Kind] = p.Descriptor.Digest
+		}
+		expected := map[ecresolver.FsckKind]digest.Digest{
+			ecresolver.FsckCorrupt:  corrupt,
+			ecresolver.FsckMissing:  missing,
+			ecresolver.FsckOrphaned: orphan.Digest,
+		}
+		if len(result.Problems) != len(expected) {
+			t.Errorf("repair %v: mismatched problems, actual %v expected %v", repair, result.Problems, expected)
+		}
+		for k, v := range expected {
+			if kinds[k] != v {
+				t.Errorf("repair %v: mismatched %s blob, actual %s expected %s", repair, k, kinds[k], v)
+			}
+		}
+		_, statErr := os.Stat(blob(corrupt))
+		switch {
+		case repair && (len(result.Repaired) != 1 || result.Repaired[0] != corrupt):
+			t.Errorf("repair: mismatched repaired, actual %v expected %s", result.Repaired, corrupt)
+		case repair && statErr == nil:
+			t.Errorf("repair: corrupt blob %s not removed", corrupt)
+		case !repair && (len(result.Repaired) != 0 || statErr != nil):
+			t.Errorf("no repair: corrupt blob %s removed", corrupt)
+		}
+	}
+
+	// once repaired, the blob is written again
+	pushImage(t, d, "docker.io/lfedge/eci:1", "layer-1")
+	result, err = d.Fsck(ecresolver.FsckOptions{})
+	if err != nil {
+		t.Fatalf("unable to fsck: %v", err)
+	}
+	for _, p := range result.Problems {
+		if p.Descriptor.Digest == corrupt {
+			t.Errorf("after push: unexpected problem %v", p)
+		}
+	}
+}
+
+func TestDirectoryFsckManifest(t *testing.T) {
+	tests := []struct {
+		name string
+		// manifest the contents to replace the manifest with, after it is pushed, nil to leave it
+		manifest func(b []byte) []byte
+		// mediaType the media type in the manifest
+		mediaType string
+		expected  []ecresolver.FsckKind
+	}{
+		// the children of a manifest with the wrong media type are checked
+		{"media type", nil, images.MediaTypeDockerSchema2Manifest, []ecresolver.FsckKind{ecresolver.FsckMediaType}},
+		// the children of a corrupt manifest that can be read are checked
+		{"corrupt", func(b []byte) []byte { return append(b, '\n') }, ocispec.MediaTypeImageManifest, []ecresolver.FsckKind{ecresolver.FsckCorrupt}},
+		// the children of a manifest that cannot be read are not known
+		{"unreadable", func(b []byte) []byte { return []byte("garbage") }, ocispec.MediaTypeImageManifest, []ecresolver.FsckKind{ecresolver.FsckCorrupt, ecresolver.FsckUnchecked, ecresolver.FsckUnchecked}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpdir, err := os.MkdirTemp("", "edge-containers-directory")
+			if err != nil {
+				t.Fatalf("unable to create temporary directory: %v", err)
+			}
+			defer func() { _ = os.RemoveAll(tmpdir) }()
+			_, d, err := ecresolver.NewDirectory(context.TODO(), tmpdir)
+			if err != nil {
+				t.Fatalf("unable to create directory resolver: %v", err)
+			}
+
+			ref := "docker.io/lfedge/eci:1"
+			manifest := ocispec.Manifest{
+				Versioned: specs.Versioned{SchemaVersion: 2},
+				MediaType: tt.mediaType,
+				Config:    pushBlob(t, d, ref, ocispec.MediaTypeImageConfig, []byte("{}")),
+				Layers:    []ocispec.Descriptor{pushBlob(t, d, ref, ocispec.MediaTypeImageLayer, []byte("layer"))},
+			}
+			b, err := json.Marshal(manifest)
+			if err != nil {
+				t.Fatalf("unable to marshal manifest: %v", err)
+			}
+			desc := pushBlob(t, d, fmt.Sprintf("%s@%s", ref, digest.FromBytes(b)), ocispec.MediaTypeImageManifest, b)
+			if tt.manifest != nil {
+				p := filepath.Join(tmpdir, "blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded())
+				if err := os.WriteFile(p, tt.manifest(b), 0644); err != nil {
+					t.Fatalf("unable to replace manifest: %v", err)
+				}
+			}
+
+			result, err := d.Fsck(ecresolver.FsckOptions{})
+			if err != nil {
+				t.Fatalf("unable to fsck: %v", err)
+			}
+			var kinds []ecresolver.FsckKind
+			for _, p := range result.Problems {
+				kinds = append(kinds, p.Kind)
+			}
+			if fmt.Sprint(kinds) != fmt.Sprint(tt.expected) {
+				t.Errorf("mismatched problems, actual %v expected %v", result.Problems, tt.expected)
+			}
+		})
+	}
+}
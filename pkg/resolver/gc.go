@@ -0,0 +1,231 @@
+package resolver
+
+/*
+ Garbage collection of the OCI image layout used by Directory.
+
+ Everything reachable from the root index.json, i.e. the images in it, and the manifests, indexes, configs
+ and layers they reference, is kept. Every other blob is removed, as are temporary files left in the ingest
+ directory by writes that never completed.
+
+ Pushes do not hold the layout lock while they write blobs, only while they change the index, so a blob
+ of a push in progress is not yet reachable. It is kept for the grace period after it last changed: a blob
+ that a push finds already in place is touched, under the layout lock, and one being written changes as it
+ is written. A write that can continue later is locked by its writer, and is kept for as long as it is.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// DefaultGCGracePeriod how long content is kept after it last changed, unless set
+const DefaultGCGracePeriod = time.Hour
+
+// GCOptions options for the garbage collection of a Directory
+type GCOptions struct {
+	// KeepTags if greater than 0, keep only the last KeepTags images pushed to each repository, removing the older
+	// ones from the index before collecting. Images without a name are always kept.
+	KeepTags int
+	// GracePeriod keep blobs and temporary files changed more recently than this, as they may be part of
+	// a push that still is in progress, default DefaultGCGracePeriod; negative keeps nothing for its age
+	GracePeriod time.Duration
+	// DryRun report what would be removed, but remove nothing
+	DryRun bool
+}
+
+// GCResult what was, or, for a dry run, would be, removed by the garbage collection
+type GCResult struct {
+	// Images the names of the images removed from the index
+	Images []string
+	// Blobs the blobs removed
+	Blobs []ocispec.Descriptor
+	// Reclaimed the total bytes reclaimed, including temporary files
+	Reclaimed int64
+}
+
+// GC remove any blobs that are not reachable from the images in the directory, after applying the retention
+// in the options. The directory is locked for the duration, so nothing else can change the index.
+func (d *Directory) GC(opts GCOptions) (result *GCResult, err error) {
+	unlock, err := lockLayout(d.dir, true)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if unlockErr := unlock(); err == nil {
+			err = unlockErr
+		}
+	}()
+	index, err := readIndex(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	result = &GCResult{}
+
+	// apply the retention
+	if opts.KeepTags > 0 {
+		kept, removed := retain(index.Manifests, opts.KeepTags)
+		if len(removed) > 0 {
+			result.Images = removed
+			index.Manifests = kept
+			if !opts.DryRun {
+				if err := writeIndex(d.dir, index); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	reachable, err := reachableBlobs(d.dir, index.Manifests)
+	if err != nil {
+		return nil, err
+	}
+	if opts.GracePeriod == 0 {
+		opts.GracePeriod = DefaultGCGracePeriod
+	}
+	cutoff := time.Now().Add(-opts.GracePeriod)
+
+	// remove everything else
+	blobsDir := path.Join(d.dir, "blobs")
+	algorithms, err := os.ReadDir(blobsDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("could not read blobs directory %s: %v", blobsDir, err)
+	}
+	for _, algorithm := range algorithms {
+		if !algorithm.IsDir() {
+			continue
+		}
+		algorithmDir := path.Join(blobsDir, algorithm.Name())
+		entries, err := os.ReadDir(algorithmDir)
+		if err != nil {
+			return nil, fmt.Errorf("could not read blobs directory %s: %v", algorithmDir, err)
+		}
+		for _, entry := range entries {
+			dgst := digest.NewDigestFromEncoded(digest.Algorithm(algorithm.Name()), entry.Name())
+			// anything that is not a blob is not ours to remove
+			if entry.IsDir() || dgst.Validate() != nil || reachable[dgst] {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return nil, fmt.Errorf("could not get info for blob %s: %v", dgst, err)
+			}
+			if info.ModTime().After(cutoff) {
+				continue
+			}
+			if !opts.DryRun {
+				if err := os.Remove(path.Join(algorithmDir, entry.Name())); err != nil {
+					return nil, fmt.Errorf("could not remove blob %s: %v", dgst, err)
+				}
+			}
+			result.Blobs = append(result.Blobs, ocispec.Descriptor{Digest: dgst, Size: info.Size()})
+			result.Reclaimed += info.Size()
+		}
+	}
+
+	// and any temporary files left behind
+	ingestDir := path.Join(d.dir, ingestDirname)
+	entries, err := os.ReadDir(ingestDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("could not read ingest directory %s: %v", ingestDir, err)
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || entry.IsDir() || info.ModTime().After(cutoff) {
+			continue
+		}
+		// a write that can continue later, and its state, are kept while the writer has it, however long it takes
+		unlockIngest, ok := lockIngest(path.Join(ingestDir, strings.TrimSuffix(entry.Name(), PartialSuffix)))
+		if !ok {
+			continue
+		}
+		if !opts.DryRun {
+			err = os.Remove(path.Join(ingestDir, entry.Name()))
+		}
+		unlockIngest()
+		if err != nil {
+			return nil, fmt.Errorf("could not remove temporary file %s: %v", entry.Name(), err)
+		}
+		result.Reclaimed += info.Size()
+	}
+	return result, nil
+}
+
+// lockIngest lock the file in the ingest directory, as its writer does while it writes to it, so that no writer
+// starts on it while it is removed. Returns false if a writer has it. The returned function releases it.
+func lockIngest(filename string) (func(), bool) {
+	file, err := os.Open(filename)
+	if err != nil {
+		// nothing to lock, e.g. a temporary file already removed, or the state of a write that is gone
+		return func() {}, true
+	}
+	locked, err := tryFlock(file)
+	if err != nil || !locked {
+		_ = file.Close()
+		return nil, false
+	}
+	return func() {
+		_ = funlock(file)
+		_ = file.Close()
+	}, true
+}
+
+// retain split the images into those to keep, the last keep pushed to each repository, and the
+// names of those to remove. Images are in the order they were pushed, so the last are the newest.
+func retain(manifests []ocispec.Descriptor, keep int) ([]ocispec.Descriptor, []string) {
+	var (
+		counts  = map[string]int{}
+		keepers = make([]bool, len(manifests))
+		kept    []ocispec.Descriptor
+		removed []string
+	)
+	for i := len(manifests) - 1; i >= 0; i-- {
+		name := stripDigest(manifests[i].Annotations[ocispec.AnnotationRefName])
+		repo := name
+		if refspec, err := reference.Parse(name); err == nil {
+			repo = refspec.Locator
+		}
+		if name == "" || counts[repo] < keep {
+			keepers[i] = true
+		}
+		counts[repo]++
+	}
+	for i, m := range manifests {
+		if keepers[i] {
+			kept = append(kept, m)
+		} else {
+			removed = append(removed, stripDigest(m.Annotations[ocispec.AnnotationRefName]))
+		}
+	}
+	return kept, removed
+}
+
+// reachableBlobs the digests of all of the blobs reachable from the descriptors. A manifest or index that
+// is missing has no children to keep, but one that cannot be read is an error, rather than risk removing them.
+func reachableBlobs(dir string, descs []ocispec.Descriptor) (map[digest.Digest]bool, error) {
+	reachable := map[digest.Digest]bool{}
+	for len(descs) > 0 {
+		desc := descs[0]
+		descs = descs[1:]
+		if reachable[desc.Digest] {
+			continue
+		}
+		reachable[desc.Digest] = true
+		refs, err := children(dir, desc)
+		switch {
+		case err != nil && errors.Is(err, os.ErrNotExist):
+			continue
+		case err != nil:
+			return nil, err
+		}
+		descs = append(descs, refs...)
+	}
+	return reachable, nil
+}
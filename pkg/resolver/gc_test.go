@@ -0,0 +1,176 @@
+package resolver_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	ctrcontent "github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	ecresolver "github.com/lf-edge/edge-containers/pkg/resolver"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestDirectoryGC(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "edge-containers-directory")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+	_, d, err := ecresolver.NewDirectory(context.TODO(), tmpdir)
+	if err != nil {
+		t.Fatalf("unable to create directory resolver: %v", err)
+	}
+
+	first := pushImage(t, d, "docker.io/lfedge/eci:1", "layer-1")
+	pushImage(t, d, "docker.io/lfedge/eci:2", "layer-2")
+	pushImage(t, d, "docker.io/lfedge/eci:3", "layer-3")
+	pushImage(t, d, "docker.io/lfedge/other:1", "layer-other")
+	// a blob that nothing references, and a write that never completed
+	orphan := pushBlob(t, d, "docker.io/lfedge/eci:4", ocispec.MediaTypeImageLayer, []byte("orphan"))
+	if err := os.WriteFile(filepath.Join(tmpdir, "ingest", "partial"), []byte("partial"), 0644); err != nil {
+		t.Fatalf("unable to write temporary file: %v", err)
+	}
+	firstLayer := digest.FromString("layer-1")
+	expectedBlobs := []string{first.Digest.String(), firstLayer.String(), orphan.Digest.String()}
+	sort.Strings(expectedBlobs)
+	expectedReclaimed := first.Size + int64(len("layer-1")) + orphan.Size + int64(len("partial"))
+	exists := func(dgst digest.Digest) bool {
+		_, err := os.Stat(filepath.Join(tmpdir, "blobs", dgst.Algorithm().String(), dgst.Encoded()))
+		return err == nil
+	}
+
+	// content within the grace period, by default, is kept
+	result, err := d.GC(ecresolver.GCOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("unable to gc: %v", err)
+	}
+	if len(result.Blobs) != 0 || result.Reclaimed != 0 {
+		t.Errorf("grace period: removed %v, %d bytes, expected nothing", result.Blobs, result.Reclaimed)
+	}
+
+	// once everything is older than that, a blob that a push found already in place is kept, as is a write
+	// still in progress, however long it takes
+	reused := pushBlob(t, d, "docker.io/lfedge/eci:5", ocispec.MediaTypeImageLayer, []byte("reused"))
+	ctx := context.TODO()
+	inProgress := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromString("in progress"), Size: int64(len("in progress"))}
+	pusher, err := d.Pusher(ctx, "docker.io/lfedge/eci:5")
+	if err != nil {
+		t.Fatalf("unable to get pusher: %v", err)
+	}
+	w, err := pusher.Push(ctx, inProgress)
+	if err != nil {
+		t.Fatalf("unable to push: %v", err)
+	}
+	defer func() { _ = w.Close() }()
+	// another write of the same blob goes to a temporary file of its own, which is kept just the same
+	fallback, err := pusher.Push(ctx, inProgress)
+	if err != nil {
+		t.Fatalf("unable to push again: %v", err)
+	}
+	defer func() { _ = fallback.Close() }()
+	for _, writer := range []ctrcontent.Writer{w, fallback} {
+		if _, err := writer.Write([]byte("in")); err != nil {
+			t.Fatalf("unable to write: %v", err)
+		}
+	}
+	old := time.Now().Add(-2 * ecresolver.DefaultGCGracePeriod)
+	if err := filepath.Walk(tmpdir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		return os.Chtimes(p, old, old)
+	}); err != nil {
+		t.Fatalf("unable to age content: %v", err)
+	}
+	pushBlob(t, d, "docker.io/lfedge/eci:5", ocispec.MediaTypeImageLayer, []byte("reused"))
+
+	for _, dryRun := range []bool{true, false} {
+		result, err := d.GC(ecresolver.GCOptions{KeepTags: 2, DryRun: dryRun})
+		if err != nil {
+			t.Fatalf("dry run %v: unable to gc: %v", dryRun, err)
+		}
+		if len(result.Images) != 1 || result.Images[0] != "docker.io/lfedge/eci:1" {
+			t.Errorf("dry run %v: mismatched images, actual %v expected %v", dryRun, result.Images, []string{"docker.io/lfedge/eci:1"})
+		}
+		blobs := make([]string, 0, len(result.Blobs))
+		for _, b := range result.Blobs {
+			blobs = append(blobs, b.Digest.String())
+		}
+		sort.Strings(blobs)
+		if len(blobs) != len(expectedBlobs) {
+			t.Errorf("dry run %v: mismatched blobs, actual %v expected %v", dryRun, blobs, expectedBlobs)
+		} else {
+			for i := range blobs {
+				if blobs[i] != expectedBlobs[i] {
+					t.Errorf("dry run %v: mismatched blobs, actual %v expected %v", dryRun, blobs, expectedBlobs)
+					break
+				}
+			}
+		}
+		if result.Reclaimed != expectedReclaimed {
+			t.Errorf("dry run %v: mismatched reclaimed, actual %d expected %d", dryRun, result.Reclaimed, expectedReclaimed)
+		}
+		if exists(firstLayer) == !dryRun {
+			t.Errorf("dry run %v: blob %s exists %v", dryRun, firstLayer, exists(firstLayer))
+		}
+		_, _, err = d.Resolve(context.TODO(), "docker.io/lfedge/eci:1")
+		if dryRun && err != nil {
+			t.Errorf("dry run: unable to resolve removed image: %v", err)
+		}
+		if !dryRun && !errors.Is(err, errdefs.ErrNotFound) {
+			t.Errorf("removed image: mismatched errors, actual %v expected %v", err, errdefs.ErrNotFound)
+		}
+	}
+
+	// everything kept still is complete
+	for _, ref := range []string{"docker.io/lfedge/eci:2", "docker.io/lfedge/eci:3", "docker.io/lfedge/other:1"} {
+		_, desc, err := d.Resolve(context.TODO(), ref)
+		if err != nil {
+			t.Errorf("%s: unable to resolve: %v", ref, err)
+			continue
+		}
+		if !exists(desc.Digest) {
+			t.Errorf("%s: manifest %s removed", ref, desc.Digest)
+		}
+	}
+	for _, layer := range []string{"layer-2", "layer-3", "layer-other", "{}"} {
+		if !exists(digest.FromString(layer)) {
+			t.Errorf("blob %s removed", layer)
+		}
+	}
+	if !exists(reused.Digest) {
+		t.Errorf("blob %s found in place by a push removed", reused.Digest)
+	}
+	entries, err := os.ReadDir(filepath.Join(tmpdir, "ingest"))
+	if err != nil {
+		t.Fatalf("unable to read ingest directory: %v", err)
+	}
+	var resumable, temporary int
+	for _, entry := range entries {
+		switch {
+		case entry.Name() == inProgress.Digest.Encoded():
+			resumable++
+		case strings.HasPrefix(entry.Name(), inProgress.Digest.Encoded()+"-"):
+			temporary++
+		}
+	}
+	if resumable != 1 || temporary != 1 {
+		t.Errorf("writes in progress removed, found %d resumable and %d temporary files, expected 1 each", resumable, temporary)
+	}
+	for _, writer := range []ctrcontent.Writer{w, fallback} {
+		if _, err := writer.Write([]byte(" progress")); err != nil {
+			t.Fatalf("unable to continue write: %v", err)
+		}
+		if err := writer.Commit(ctx, inProgress.Size, inProgress.Digest); err != nil {
+			t.Errorf("unable to commit write in progress: %v", err)
+		}
+	}
+}
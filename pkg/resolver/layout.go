@@ -0,0 +1,377 @@
+package resolver
+
+/*
+ Reading and updating the OCI image layout used by Directory, i.e. the index.json and oci-layout files
+ in its root.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	indexFilename = "index.json"
+	// ingestDirname the directory in the layout root for files being written, which are moved into place when complete
+	ingestDirname = "ingest"
+)
+
+// readIndex read the root index.json of the layout in dir. A layout without one is empty.
+func readIndex(dir string) (*ocispec.Index, error) {
+	if err := checkLayout(dir); err != nil {
+		return nil, err
+	}
+	indexFile := path.Join(dir, indexFilename)
+	contents, err := os.ReadFile(indexFile)
+	switch {
+	case err != nil && errors.Is(err, os.ErrNotExist):
+		return emptyIndex(), nil
+	case err != nil:
+		return nil, fmt.Errorf("could not read index %s: %v", indexFile, err)
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(contents, &index); err != nil {
+		return nil, fmt.Errorf("could not convert index %s from json: %v", indexFile, err)
+	}
+	return &index, nil
+}
+
+// writeIndex write the root index.json of the layout in dir, and the oci-layout file if it is missing.
+// Each is replaced atomically, so that a reader never sees it partially written.
+func writeIndex(dir string, index *ocispec.Index) error {
+	layoutFile := path.Join(dir, ocispec.ImageLayoutFile)
+	if _, err := os.Stat(layoutFile); err != nil {
+		b, err := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+		if err != nil {
+			return fmt.Errorf("could not convert layout to json: %v", err)
+		}
+		if err := writeFileAtomic(dir, layoutFile, b); err != nil {
+			return fmt.Errorf("error writing layout file %s: %v", layoutFile, err)
+		}
+	}
+	b, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("could not convert index to json: %v", err)
+	}
+	indexFile := path.Join(dir, indexFilename)
+	if err := writeFileAtomic(dir, indexFile, b); err != nil {
+		return fmt.Errorf("error writing index file %s: %v", indexFile, err)
+	}
+	return nil
+}
+
+// writeFileAtomic write b to a temporary file in the ingest directory of the layout in dir,
+// sync it, and move it into place at filename
+func writeFileAtomic(dir, filename string, b []byte) error {
+	ingestDir := path.Join(dir, ingestDirname)
+	if err := os.MkdirAll(ingestDir, 0755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(ingestDir, path.Base(filename)+"-*")
+	if err != nil {
+		return err
+	}
+	tmpfile := file.Name()
+	defer func() { _ = os.Remove(tmpfile) }()
+	_, err = file.Write(b)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpfile, 0644)
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpfile, filename); err != nil {
+		return err
+	}
+	return syncDir(path.Dir(filename))
+}
+
+// syncDir sync the directory, so that files moved into it survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("could not open directory %s: %v", dir, err)
+	}
+	defer func() { _ = d.Close() }()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("could not sync directory %s: %v", dir, err)
+	}
+	return nil
+}
+
+// verifyBlob check that the blob in filename has the size and digest in desc. The error wraps
+// os.ErrNotExist if there is no such blob.
+func verifyBlob(filename string, desc ocispec.Descriptor) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = file.Close() }()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if desc.Size > 0 && info.Size() != desc.Size {
+		return fmt.Errorf("blob %s has size %d, expected %d", filename, info.Size(), desc.Size)
+	}
+	verifier := desc.Digest.Verifier()
+	if _, err := io.Copy(verifier, file); err != nil {
+		return fmt.Errorf("could not read blob %s: %v", filename, err)
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("blob %s does not match its digest %s", filename, desc.Digest)
+	}
+	return nil
+}
+
+// checkLayout check that the oci-layout file in dir, if any, is a version we understand
+func checkLayout(dir string) error {
+	layoutFile := path.Join(dir, ocispec.ImageLayoutFile)
+	contents, err := os.ReadFile(layoutFile)
+	switch {
+	case err != nil && errors.Is(err, os.ErrNotExist):
+		return nil
+	case err != nil:
+		return fmt.Errorf("could not read layout file %s: %v", layoutFile, err)
+	}
+	var layout ocispec.ImageLayout
+	if err := json.Unmarshal(contents, &layout); err != nil {
+		return fmt.Errorf("could not convert layout file %s from json: %v", layoutFile, err)
+	}
+	if layout.Version != ocispec.ImageLayoutVersion {
+		return fmt.Errorf("unsupported layout version %s in %s", layout.Version, layoutFile)
+	}
+	return nil
+}
+
+func emptyIndex() *ocispec.Index {
+	return &ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+	}
+}
+
+// addToIndex add desc to the root index.json in dir as the image ref, replacing any image
+// already there with the same name. The layout is locked while the index is updated.
+func addToIndex(dir string, desc ocispec.Descriptor, ref string) (err error) {
+	unlock, err := lockLayout(dir, true)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if unlockErr := unlock(); err == nil {
+			err = unlockErr
+		}
+	}()
+	index, err := readIndex(dir)
+	if err != nil {
+		return err
+	}
+	addImage(index, desc, ref)
+	return writeIndex(dir, index)
+}
+
+// addImage add desc to the index as the image ref, replacing any image already there with the same name
+func addImage(index *ocispec.Index, desc ocispec.Descriptor, ref string) {
+	annotations := map[string]string{}
+	for k, v := range desc.Annotations {
+		annotations[k] = v
+	}
+	if value, ok := annotations[ocispec.AnnotationRefName]; !ok || value == "" {
+		if name := refName(ref); name != "" {
+			annotations[ocispec.AnnotationRefName] = name
+		}
+	}
+	if len(annotations) > 0 {
+		desc.Annotations = annotations
+	}
+	name := stripDigest(annotations[ocispec.AnnotationRefName])
+
+	manifests := make([]ocispec.Descriptor, 0, len(index.Manifests)+1)
+	for _, m := range index.Manifests {
+		existing := stripDigest(m.Annotations[ocispec.AnnotationRefName])
+		// an unnamed image is replaced only by the same unnamed image
+		if existing == name && (name != "" || m.Digest == desc.Digest) {
+			continue
+		}
+		manifests = append(manifests, m)
+	}
+	index.Manifests = append(manifests, desc)
+}
+
+// isRoot whether desc is the root of the image ref being pushed, i.e. a manifest or index whose digest is in the ref.
+// If there is no digest in the ref, every manifest or index is, and the last one pushed wins.
+func isRoot(ref string, desc ocispec.Descriptor) bool {
+	if !isIndex(desc.MediaType) && !isManifest(desc.MediaType) {
+		return false
+	}
+	refspec, err := reference.Parse(ref)
+	return err != nil || refspec.Digest() == "" || refspec.Digest() == desc.Digest
+}
+
+// refName the name under which to store ref in the index, i.e. without any digest, blank if it has no tag
+func refName(ref string) string {
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		return stripDigest(ref)
+	}
+	tag, _ := reference.SplitObject(refspec.Object)
+	tag = strings.TrimSuffix(tag, "@")
+	if tag == "" {
+		return ""
+	}
+	return refspec.Locator + ":" + tag
+}
+
+// stripDigest remove any trailing @digest from a name. Older versions of Directory
+// stored names with the digest of the image.
+func stripDigest(name string) string {
+	if i := strings.Index(name, "@"); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// indexReader read the index with the descriptor desc, wherever the blobs are stored
+type indexReader func(desc ocispec.Descriptor) (*ocispec.Index, error)
+
+// findName find the image named by refspec in the descriptors, or any indexes nested in them.
+// The full name is preferred, but the tag alone, as written by some other tools, is accepted.
+func findName(descs []ocispec.Descriptor, refspec reference.Spec, read indexReader) (*ocispec.Descriptor, error) {
+	tag, _ := reference.SplitObject(refspec.Object)
+	tag = strings.TrimSuffix(tag, "@")
+	full := refspec.Locator + ":" + tag
+	for _, want := range []string{full, tag} {
+		found, err := walkIndex(descs, func(desc ocispec.Descriptor) bool {
+			return stripDigest(desc.Annotations[ocispec.AnnotationRefName]) == want
+		}, read)
+		if found != nil || err != nil {
+			return found, err
+		}
+	}
+	return nil, nil
+}
+
+// findDigest find the descriptor with the digest dgst in the descriptors, or any indexes nested in them
+func findDigest(descs []ocispec.Descriptor, dgst digest.Digest, read indexReader) (*ocispec.Descriptor, error) {
+	return walkIndex(descs, func(desc ocispec.Descriptor) bool {
+		return desc.Digest == dgst
+	}, read)
+}
+
+// findImage find the image ref in the descriptors, by digest if it has one, else by name
+func findImage(descs []ocispec.Descriptor, ref string, read indexReader) (*ocispec.Descriptor, error) {
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	if refspec.Object == "" {
+		return nil, reference.ErrObjectRequired
+	}
+	if dgst := refspec.Digest(); dgst != "" {
+		return findDigest(descs, dgst, read)
+	}
+	return findName(descs, refspec, read)
+}
+
+// walkIndex find the first descriptor that matches, one level of nesting at a time,
+// so that a descriptor in index.json is preferred over one in a nested index
+func walkIndex(descs []ocispec.Descriptor, match func(ocispec.Descriptor) bool, read indexReader) (*ocispec.Descriptor, error) {
+	seen := map[digest.Digest]bool{}
+	for len(descs) > 0 {
+		for i := range descs {
+			if match(descs[i]) {
+				return &descs[i], nil
+			}
+		}
+		var next []ocispec.Descriptor
+		for _, desc := range descs {
+			if !isIndex(desc.MediaType) || seen[desc.Digest] {
+				continue
+			}
+			seen[desc.Digest] = true
+			index, err := read(desc)
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, index.Manifests...)
+		}
+		descs = next
+	}
+	return nil, nil
+}
+
+// readIndexBlob read the index with the descriptor desc from the blobs in dir
+func readIndexBlob(dir string, desc ocispec.Descriptor) (*ocispec.Index, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid digest %s: %v", desc.Digest, err)
+	}
+	filename := blobPath(dir, desc.Digest)
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read index %s: %w", filename, err)
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(contents, &index); err != nil {
+		return nil, fmt.Errorf("could not convert index %s from json: %v", filename, err)
+	}
+	return &index, nil
+}
+
+// children the descriptors referenced by the manifest or index desc, read from the blobs in dir;
+// none for any other type
+func children(dir string, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+	switch {
+	case isIndex(desc.MediaType):
+		index, err := readIndexBlob(dir, desc)
+		if err != nil {
+			return nil, err
+		}
+		return index.Manifests, nil
+	case isManifest(desc.MediaType):
+		if err := desc.Digest.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid digest %s: %v", desc.Digest, err)
+		}
+		filename := blobPath(dir, desc.Digest)
+		contents, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("could not read manifest %s: %w", filename, err)
+		}
+		var manifest ocispec.Manifest
+		if err := json.Unmarshal(contents, &manifest); err != nil {
+			return nil, fmt.Errorf("could not convert manifest %s from json: %v", filename, err)
+		}
+		return append([]ocispec.Descriptor{manifest.Config}, manifest.Layers...), nil
+	}
+	return nil, nil
+}
+
+// blobPath the path to the blob with the digest dgst in the layout in dir
+func blobPath(dir string, dgst digest.Digest) string {
+	return path.Join(dir, "blobs", dgst.Algorithm().String(), dgst.Encoded())
+}
+
+func isIndex(mediaType string) bool {
+	return mediaType == ocispec.MediaTypeImageIndex || mediaType == images.MediaTypeDockerSchema2ManifestList
+}
+
+func isManifest(mediaType string) bool {
+	return mediaType == ocispec.MediaTypeImageManifest || mediaType == images.MediaTypeDockerSchema2Manifest
+}
@@ -0,0 +1,59 @@
+package resolver
+
+/*
+ Advisory locking of the OCI image layout used by Directory, so that several Directory instances,
+ in one or more processes, can share a single directory.
+
+ The lock is a lock file in the layout root. Anything that changes the index.json holds it exclusively
+ for the whole read-modify-write. Blobs need no layout lock, as each is written to a file in the ingest
+ directory and moved into place atomically, so concurrent writers of the same blob simply replace identical
+ content. The file a blob is written to, so that the write can continue later, is locked by its writer;
+ any other writer of the same blob at the same time writes to a temporary file of its own.
+
+ A layout that cannot be written, e.g. on a read-only filesystem, still can be read. Its readers open the lock
+ file read-only, or, if there is none, go without the lock, as nothing can change a layout that nobody can write.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"syscall"
+)
+
+// lockFilename the lock file in the layout root
+const lockFilename = ".lock"
+
+// lockLayout take the lock on the layout in dir, exclusive or shared, waiting until it is available.
+// The returned function releases it.
+func lockLayout(dir string, exclusive bool) (func() error, error) {
+	lockFile := path.Join(dir, lockFilename)
+	file, err := os.OpenFile(lockFile, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil && !exclusive && readOnly(err) {
+		file, err = os.Open(lockFile)
+		if errors.Is(err, fs.ErrNotExist) {
+			return func() error { return nil }, nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open lock file %s: %v", lockFile, err)
+	}
+	if err := flock(file, exclusive); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("could not lock %s: %v", lockFile, err)
+	}
+	return func() error {
+		err := funlock(file)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}, nil
+}
+
+// readOnly whether the error is from writing where only reading is allowed, e.g. a read-only filesystem
+func readOnly(err error) bool {
+	return errors.Is(err, fs.ErrPermission) || errors.Is(err, syscall.EROFS)
+}
@@ -0,0 +1,104 @@
+package resolver
+
+/*
+ Stores and removes the credentials for registries, in the docker config, or the credential helper
+ it names, e.g. docker-credential-pass, so that they are shared with docker, which need not be installed.
+
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"oras.land/oras-go/pkg/auth"
+	dockerauth "oras.land/oras-go/pkg/auth/docker"
+)
+
+// Credentials the username and secret for the registry host. A blank username with a secret is
+// an identity token, and both blank is no credentials for the host.
+type Credentials func(host string) (username, secret string, err error)
+
+// StaticCredentials the credentials for the one registry host, e.g. registry.example.com or docker.io, and none
+// for any other, so that they are not sent to mirrors, or to the registries of other images
+func StaticCredentials(registry, username, secret string) Credentials {
+	registry = credentialsHost(registry)
+	return func(host string) (string, string, error) {
+		if !strings.EqualFold(credentialsHost(host), registry) {
+			return "", "", nil
+		}
+		return username, secret, nil
+	}
+}
+
+// credentialsHost the host that the credentials for the registry are sent to, which for docker hub is not its name
+func credentialsHost(registry string) string {
+	switch registry {
+	case "docker.io", "index.docker.io":
+		return "registry-1.docker.io"
+	}
+	return registry
+}
+
+// ErrNotLoggedIn no credentials are stored for the host
+var ErrNotLoggedIn = auth.ErrNotLoggedIn
+
+// authClient the client for the credentials stored in the docker config of the options
+func (o RegistryOptions) authClient() (*dockerauth.Client, error) {
+	var paths []string
+	if o.AuthConfig != "" {
+		paths = append(paths, o.AuthConfig)
+	}
+	cli, err := dockerauth.NewClient(paths...)
+	if err != nil {
+		return nil, err
+	}
+	client, ok := cli.(*dockerauth.Client)
+	if !ok {
+		return nil, fmt.Errorf("unexpected authenticating client %T", cli)
+	}
+	return client, nil
+}
+
+// Login check the credentials with the registry host, connecting with the options, and store them
+// for later use by registry resolvers.
+func Login(ctx context.Context, host, username, secret string, opts RegistryOptions) error {
+	if secret == "" {
+		return errors.New("a password or token is required")
+	}
+	client, err := opts.authClient()
+	if err != nil {
+		return fmt.Errorf("unable to get authenticating client to registry: %v", err)
+	}
+	options := []auth.LoginOption{
+		auth.WithLoginContext(ctx),
+		auth.WithLoginHostname(host),
+		auth.WithLoginUsername(username),
+		auth.WithLoginSecret(secret),
+		auth.WithLoginUserAgent("eci"),
+		auth.WithLoginTLS(opts.CertFile, opts.KeyFile, opts.CAFile),
+	}
+	if opts.PlainHTTP || opts.Insecure {
+		options = append(options, auth.WithLoginInsecure())
+	}
+	if err := client.LoginWithOpts(options...); err != nil {
+		return fmt.Errorf("unable to log in to %s: %v", host, err)
+	}
+	return nil
+}
+
+// Logout remove the stored credentials for the registry host; ErrNotLoggedIn if there are none
+func Logout(ctx context.Context, host string, opts RegistryOptions) error {
+	client, err := opts.authClient()
+	if err != nil {
+		return fmt.Errorf("unable to get authenticating client to registry: %v", err)
+	}
+	if err := client.Logout(ctx, host); err != nil {
+		if errors.Is(err, auth.ErrNotLoggedIn) {
+			return err
+		}
+		return fmt.Errorf("unable to log out of %s: %v", host, err)
+	}
+	return nil
+}
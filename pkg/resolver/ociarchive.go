@@ -0,0 +1,148 @@
+package resolver
+
+/*
+ Provides a github.com/containerd/containerd/remotes#Resolver that resolves
+ to a single tar archive of an OCI image layout, as in Directory, e.g. to carry images
+ to air-gapped sites.
+
+ An archive either is written or read, never both. Pushing adds each blob to the archive once it is
+ committed, which is built as a temporary file next to it, and moved into place with its index.json
+ on Finalize. Pulling reads each blob by seeking to it in the archive, without extracting it.
+*/
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// OCIArchive resolver to push to/pull from a tar archive of an OCI image layout
+type OCIArchive struct {
+	archive *tarArchive
+	ctx     context.Context
+
+	// checkLayout verifies the oci-layout of an archive being read, once
+	checkLayout sync.Once
+	layoutErr   error
+	// index the index.json of an archive being written, guarded by the archive lock
+	index *ocispec.Index
+}
+
+// NewOCIArchive create a resolver for the OCI image layout archive in file. Nothing is opened until it is
+// first used, for pushing, which creates or replaces the archive, or for pulling, which requires it to exist.
+func NewOCIArchive(ctx context.Context, file string) (context.Context, *OCIArchive, error) {
+	if file == "" {
+		return ctx, nil, fmt.Errorf("must have an archive file")
+	}
+	return ctx, &OCIArchive{archive: &tarArchive{path: file}, ctx: ctx}, nil
+}
+
+func (a *OCIArchive) Resolve(ctx context.Context, ref string) (name string, desc ocispec.Descriptor, err error) {
+	if err := a.openReader(); err != nil {
+		return "", ocispec.Descriptor{}, err
+	}
+	var index ocispec.Index
+	if err := a.archive.readJSON(indexFilename, &index); err != nil {
+		return "", ocispec.Descriptor{}, err
+	}
+	found, err := findImage(index.Manifests, ref, func(desc ocispec.Descriptor) (*ocispec.Index, error) {
+		var nested ocispec.Index
+		if err := a.archive.readJSON(blobName(desc.Digest), &nested); err != nil {
+			return nil, err
+		}
+		return &nested, nil
+	})
+	if err != nil {
+		return "", ocispec.Descriptor{}, err
+	}
+	if found == nil {
+		return "", ocispec.Descriptor{}, fmt.Errorf("%s not found in %s: %w", ref, a.archive.path, errdefs.ErrNotFound)
+	}
+	return ref, *found, nil
+}
+
+func (a *OCIArchive) Fetcher(ctx context.Context, ref string) (remotes.Fetcher, error) {
+	if err := a.openReader(); err != nil {
+		return nil, err
+	}
+	return ociArchiveFetcher{a}, nil
+}
+
+func (a *OCIArchive) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	created, err := a.archive.openWriter()
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		a.archive.mu.Lock()
+		defer a.archive.mu.Unlock()
+		a.index = emptyIndex()
+		if err := a.archive.writeJSON(ocispec.ImageLayoutFile, ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion}); err != nil {
+			return nil, fmt.Errorf("could not add %s to archive: %v", ocispec.ImageLayoutFile, err)
+		}
+	}
+	return ociArchivePusher{archive: a, ref: ref}, nil
+}
+
+// Finalize when pushing, add the index.json, close the archive and move it into place; when pulling, close it.
+func (a *OCIArchive) Finalize(ctx context.Context) error {
+	return a.archive.close(func() error {
+		return a.archive.writeJSON(indexFilename, a.index)
+	})
+}
+
+func (a *OCIArchive) Context() context.Context {
+	return a.ctx
+}
+
+// openReader open the archive for reading, checking its layout version, if it has one
+func (a *OCIArchive) openReader() error {
+	if err := a.archive.openReader(); err != nil {
+		return err
+	}
+	a.checkLayout.Do(func() {
+		if !a.archive.has(ocispec.ImageLayoutFile) {
+			return
+		}
+		var layout ocispec.ImageLayout
+		if err := a.archive.readJSON(ocispec.ImageLayoutFile, &layout); err != nil {
+			a.layoutErr = err
+			return
+		}
+		if layout.Version != ocispec.ImageLayoutVersion {
+			a.layoutErr = fmt.Errorf("unsupported layout version %s in %s", layout.Version, a.archive.path)
+		}
+	})
+	return a.layoutErr
+}
+
+type ociArchiveFetcher struct {
+	archive *OCIArchive
+}
+
+func (f ociArchiveFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	return f.archive.archive.fetch(desc)
+}
+
+type ociArchivePusher struct {
+	archive *OCIArchive
+	ref     string
+}
+
+// Push start writing the blob, which is added to the archive when committed. Any number of blobs may be
+// written at once.
+func (p ociArchivePusher) Push(ctx context.Context, desc ocispec.Descriptor) (content.Writer, error) {
+	a := p.archive
+	add := func() {
+		if isRoot(p.ref, desc) {
+			addImage(a.index, desc, p.ref)
+		}
+	}
+	return a.archive.push(p.ref, desc, add, func([]byte) { add() })
+}
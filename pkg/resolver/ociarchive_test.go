@@ -0,0 +1,198 @@
+package resolver_test
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	ecresolver "github.com/lf-edge/edge-containers/pkg/resolver"
+
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// fetchString fetch the blob with the digest from the resolver
+func fetchString(t *testing.T, r ecresolver.ResolverCloser, ref string, dgst digest.Digest) string {
+	t.Helper()
+	fetcher, err := r.Fetcher(context.TODO(), ref)
+	if err != nil {
+		t.Fatalf("unable to get fetcher: %v", err)
+	}
+	rc, err := fetcher.Fetch(context.TODO(), ocispec.Descriptor{Digest: dgst})
+	if err != nil {
+		t.Fatalf("unable to fetch %s: %v", dgst, err)
+	}
+	defer func() { _ = rc.Close() }()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("unable to read %s: %v", dgst, err)
+	}
+	return string(b)
+}
+
+func TestOCIArchive(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "edge-containers-archive")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+	archive := filepath.Join(tmpdir, "images.tar")
+
+	_, w, err := ecresolver.NewOCIArchive(context.TODO(), archive)
+	if err != nil {
+		t.Fatalf("unable to create archive resolver: %v", err)
+	}
+	// a writer that is abandoned, neither committed nor closed, holds up no other, and is left out
+	pusher, err := w.Pusher(context.TODO(), "docker.io/lfedge/eci:current")
+	if err != nil {
+		t.Fatalf("unable to get pusher: %v", err)
+	}
+	abandoned, err := pusher.Push(context.TODO(), ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromString("abandoned"), Size: int64(len("abandoned"))})
+	if err != nil {
+		t.Fatalf("unable to push: %v", err)
+	}
+	if _, err := abandoned.Write([]byte("aban")); err != nil {
+		t.Fatalf("unable to write: %v", err)
+	}
+	current := pushImage(t, w, "docker.io/lfedge/eci:current", "current")
+	nested := pushImage(t, w, "docker.io/lfedge/other:1.0", "nested")
+	b, err := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{nested},
+	})
+	if err != nil {
+		t.Fatalf("unable to marshal index: %v", err)
+	}
+	indexDesc := pushBlob(t, w, fmt.Sprintf("docker.io/lfedge/other:1.0@%s", digest.FromBytes(b)), ocispec.MediaTypeImageIndex, b)
+	// nothing is in place until finalized
+	if _, err := os.Stat(archive); err == nil {
+		t.Errorf("archive exists before finalize")
+	}
+	if err := w.Finalize(context.TODO()); err != nil {
+		t.Fatalf("unable to finalize archive: %v", err)
+	}
+	if err := abandoned.Close(); err != nil {
+		t.Errorf("unable to close abandoned writer: %v", err)
+	}
+	if entries, err := os.ReadDir(tmpdir); err != nil || len(entries) != 1 {
+		t.Errorf("mismatched files, expected only the archive: %v %v", entries, err)
+	}
+
+	_, r, err := ecresolver.NewOCIArchive(context.TODO(), archive)
+	if err != nil {
+		t.Fatalf("unable to create archive resolver: %v", err)
+	}
+	defer func() { _ = r.Finalize(context.TODO()) }()
+	tests := []struct {
+		ref    string
+		digest digest.Digest
+		err    error
+	}{
+		{"docker.io/lfedge/eci:current", current.Digest, nil},
+		{"docker.io/lfedge/other:1.0", indexDesc.Digest, nil},
+		{fmt.Sprintf("docker.io/lfedge/other@%s", nested.Digest), nested.Digest, nil},
+		{"docker.io/lfedge/eci:unknown", "", errdefs.ErrNotFound},
+	}
+	for _, tt := range tests {
+		_, desc, err := r.Resolve(context.TODO(), tt.ref)
+		switch {
+		case tt.err != nil && !errors.Is(err, tt.err):
+			t.Errorf("%s: mismatched errors, actual %v expected %v", tt.ref, err, tt.err)
+		case tt.err == nil && err != nil:
+			t.Errorf("%s: unexpected error: %v", tt.ref, err)
+		case desc.Digest != tt.digest:
+			t.Errorf("%s: mismatched digest, actual %s expected %s", tt.ref, desc.Digest, tt.digest)
+		}
+	}
+	for _, layer := range []string{"current", "nested"} {
+		if actual := fetchString(t, r, "docker.io/lfedge/eci:current", digest.FromString(layer)); actual != layer {
+			t.Errorf("mismatched layer, actual %q expected %q", actual, layer)
+		}
+	}
+	fetcher, err := r.Fetcher(context.TODO(), "docker.io/lfedge/eci:current")
+	if err != nil {
+		t.Fatalf("unable to get fetcher: %v", err)
+	}
+	if _, err := fetcher.Fetch(context.TODO(), ocispec.Descriptor{Digest: digest.FromString("abandoned")}); !errors.Is(err, errdefs.ErrNotFound) {
+		t.Errorf("abandoned blob: mismatched errors, actual %v expected %v", err, errdefs.ErrNotFound)
+	}
+	// an archive being read cannot be written
+	if _, err := r.Pusher(context.TODO(), "docker.io/lfedge/eci:current"); err == nil {
+		t.Errorf("pusher for an archive being read did not fail")
+	}
+}
+
+func TestOCIArchiveFromTar(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "edge-containers-archive")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+
+	// a layout in a directory, archived with names like ./blobs/sha256/..., as tar -C dir . would
+	layoutDir := filepath.Join(tmpdir, "layout")
+	_, d, err := ecresolver.NewDirectory(context.TODO(), layoutDir)
+	if err != nil {
+		t.Fatalf("unable to create directory resolver: %v", err)
+	}
+	desc := pushImage(t, d, "docker.io/lfedge/eci:1.0", "layer")
+	archive := filepath.Join(tmpdir, "layout.tar")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatalf("unable to create archive: %v", err)
+	}
+	tw := tar.NewWriter(f)
+	err = filepath.Walk(layoutDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			return err
+		}
+		rel, err := filepath.Rel(layoutDir, p)
+		if err != nil {
+			return err
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: "./" + filepath.ToSlash(rel), Mode: 0644, Size: int64(len(b))}); err != nil {
+			return err
+		}
+		_, err = tw.Write(b)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("unable to archive layout: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("unable to close archive: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("unable to close archive: %v", err)
+	}
+
+	_, r, err := ecresolver.NewOCIArchive(context.TODO(), archive)
+	if err != nil {
+		t.Fatalf("unable to create archive resolver: %v", err)
+	}
+	defer func() { _ = r.Finalize(context.TODO()) }()
+	_, resolved, err := r.Resolve(context.TODO(), "docker.io/lfedge/eci:1.0")
+	if err != nil {
+		t.Fatalf("unable to resolve: %v", err)
+	}
+	if resolved.Digest != desc.Digest {
+		t.Errorf("mismatched digest, actual %s expected %s", resolved.Digest, desc.Digest)
+	}
+	if actual := fetchString(t, r, "docker.io/lfedge/eci:1.0", digest.FromString("layer")); actual != "layer" {
+		t.Errorf("mismatched layer, actual %q expected %q", actual, "layer")
+	}
+}
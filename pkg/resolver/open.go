@@ -0,0 +1,142 @@
+package resolver
+
+/*
+ Opens a ResolverCloser from a URI-style remote, e.g. containerd:///run/containerd.sock?namespace=eve,
+ using the factory registered for its scheme. The stores in this package are registered as:
+
+   ""              the default registry for each image, by its name, with the options
+                   plain-http, insecure, ca-file, cert and key, e.g. ?ca-file=/etc/eci/ca.pem
+   file            a local directory, also a bare /path
+   containerd      a containerd socket, with the option namespace
+   oci-archive     a tar archive of an OCI image layout
+   docker-archive  a tar archive as written by docker save
+
+ Other stores, e.g. in tools that embed this package, are added with Register. Registry remotes
+ start from the options set on the context with WithRegistryOptions.
+*/
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Factory create a resolver for the remote uri, whose scheme it was registered for.
+// Options are in the query of the uri.
+type Factory func(ctx context.Context, uri *url.URL) (context.Context, ResolverCloser, error)
+
+var (
+	factoriesLock sync.RWMutex
+	factories     = map[string]Factory{}
+)
+
+func init() {
+	Register("", func(ctx context.Context, uri *url.URL) (context.Context, ResolverCloser, error) {
+		if err := checkOptions(uri, registryOptionPlainHTTP, registryOptionInsecure, registryOptionCAFile, registryOptionCert, registryOptionKey); err != nil {
+			return ctx, nil, err
+		}
+		opts, err := registryOptionsFromContext(ctx).withQuery(uri)
+		if err != nil {
+			return ctx, nil, err
+		}
+		return NewRegistryWithOptions(ctx, opts)
+	})
+	Register("file", func(ctx context.Context, uri *url.URL) (context.Context, ResolverCloser, error) {
+		if err := checkOptions(uri); err != nil {
+			return ctx, nil, err
+		}
+		return NewDirectory(ctx, uriPath(uri))
+	})
+	Register("containerd", func(ctx context.Context, uri *url.URL) (context.Context, ResolverCloser, error) {
+		if err := checkOptions(uri, "namespace"); err != nil {
+			return ctx, nil, err
+		}
+		return NewContainerd(ctx, uriPath(uri), uri.Query().Get("namespace"))
+	})
+	Register("oci-archive", func(ctx context.Context, uri *url.URL) (context.Context, ResolverCloser, error) {
+		if err := checkOptions(uri); err != nil {
+			return ctx, nil, err
+		}
+		return NewOCIArchive(ctx, uriPath(uri))
+	})
+	Register("docker-archive", func(ctx context.Context, uri *url.URL) (context.Context, ResolverCloser, error) {
+		if err := checkOptions(uri); err != nil {
+			return ctx, nil, err
+		}
+		return NewDockerArchive(ctx, uriPath(uri))
+	})
+}
+
+// Register the factory for remotes with the scheme, replacing any already registered for it.
+// Schemes are case-insensitive.
+func Register(scheme string, factory Factory) {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+	factories[strings.ToLower(scheme)] = factory
+}
+
+// Schemes the schemes that have a factory registered, sorted
+func Schemes() []string {
+	factoriesLock.RLock()
+	defer factoriesLock.RUnlock()
+	var schemes []string
+	for scheme := range factories {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Open create a resolver for the remote uri, with the factory registered for its scheme.
+// A blank uri is the default registry, and a bare /path is a local directory.
+func Open(ctx context.Context, uri string) (context.Context, ResolverCloser, error) {
+	parsed, err := parseURI(uri)
+	if err != nil {
+		return ctx, nil, err
+	}
+	factoriesLock.RLock()
+	factory, ok := factories[parsed.Scheme]
+	factoriesLock.RUnlock()
+	if !ok {
+		return ctx, nil, fmt.Errorf("unknown remote %s, scheme must be one of %q", uri, Schemes())
+	}
+	return factory(ctx, parsed)
+}
+
+// parseURI parse the remote uri; a bare /path is a file uri
+func parseURI(uri string) (*url.URL, error) {
+	if strings.HasPrefix(uri, "/") {
+		return &url.URL{Scheme: "file", Path: uri}, nil
+	}
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote %s: %v", uri, err)
+	}
+	return parsed, nil
+}
+
+// uriPath the path in the uri. Relative paths are accepted, whether as scheme:path or scheme://path,
+// so the latter has no host, and is not escaped.
+func uriPath(uri *url.URL) string {
+	if uri.Opaque != "" {
+		return uri.Opaque
+	}
+	return uri.Host + uri.Path
+}
+
+// checkOptions check that the uri has only the allowed options
+func checkOptions(uri *url.URL, allowed ...string) error {
+	for option := range uri.Query() {
+		found := false
+		for _, a := range allowed {
+			found = found || option == a
+		}
+		if !found {
+			return fmt.Errorf("unknown option %s for remote %s", option, uri.Redacted())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package resolver_test
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ecresolver "github.com/lf-edge/edge-containers/pkg/resolver"
+)
+
+func TestOpen(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "edge-containers-open")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+
+	var opened *url.URL
+	ecresolver.Register("test", func(ctx context.Context, uri *url.URL) (context.Context, ecresolver.ResolverCloser, error) {
+		opened = uri
+		return ecresolver.NewDirectory(ctx, tmpdir)
+	})
+
+	tests := []struct {
+		uri     string
+		path    string
+		options url.Values
+	}{
+		{"test:///var/lib/store?level=3&debug=true", "/var/lib/store", url.Values{"level": {"3"}, "debug": {"true"}}},
+		{"TEST:relative/store", "", url.Values{}},
+	}
+	for _, tt := range tests {
+		opened = nil
+		if _, _, err := ecresolver.Open(context.TODO(), tt.uri); err != nil {
+			t.Fatalf("%s: unable to open: %v", tt.uri, err)
+		}
+		if opened == nil {
+			t.Fatalf("%s: registered factory not called", tt.uri)
+		}
+		if tt.path != "" && opened.Path != tt.path {
+			t.Errorf("%s: mismatched path, actual %s expected %s", tt.uri, opened.Path, tt.path)
+		}
+		for k, v := range tt.options {
+			if actual := opened.Query()[k]; len(actual) != 1 || actual[0] != v[0] {
+				t.Errorf("%s: mismatched option %s, actual %v expected %v", tt.uri, k, actual, v)
+			}
+		}
+	}
+
+	// built-in schemes
+	for _, uri := range []string{tmpdir, "file://" + tmpdir} {
+		_, r, err := ecresolver.Open(context.TODO(), uri)
+		if err != nil {
+			t.Fatalf("%s: unable to open: %v", uri, err)
+		}
+		if _, ok := r.(*ecresolver.Directory); !ok {
+			t.Errorf("%s: mismatched resolver type %T", uri, r)
+		}
+	}
+	archive := filepath.Join(tmpdir, "images.tar")
+	if _, r, err := ecresolver.Open(context.TODO(), "docker-archive:"+archive); err != nil {
+		t.Errorf("unable to open docker archive: %v", err)
+	} else if _, ok := r.(*ecresolver.DockerArchive); !ok {
+		t.Errorf("mismatched resolver type %T", r)
+	}
+
+	for _, uri := range []string{"unknown:///store", "file://" + tmpdir + "?namespace=eve", "containerd:///run/containerd.sock?unknown=1"} {
+		if _, _, err := ecresolver.Open(context.TODO(), uri); err == nil {
+			t.Errorf("%s: open did not fail", uri)
+		}
+	}
+}
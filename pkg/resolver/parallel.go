@@ -0,0 +1,238 @@
+package resolver
+
+/*
+ Provides a github.com/containerd/containerd/remotes#Resolver whose readers of large blobs from an existing
+ resolver also read any range of the blob, concurrently, each range continuing a fetch of its own, e.g. a range
+ request to a registry. A writer that supports it, e.g. a PartialWriter, then fetches several ranges of the blob
+ at once, which makes better use of links with high latency, and of registries served from a CDN.
+
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/containerd/containerd/remotes"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// DefaultParallelConnections the number of ranges of a blob fetched at once, unless set
+const DefaultParallelConnections = 4
+
+// ParallelOptions which blobs to fetch in ranges at once, and how many
+type ParallelOptions struct {
+	// Threshold the least size of a blob to fetch in ranges; 0 fetches every blob in a single request
+	Threshold int64
+	// Connections the number of ranges to fetch at once, default DefaultParallelConnections
+	Connections int
+}
+
+// ConcurrentReaderAt reader of a blob whose ReadAt may be called concurrently, for up to Concurrency ranges,
+// each continuing a fetch of its own
+type ConcurrentReaderAt interface {
+	io.Reader
+	io.ReaderAt
+	Concurrency() int
+}
+
+// Parallel resolver that fetches large blobs with an existing resolver in ranges at once
+type Parallel struct {
+	ResolverCloser
+	opts ParallelOptions
+}
+
+// NewParallel create a resolver that fetches the large blobs of the resolver in ranges at once, with the options
+func NewParallel(ctx context.Context, resolver ResolverCloser, opts ParallelOptions) (context.Context, *Parallel, error) {
+	if opts.Connections == 0 {
+		opts.Connections = DefaultParallelConnections
+	}
+	if opts.Threshold < 0 || opts.Connections < 0 {
+		return ctx, nil, fmt.Errorf("invalid parallel options, threshold %d and connections %d", opts.Threshold, opts.Connections)
+	}
+	return ctx, &Parallel{ResolverCloser: resolver, opts: opts}, nil
+}
+
+func (r *Parallel) Fetcher(ctx context.Context, ref string) (remotes.Fetcher, error) {
+	fetcher, err := r.ResolverCloser.Fetcher(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return parallelFetcher{fetcher: fetcher, opts: r.opts}, nil
+}
+
+// parallelFetcher fetcher whose readers of blobs of at least the threshold read ranges of them concurrently
+type parallelFetcher struct {
+	fetcher remotes.Fetcher
+	opts    ParallelOptions
+}
+
+func (f parallelFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	rc, err := f.fetcher.Fetch(ctx, desc)
+	if err != nil || f.opts.Threshold <= 0 || f.opts.Connections < 2 || desc.Size < f.opts.Threshold {
+		return rc, err
+	}
+	return &rangeReader{ctx: ctx, fetcher: f.fetcher, desc: desc, connections: f.opts.Connections, streams: []rangeStream{{rc: rc}}}, nil
+}
+
+// offsetFetcher fetcher that fetches a blob from an offset, e.g. that of a Retry resolver, whose fetch otherwise
+// would start, from the start of the blob, before it could be moved there; the fetches that are at another offset
+// are kept for the reads that continue them, rather than moved
+type offsetFetcher interface {
+	fetchFrom(ctx context.Context, desc ocispec.Descriptor, offset int64) (io.ReadCloser, error)
+}
+
+// rangeStream a fetch of the blob, at the offset it has read to
+type rangeStream struct {
+	offset int64
+	rc     io.ReadCloser
+}
+
+// rangeReader reader of a blob that reads any range of it, continuing the fetch that is already there, if any,
+// or else fetching from the start of the range
+type rangeReader struct {
+	ctx         context.Context
+	fetcher     remotes.Fetcher
+	desc        ocispec.Descriptor
+	connections int
+	// offset where Read reads from
+	offset int64
+	lock   sync.Mutex
+	// streams the fetches not being read
+	streams []rangeStream
+	closed  bool
+}
+
+// stream take the fetch that is at the offset, or else fetch the blob from there, moving a fetch there where
+// the fetcher cannot fetch from an offset
+func (r *rangeReader) stream(offset int64) (io.ReadCloser, error) {
+	r.lock.Lock()
+	if r.closed {
+		r.lock.Unlock()
+		return nil, fmt.Errorf("reader for %s is closed", r.desc.Digest)
+	}
+	from, _ := r.fetcher.(offsetFetcher)
+	seekable := -1
+	for i, s := range r.streams {
+		if s.offset == offset {
+			r.streams = append(r.streams[:i], r.streams[i+1:]...)
+			r.lock.Unlock()
+			return s.rc, nil
+		}
+		if _, ok := s.rc.(io.Seeker); ok && seekable < 0 && from == nil {
+			seekable = i
+		}
+	}
+	if seekable >= 0 {
+		rc := r.streams[seekable].rc
+		r.streams = append(r.streams[:seekable], r.streams[seekable+1:]...)
+		r.lock.Unlock()
+		if _, err := rc.(io.Seeker).Seek(offset, io.SeekStart); err != nil {
+			_ = rc.Close()
+			return nil, err
+		}
+		return rc, nil
+	}
+	r.lock.Unlock()
+	if from != nil {
+		return from.fetchFrom(r.ctx, r.desc, offset)
+	}
+	rc, err := r.fetcher.Fetch(r.ctx, r.desc)
+	if err != nil {
+		return nil, err
+	}
+	if err := skip(rc, offset); err != nil {
+		_ = rc.Close()
+		return nil, err
+	}
+	return rc, nil
+}
+
+// idle keep the fetch, now at the offset, for the read that continues from there
+func (r *rangeReader) idle(offset int64, rc io.ReadCloser) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed || offset >= r.desc.Size {
+		_ = rc.Close()
+		return
+	}
+	r.streams = append(r.streams, rangeStream{offset: offset, rc: rc})
+	if len(r.streams) > r.connections {
+		_ = r.streams[0].rc.Close()
+		r.streams = r.streams[1:]
+	}
+}
+
+// ReadAt reads len(p) bytes of the blob from the offset, continuing the fetch that last read up to it, if any.
+// It may be called concurrently.
+func (r *rangeReader) ReadAt(p []byte, off int64) (int, error) {
+	switch {
+	case off < 0:
+		return 0, fmt.Errorf("negative offset %d", off)
+	case off >= r.desc.Size:
+		return 0, io.EOF
+	}
+	var eof error
+	if remaining := r.desc.Size - off; int64(len(p)) > remaining {
+		p, eof = p[:remaining], io.EOF
+	}
+	rc, err := r.stream(off)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(rc, p)
+	if err != nil {
+		_ = rc.Close()
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return n, err
+	}
+	r.idle(off+int64(n), rc)
+	return n, eof
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	return n, err
+}
+
+// Seek move where Read reads from, e.g. where a write that continues an earlier one starts
+func (r *rangeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.desc.Size
+	default:
+		return r.offset, fmt.Errorf("unsupported whence %d", whence)
+	}
+	if offset < 0 {
+		return r.offset, fmt.Errorf("negative offset %d", offset)
+	}
+	r.offset = offset
+	return r.offset, nil
+}
+
+// Concurrency the number of ranges to read at once
+func (r *rangeReader) Concurrency() int {
+	return r.connections
+}
+
+func (r *rangeReader) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.closed = true
+	var err error
+	for _, s := range r.streams {
+		if closeErr := s.rc.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	r.streams = nil
+	return err
+}
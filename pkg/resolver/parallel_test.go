@@ -0,0 +1,262 @@
+package resolver_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ctrcontent "github.com/containerd/containerd/content"
+	ecresolver "github.com/lf-edge/edge-containers/pkg/resolver"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestParallel(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "edge-containers-parallel")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+	t.Setenv("DOCKER_CONFIG", tmpdir)
+
+	blob := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromBytes(blob), Size: int64(len(blob))}
+	const connections = 4
+	part := int64(len(blob) / connections)
+	ctx := context.Background()
+
+	registry := &flakyRegistry{blob: blob}
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	_, r, err := ecresolver.NewRegistryWithOptions(ctx, ecresolver.RegistryOptions{})
+	if err != nil {
+		t.Fatalf("unable to create registry resolver: %v", err)
+	}
+	_, pr, err := ecresolver.NewParallel(ctx, r, ecresolver.ParallelOptions{Threshold: part, Connections: connections})
+	if err != nil {
+		t.Fatalf("unable to create parallel resolver: %v", err)
+	}
+	fetcher, err := pr.Fetcher(ctx, strings.TrimPrefix(server.URL, "http://")+"/lfedge/eci:current")
+	if err != nil {
+		t.Fatalf("unable to get fetcher: %v", err)
+	}
+
+	// pull fetches the blob to the file, with the flags it is opened with, returning the ranges requested
+	pull := func(filename string, flag int, appending bool, failures []string) ([]string, error) {
+		t.Helper()
+		registry.lock.Lock()
+		registry.requests, registry.failures = nil, failures
+		registry.lock.Unlock()
+		file, err := os.OpenFile(filename, flag|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatalf("unable to open %s: %v", filename, err)
+		}
+		defer func() { _ = file.Close() }()
+		w, err := ecresolver.NewPartialWriter(file, filename+ecresolver.PartialSuffix, desc, appending)
+		if err != nil {
+			t.Fatalf("unable to create writer: %v", err)
+		}
+		defer func() { _ = w.Close() }()
+		rc, err := fetcher.Fetch(ctx, desc)
+		if err != nil {
+			t.Fatalf("unable to fetch: %v", err)
+		}
+		defer func() { _ = rc.Close() }()
+		if _, ok := rc.(ecresolver.ConcurrentReaderAt); !ok {
+			t.Fatal("reader does not read ranges concurrently")
+		}
+		err = ctrcontent.Copy(ctx, w, rc, desc.Size, desc.Digest)
+		registry.lock.Lock()
+		defer registry.lock.Unlock()
+		return registry.requests, err
+	}
+	// check the contents of the file, and that each range was requested, from the offset
+	check := func(filename string, expected []byte, requests []string, offset int64) {
+		t.Helper()
+		if b, err := os.ReadFile(filename); err != nil || !bytes.Equal(b, expected) {
+			t.Errorf("mismatched contents, %d bytes, expected %d: %v", len(b), len(expected), err)
+		}
+		ranges := strings.Join(requests, ",")
+		size := (desc.Size - offset + connections - 1) / connections
+		for i := int64(1); i < connections; i++ {
+			if expected := fmt.Sprintf("bytes=%d-", offset+i*size); !strings.Contains(ranges, expected) {
+				t.Errorf("range %s not requested: %v", expected, requests)
+			}
+		}
+	}
+
+	// a file written to anywhere
+	filename := filepath.Join(tmpdir, "blob")
+	requests, err := pull(filename, os.O_RDWR, false, nil)
+	if err != nil {
+		t.Fatalf("unable to pull: %v", err)
+	}
+	check(filename, blob, requests, 0)
+	if len(requests) != connections {
+		t.Errorf("mismatched requests, actual %d expected %d: %v", len(requests), connections, requests)
+	}
+
+	// a file opened to append, as pullfiles does, is written after what already is in it
+	filename = filepath.Join(tmpdir, "appended")
+	header := []byte("header;")
+	if err := os.WriteFile(filename, header, 0644); err != nil {
+		t.Fatalf("unable to write header: %v", err)
+	}
+	if requests, err = pull(filename, os.O_APPEND|os.O_WRONLY, true, nil); err != nil {
+		t.Fatalf("unable to pull: %v", err)
+	}
+	check(filename, append(append([]byte{}, header...), blob...), requests, 0)
+
+	// a pull that fails keeps what follows on from the start, and the next continues from there
+	filename = filepath.Join(tmpdir, "failed")
+	if _, err := pull(filename, os.O_RDWR, false, []string{"ok", "503"}); err == nil {
+		t.Fatal("pull did not fail")
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatalf("unable to get info: %v", err)
+	}
+	if info.Size() >= desc.Size {
+		t.Errorf("kept %d bytes, expected less than the blob", info.Size())
+	}
+	if requests, err = pull(filename, os.O_RDWR, false, nil); err != nil {
+		t.Fatalf("unable to continue pull: %v", err)
+	}
+	check(filename, blob, requests, info.Size())
+	if _, err := os.Stat(filename + ecresolver.PartialSuffix); err == nil {
+		t.Error("partial state not removed")
+	}
+
+	// blobs below the threshold are fetched as they are
+	small := ocispec.Descriptor{MediaType: desc.MediaType, Digest: desc.Digest, Size: part - 1}
+	rc, err := fetcher.Fetch(ctx, small)
+	if err != nil {
+		t.Fatalf("unable to fetch: %v", err)
+	}
+	defer func() { _ = rc.Close() }()
+	if _, ok := rc.(io.ReaderAt); ok {
+		t.Error("small blob fetched in ranges")
+	}
+
+	// with retries below, as a Puller has them, a range that fails is retried, and each range is fetched from
+	// where it starts, without fetching the blob from the start first
+	retry := ecresolver.RetryOptions{Attempts: 3, Backoff: time.Millisecond}
+	if _, r, err = ecresolver.NewRegistryWithOptions(ctx, ecresolver.RegistryOptions{Retry: retry}); err != nil {
+		t.Fatalf("unable to create registry resolver: %v", err)
+	}
+	_, rr, err := ecresolver.NewRetry(ctx, r, retry)
+	if err != nil {
+		t.Fatalf("unable to create retry resolver: %v", err)
+	}
+	if _, pr, err = ecresolver.NewParallel(ctx, rr, ecresolver.ParallelOptions{Threshold: part, Connections: connections}); err != nil {
+		t.Fatalf("unable to create parallel resolver: %v", err)
+	}
+	if fetcher, err = pr.Fetcher(ctx, strings.TrimPrefix(server.URL, "http://")+"/lfedge/eci:current"); err != nil {
+		t.Fatalf("unable to get fetcher: %v", err)
+	}
+	filename = filepath.Join(tmpdir, "retried")
+	if requests, err = pull(filename, os.O_RDWR, false, []string{"", "503"}); err != nil {
+		t.Fatalf("unable to pull with retries: %v", err)
+	}
+	if b, err := os.ReadFile(filename); err != nil || !bytes.Equal(b, blob) {
+		t.Errorf("mismatched contents, %d bytes, expected %d: %v", len(b), len(blob), err)
+	}
+	whole := 0
+	for _, r := range requests {
+		if r == "" {
+			whole++
+		}
+	}
+	if whole != 1 || len(requests) < 3 {
+		t.Errorf("mismatched requests, %d for the whole blob, expected 1, and the failed range again: %v", whole, requests)
+	}
+}
+
+func TestParallelCheckpoint(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "edge-containers-parallel")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+	t.Setenv("DOCKER_CONFIG", tmpdir)
+
+	// each range larger than the checkpoint
+	blob := bytes.Repeat([]byte("0123456789abcdef"), 2<<20)
+	desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromBytes(blob), Size: int64(len(blob))}
+	const connections = 4
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// a range after the first never arrives, as when the pull is killed partway
+	registry := &flakyRegistry{blob: blob, failures: []string{"", "hang"}}
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	// as a Puller does, with retries below
+	retry := ecresolver.RetryOptions{Attempts: 3, Backoff: time.Millisecond}
+	_, r, err := ecresolver.NewRegistryWithOptions(ctx, ecresolver.RegistryOptions{Retry: retry})
+	if err != nil {
+		t.Fatalf("unable to create registry resolver: %v", err)
+	}
+	_, rr, err := ecresolver.NewRetry(ctx, r, retry)
+	if err != nil {
+		t.Fatalf("unable to create retry resolver: %v", err)
+	}
+	_, pr, err := ecresolver.NewParallel(ctx, rr, ecresolver.ParallelOptions{Threshold: 1, Connections: connections})
+	if err != nil {
+		t.Fatalf("unable to create parallel resolver: %v", err)
+	}
+	fetcher, err := pr.Fetcher(ctx, strings.TrimPrefix(server.URL, "http://")+"/lfedge/eci:current")
+	if err != nil {
+		t.Fatalf("unable to get fetcher: %v", err)
+	}
+	filename := filepath.Join(tmpdir, "blob")
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("unable to open %s: %v", filename, err)
+	}
+	defer func() { _ = file.Close() }()
+	w, err := ecresolver.NewPartialWriter(file, filename+ecresolver.PartialSuffix, desc, false)
+	if err != nil {
+		t.Fatalf("unable to create writer: %v", err)
+	}
+	defer func() { _ = w.Close() }()
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		t.Fatalf("unable to fetch: %v", err)
+	}
+	defer func() { _ = rc.Close() }()
+	done := make(chan error, 1)
+	go func() { done <- ctrcontent.Copy(ctx, w, rc, desc.Size, desc.Digest) }()
+
+	// the state is saved as far as the first range, while the one that never arrives still is being fetched
+	part := desc.Size / connections
+	var state struct {
+		Offset int64 `json:"offset"`
+	}
+	for deadline := time.Now().Add(5 * time.Second); state.Offset < part && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if b, err := os.ReadFile(filename + ecresolver.PartialSuffix); err == nil {
+			_ = json.Unmarshal(b, &state)
+		}
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("copy ended before the range that never arrives: %v", err)
+	default:
+	}
+	if state.Offset < part {
+		t.Errorf("state saved at %d, expected at least %d", state.Offset, part)
+	}
+	cancel()
+	if err := <-done; err == nil {
+		t.Error("copy did not fail")
+	}
+}
@@ -0,0 +1,459 @@
+package resolver
+
+/*
+ Provides a github.com/containerd/containerd/content#Writer that writes a blob to a file, keeping a small
+ state file beside it, so that when the write stops partway, e.g. the pull is interrupted or the device
+ reboots, a later write of the same blob continues from where it stopped, rather than starting over.
+
+ The writer reports where it continues from in its Status, so that content.Copy moves the reader of the blob
+ there, which for a registry is a range request. The state holds the digester as of the last bytes synced
+ to the file, so the full digest still is verified on commit without reading back what already was written.
+ The blob from a reader that reads ranges of it concurrently, e.g. that of a Parallel resolver, is written in
+ several ranges at once, each where it goes in the file, and hashed from the file once they are complete.
+*/
+
+import (
+	"context"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// PartialSuffix the suffix of the state file kept beside a partially written file
+	PartialSuffix = ".partial"
+	// partialCheckpoint how many bytes are written between syncing the file and saving its state
+	partialCheckpoint = 8 << 20
+)
+
+// partialState the state of a blob partially written to a file
+type partialState struct {
+	Digest digest.Digest `json:"digest"`
+	Size   int64         `json:"size"`
+	// Start where in the file the blob starts
+	Start int64 `json:"start"`
+	// Offset how much of the blob is written, and synced, to the file
+	Offset int64 `json:"offset"`
+	// Hash the state of the digester after Offset bytes
+	Hash []byte `json:"hash"`
+}
+
+// PartialWriter writer of a blob to a file, that continues from where an earlier write of the same blob stopped
+type PartialWriter struct {
+	file      *os.File
+	stateFile string
+	desc      ocispec.Descriptor
+	digester  digest.Digester
+	start     int64
+	offset    int64
+	// unsaved bytes written since the state last was saved
+	unsaved int64
+	closed  bool
+	started time.Time
+	updated time.Time
+}
+
+// NewPartialWriter create a writer of the blob in desc to the file, which must be open for writing, keeping its
+// state in stateFile. If the state is that of an earlier write of the same blob, the write continues from where
+// that one stopped. Otherwise the blob is written from the start of the file, replacing anything in it, or,
+// if appending, after whatever already is in it. An empty stateFile keeps no state, so the write cannot continue.
+// The file is not closed by the writer.
+//
+// When appending to a file that already ends with the blob, e.g. when a pull that wrote it is run again,
+// returns ErrAlreadyExists, rather than appending it a second time.
+func NewPartialWriter(file *os.File, stateFile string, desc ocispec.Descriptor, appending bool) (*PartialWriter, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid digest %s: %v", desc.Digest, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("could not get info for %s: %v", file.Name(), err)
+	}
+	now := time.Now()
+	w := &PartialWriter{
+		file:      file,
+		stateFile: stateFile,
+		desc:      desc,
+		digester:  desc.Digest.Algorithm().Digester(),
+		started:   now,
+		updated:   now,
+	}
+	if appending {
+		w.start = info.Size()
+	}
+	state, err := readPartialState(stateFile)
+	switch {
+	case err != nil:
+		return nil, err
+	case state == nil:
+		if appending && w.committed(info) {
+			return nil, fmt.Errorf("blob %s in %s: %w", desc.Digest, file.Name(), errdefs.ErrAlreadyExists)
+		}
+	case !w.resume(state, info.Size()):
+		// whatever an earlier write left incomplete is replaced
+		if state.Start >= 0 && state.Start <= info.Size() {
+			w.start = state.Start
+		}
+		if err := os.Remove(stateFile); err != nil {
+			return nil, fmt.Errorf("could not remove partial state %s: %v", stateFile, err)
+		}
+	}
+	// anything after what was synced is not known to be valid
+	if err := file.Truncate(w.start + w.offset); err != nil {
+		return nil, fmt.Errorf("could not truncate %s: %v", file.Name(), err)
+	}
+	if _, err := file.Seek(w.start+w.offset, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("could not seek in %s: %v", file.Name(), err)
+	}
+	return w, nil
+}
+
+// resume continue from the state, if it is of the same blob and still valid for a file of the given size
+func (w *PartialWriter) resume(state *partialState, size int64) bool {
+	if state.Digest != w.desc.Digest || state.Size != w.desc.Size || state.Start < 0 || state.Offset < 0 ||
+		(w.desc.Size > 0 && state.Offset > w.desc.Size) || state.Start+state.Offset > size {
+		return false
+	}
+	unmarshaler, ok := w.digester.Hash().(encoding.BinaryUnmarshaler)
+	if !ok || unmarshaler.UnmarshalBinary(state.Hash) != nil {
+		w.digester = w.desc.Digest.Algorithm().Digester()
+		return false
+	}
+	w.start, w.offset = state.Start, state.Offset
+	return true
+}
+
+// committed whether the file, of the info, already ends with the blob, as it does once an appending write of it
+// is committed, reading back the end of the file
+func (w *PartialWriter) committed(info os.FileInfo) bool {
+	if info.Size() < w.desc.Size {
+		return false
+	}
+	file, err := os.Open(w.file.Name())
+	if err != nil {
+		return false
+	}
+	defer func() { _ = file.Close() }()
+	if reopened, err := file.Stat(); err != nil || !os.SameFile(reopened, info) {
+		return false
+	}
+	digester := w.desc.Digest.Algorithm().Digester()
+	if _, err := io.Copy(digester.Hash(), io.NewSectionReader(file, info.Size()-w.desc.Size, w.desc.Size)); err != nil {
+		return false
+	}
+	return digester.Digest() == w.desc.Digest
+}
+
+// readPartialState read the state in the file, nil if there is none or it is not valid
+func readPartialState(stateFile string) (*partialState, error) {
+	if stateFile == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(stateFile)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("could not read partial state %s: %v", stateFile, err)
+	}
+	var state partialState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return &partialState{Start: -1}, nil
+	}
+	return &state, nil
+}
+
+// save sync the file and save the state, so that a later write continues from here
+func (w *PartialWriter) save() error {
+	if w.stateFile == "" {
+		return nil
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("could not sync %s: %v", w.file.Name(), err)
+	}
+	marshaler, ok := w.digester.Hash().(encoding.BinaryMarshaler)
+	if !ok {
+		return nil
+	}
+	hash, err := marshaler.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("could not save digester state: %v", err)
+	}
+	b, err := json.Marshal(partialState{Digest: w.desc.Digest, Size: w.desc.Size, Start: w.start, Offset: w.offset, Hash: hash})
+	if err != nil {
+		return fmt.Errorf("could not convert partial state to json: %v", err)
+	}
+	// replaced atomically, so that it always matches what was synced
+	tmp, err := os.CreateTemp(filepath.Dir(w.stateFile), filepath.Base(w.stateFile)+"-*")
+	if err != nil {
+		return fmt.Errorf("could not create partial state %s: %v", w.stateFile, err)
+	}
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), w.stateFile)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("could not write partial state %s: %v", w.stateFile, err)
+	}
+	w.unsaved = 0
+	return nil
+}
+
+// discard remove whatever was written, and the state
+func (w *PartialWriter) discard() error {
+	w.digester = w.desc.Digest.Algorithm().Digester()
+	w.offset, w.unsaved = 0, 0
+	if w.stateFile != "" {
+		if err := os.Remove(w.stateFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("could not remove partial state %s: %v", w.stateFile, err)
+		}
+	}
+	if err := w.file.Truncate(w.start); err != nil {
+		return fmt.Errorf("could not truncate %s: %v", w.file.Name(), err)
+	}
+	if _, err := w.file.Seek(w.start, io.SeekStart); err != nil {
+		return fmt.Errorf("could not seek in %s: %v", w.file.Name(), err)
+	}
+	return nil
+}
+
+// Digest the digest of the blob being written
+func (w *PartialWriter) Digest() digest.Digest {
+	return w.desc.Digest
+}
+
+// Close closes the writer; if it was not committed, whatever was written is kept, so that a later write
+// continues from it. The file itself is not closed.
+func (w *PartialWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.offset == 0 {
+		return w.discard()
+	}
+	return w.save()
+}
+
+func (w *PartialWriter) Write(p []byte) (n int, err error) {
+	if w.closed {
+		return 0, fmt.Errorf("writer for %s is closed", w.desc.Digest)
+	}
+	n, err = w.file.Write(p)
+	_, _ = w.digester.Hash().Write(p[:n])
+	w.offset += int64(n)
+	w.unsaved += int64(n)
+	w.updated = time.Now()
+	if err == nil && w.unsaved >= partialCheckpoint {
+		err = w.save()
+	}
+	return n, err
+}
+
+// ReadFrom writes the rest of the blob from r. When r is a ConcurrentReaderAt, e.g. a reader of a Parallel resolver,
+// the rest is split in as many ranges as it reads at once, each written to where it goes in the file, and hashed
+// from the file, and saved, as far as it follows on from the blob so far. Of ranges that fail, only that is kept.
+func (w *PartialWriter) ReadFrom(r io.Reader) (int64, error) {
+	ra, ok := r.(ConcurrentReaderAt)
+	if !ok || w.closed || ra.Concurrency() < 2 || w.desc.Size-w.offset < int64(ra.Concurrency()) {
+		return io.Copy(struct{ io.Writer }{w}, r)
+	}
+	file, err := w.positional()
+	if err != nil {
+		return io.Copy(struct{ io.Writer }{w}, r)
+	}
+	if file != w.file {
+		defer func() { _ = file.Close() }()
+	}
+
+	from, connections := w.offset, int64(ra.Concurrency())
+	part := (w.desc.Size - from + connections - 1) / connections
+	written := make([]int64, connections)
+	errs := make([]error, connections)
+	var (
+		wg     sync.WaitGroup
+		failed atomic.Bool
+		// lock guards written, and the offset and digester as the blob so far is advanced
+		lock sync.Mutex
+	)
+	// contiguous how much of the rest of the blob follows on from the blob so far, as far as the ranges are
+	// complete, in order
+	contiguous := func() int64 {
+		done := int64(0)
+		for i := int64(0); i < connections; i++ {
+			done += written[i]
+			if written[i] < min(part, max(w.desc.Size-from-i*part, 0)) {
+				break
+			}
+		}
+		return done
+	}
+	// advance the blob so far to what follows on from it, hashing that from the file
+	advance := func() error {
+		n, err := io.Copy(w.digester.Hash(), io.NewSectionReader(file, w.start+w.offset, from+contiguous()-w.offset))
+		w.offset += n
+		w.unsaved += n
+		w.updated = time.Now()
+		if err != nil {
+			return fmt.Errorf("could not read back %s: %v", file.Name(), err)
+		}
+		return nil
+	}
+	for i := int64(0); i < connections; i++ {
+		start, end := from+i*part, min(from+(i+1)*part, w.desc.Size)
+		if start >= end {
+			break
+		}
+		wg.Add(1)
+		go func(i, start, end int64) {
+			defer wg.Done()
+			buf := make([]byte, min(end-start, 1<<20))
+			for off := start; off < end && !failed.Load(); {
+				n, err := ra.ReadAt(buf[:min(int64(len(buf)), end-off)], off)
+				if n > 0 {
+					if _, writeErr := file.WriteAt(buf[:n], w.start+off); writeErr != nil {
+						err = fmt.Errorf("could not write to %s: %v", file.Name(), writeErr)
+					} else {
+						off += int64(n)
+						// the blob so far is saved as it grows, as with Write, so that a write that is killed
+						// continues from there
+						lock.Lock()
+						written[i] += int64(n)
+						if from+contiguous()-w.offset >= partialCheckpoint {
+							if saveErr := advance(); saveErr != nil {
+								err = saveErr
+							} else if saveErr := w.save(); saveErr != nil {
+								err = saveErr
+							}
+						}
+						lock.Unlock()
+					}
+				}
+				if err != nil && (!errors.Is(err, io.EOF) || off < end) {
+					errs[i] = err
+					failed.Store(true)
+					return
+				}
+			}
+		}(i, start, end)
+	}
+	wg.Wait()
+
+	// the blob continues only as far as the ranges are complete, in order
+	err = errors.Join(append(errs, advance())...)
+	if truncErr := w.file.Truncate(w.start + w.offset); truncErr != nil {
+		return w.offset - from, errors.Join(err, fmt.Errorf("could not truncate %s: %v", w.file.Name(), truncErr))
+	}
+	if _, seekErr := w.file.Seek(w.start+w.offset, io.SeekStart); seekErr != nil {
+		return w.offset - from, errors.Join(err, fmt.Errorf("could not seek in %s: %v", w.file.Name(), seekErr))
+	}
+	if w.unsaved > 0 {
+		err = errors.Join(err, w.save())
+	}
+	return w.offset - from, err
+}
+
+// positional the file, to write and read back at any offset; one that was opened to append, or only to write,
+// e.g. as pullfiles does, is opened again
+func (w *PartialWriter) positional() (*os.File, error) {
+	_, writeErr := w.file.WriteAt(nil, 0)
+	_, readErr := w.file.ReadAt(make([]byte, 1), 0)
+	if writeErr == nil && (readErr == nil || errors.Is(readErr, io.EOF)) {
+		return w.file, nil
+	}
+	file, err := os.OpenFile(w.file.Name(), os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err == nil {
+		var original os.FileInfo
+		if original, err = w.file.Stat(); err == nil && !os.SameFile(info, original) {
+			err = fmt.Errorf("%s is no longer the file being written", w.file.Name())
+		}
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// Commit commits the blob, once it is verified to match the size and digest it was written with,
+// as well as those passed, if any, and syncs it to disk. A blob that does not match is discarded.
+// The state is removed.
+// size and expected can be zero-value when unknown.
+// Commit always closes the writer, even on error.
+func (w *PartialWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+	if w.closed {
+		return fmt.Errorf("writer for %s is closed", w.desc.Digest)
+	}
+	w.closed = true
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("could not sync %s: %v", w.file.Name(), err)
+	}
+	if size == 0 {
+		size = w.desc.Size
+	}
+	actual := w.digester.Digest()
+	var err error
+	switch {
+	case size > 0 && w.offset != size:
+		err = fmt.Errorf("unexpected commit size %d, expected %d: %w", w.offset, size, errdefs.ErrFailedPrecondition)
+	case expected != "" && actual != expected:
+		err = fmt.Errorf("unexpected commit digest %s, expected %s: %w", actual, expected, errdefs.ErrFailedPrecondition)
+	case actual != w.desc.Digest:
+		err = fmt.Errorf("unexpected commit digest %s, expected %s: %w", actual, w.desc.Digest, errdefs.ErrFailedPrecondition)
+	}
+	if err != nil {
+		if discardErr := w.discard(); discardErr != nil {
+			return fmt.Errorf("%w; %v", err, discardErr)
+		}
+		return err
+	}
+	if w.stateFile != "" {
+		if err := os.Remove(w.stateFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("could not remove partial state %s: %v", w.stateFile, err)
+		}
+	}
+	return nil
+}
+
+// Status returns the current state of write; its offset is where a write that continues an earlier one starts
+func (w *PartialWriter) Status() (content.Status, error) {
+	return content.Status{
+		Ref:       w.file.Name(),
+		Offset:    w.offset,
+		Total:     w.desc.Size,
+		Expected:  w.desc.Digest,
+		StartedAt: w.started,
+		UpdatedAt: w.updated,
+	}, nil
+}
+
+// Truncate discards whatever was written, when size is 0; no other size is supported
+func (w *PartialWriter) Truncate(size int64) error {
+	if size != 0 {
+		return fmt.Errorf("unsupported")
+	}
+	return w.discard()
+}
@@ -0,0 +1,124 @@
+package resolver_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	ecresolver "github.com/lf-edge/edge-containers/pkg/resolver"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestPartialWriter(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "edge-containers-partial")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+
+	blob := []byte("a partially written layer")
+	other := []byte("another layer")
+	desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromBytes(blob), Size: int64(len(blob))}
+	otherDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromBytes(other), Size: int64(len(other))}
+	half := len(blob) / 2
+
+	// write opens the file, and writes the blob to it, returning where it continued from, and the commit error
+	write := func(filename string, desc ocispec.Descriptor, b []byte, appending, commit bool) (int64, error) {
+		t.Helper()
+		file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatalf("unable to open %s: %v", filename, err)
+		}
+		defer func() { _ = file.Close() }()
+		w, err := ecresolver.NewPartialWriter(file, filename+ecresolver.PartialSuffix, desc, appending)
+		if err != nil {
+			return 0, err
+		}
+		status, err := w.Status()
+		if err != nil {
+			t.Fatalf("unable to get status: %v", err)
+		}
+		if _, err := w.Write(b[status.Offset:]); err != nil {
+			t.Fatalf("unable to write: %v", err)
+		}
+		if !commit {
+			return status.Offset, w.Close()
+		}
+		return status.Offset, w.Commit(context.TODO(), desc.Size, desc.Digest)
+	}
+	check := func(filename string, expected []byte, state bool) {
+		t.Helper()
+		if b, err := os.ReadFile(filename); err != nil || !bytes.Equal(b, expected) {
+			t.Errorf("mismatched contents, actual %q expected %q: %v", b, expected, err)
+		}
+		if _, err := os.Stat(filename + ecresolver.PartialSuffix); (err == nil) != state {
+			t.Errorf("state exists %v, expected %v", err == nil, state)
+		}
+	}
+
+	filename := filepath.Join(tmpdir, "blob")
+	if _, err := write(filename, desc, blob[:half], false, false); err != nil {
+		t.Fatalf("unable to write first half: %v", err)
+	}
+	check(filename, blob[:half], true)
+	offset, err := write(filename, desc, blob, false, true)
+	switch {
+	case err != nil:
+		t.Fatalf("unable to continue: %v", err)
+	case offset != int64(half):
+		t.Errorf("mismatched offset, actual %d expected %d", offset, half)
+	}
+	check(filename, blob, false)
+
+	// the state of another blob, or that is not valid, starts over
+	if _, err := write(filename, desc, blob[:half], false, false); err != nil {
+		t.Fatalf("unable to write first half: %v", err)
+	}
+	if offset, err := write(filename, otherDesc, other, false, true); err != nil || offset != 0 {
+		t.Errorf("other blob: mismatched offset %d, expected 0: %v", offset, err)
+	}
+	check(filename, other, false)
+	if _, err := write(filename, desc, blob[:half], false, false); err != nil {
+		t.Fatalf("unable to write first half: %v", err)
+	}
+	if err := os.WriteFile(filename+ecresolver.PartialSuffix, []byte("{"), 0644); err != nil {
+		t.Fatalf("unable to corrupt state: %v", err)
+	}
+	if offset, err := write(filename, desc, blob, false, true); err != nil || offset != 0 {
+		t.Errorf("invalid state: mismatched offset %d, expected 0: %v", offset, err)
+	}
+	check(filename, blob, false)
+
+	// a blob that does not match is discarded
+	if _, err := write(filename, desc, []byte("a partially written lAyer"), false, true); !errors.Is(err, errdefs.ErrFailedPrecondition) {
+		t.Errorf("mismatched errors, actual %v expected %v", err, errdefs.ErrFailedPrecondition)
+	}
+	check(filename, nil, false)
+
+	// appending keeps what already is in the file, and does not append a blob the file already ends with
+	filename = filepath.Join(tmpdir, "appended")
+	header := []byte("header;")
+	if err := os.WriteFile(filename, header, 0644); err != nil {
+		t.Fatalf("unable to write header: %v", err)
+	}
+	if _, err := write(filename, desc, blob[:half], true, false); err != nil {
+		t.Fatalf("unable to write first half: %v", err)
+	}
+	if offset, err := write(filename, desc, blob, true, true); err != nil || offset != int64(half) {
+		t.Errorf("appending: mismatched offset %d, expected %d: %v", offset, half, err)
+	}
+	check(filename, append(header, blob...), false)
+	if _, err := write(filename, desc, blob, true, true); !errors.Is(err, errdefs.ErrAlreadyExists) {
+		t.Errorf("appending again: mismatched errors, actual %v expected %v", err, errdefs.ErrAlreadyExists)
+	}
+	if _, err := write(filename, otherDesc, other, true, true); err != nil {
+		t.Errorf("unable to append another blob: %v", err)
+	}
+	check(filename, append(append(header, blob...), other...), false)
+}
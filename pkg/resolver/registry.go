@@ -2,33 +2,239 @@ package resolver
 
 /*
  Provides a github.com/containerd/containerd/remotes#Resolver that resolves
- to a containerd socket
+ to a registry
 
 */
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
 
 	"github.com/containerd/containerd/remotes"
-	auth "oras.land/oras-go/pkg/auth/docker"
+	"github.com/containerd/containerd/remotes/docker"
 )
 
+// registry options, as the query of a registry remote
+const (
+	registryOptionPlainHTTP = "plain-http"
+	registryOptionInsecure  = "insecure"
+	registryOptionCAFile    = "ca-file"
+	registryOptionCert      = "cert"
+	registryOptionKey       = "key"
+)
+
+// RegistryOptions how to connect to a registry
+type RegistryOptions struct {
+	// PlainHTTP use http rather than https for every registry. Registries on localhost always use http,
+	// unless a Client or any of the TLS options are set.
+	PlainHTTP bool `json:"plainHTTP,omitempty"`
+	// Insecure do not verify the certificate of the registry
+	Insecure bool `json:"insecure,omitempty"`
+	// CAFile PEM file of certificate authorities to trust, in addition to those of the system
+	CAFile string `json:"caFile,omitempty"`
+	// CertFile and KeyFile PEM files of the client certificate and its key, to authenticate with TLS
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	// Client http client to use, instead of one configured by the TLS options
+	Client *http.Client `json:"-"`
+	// AuthConfig docker config file with the stored credentials, by default the one used by docker
+	AuthConfig string `json:"authConfig,omitempty"`
+	// Credentials explicit credentials, used instead of the stored credentials for every host they are given for
+	Credentials Credentials `json:"-"`
+	// Retry how to retry requests that fail with a transient error, e.g. an http status 429 or 503
+	Retry RetryOptions `json:"-"`
+	// ChunkSize upload blobs in chunks of this many bytes, continuing an upload that stops partway from the last
+	// chunk the registry has; 0 uploads each blob in a single request
+	ChunkSize int64 `json:"chunkSize,omitempty"`
+	// UploadState directory to record the chunked uploads in progress, so that a later push continues them too;
+	// empty continues them only within the same Registry
+	UploadState string `json:"uploadState,omitempty"`
+}
+
+// LoadRegistryOptions read the options from a json file, e.g. {"caFile": "/etc/eci/ca.pem"}
+func LoadRegistryOptions(path string) (RegistryOptions, error) {
+	var opts RegistryOptions
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return opts, fmt.Errorf("unable to read registry options %s: %v", path, err)
+	}
+	if err := json.Unmarshal(b, &opts); err != nil {
+		return opts, fmt.Errorf("invalid registry options %s: %v", path, err)
+	}
+	return opts, nil
+}
+
+// registryOptionsKey the context key of the registry options
+type registryOptionsKey struct{}
+
+// WithRegistryOptions the context with the options for the registry remotes opened with it by Open.
+// Options in the query of a remote take precedence.
+func WithRegistryOptions(ctx context.Context, opts RegistryOptions) context.Context {
+	return context.WithValue(ctx, registryOptionsKey{}, opts)
+}
+
+// registryOptionsFromContext the registry options of the context, if any
+func registryOptionsFromContext(ctx context.Context) RegistryOptions {
+	opts, _ := ctx.Value(registryOptionsKey{}).(RegistryOptions)
+	return opts
+}
+
+// withQuery the options, with those in the query of a registry remote instead
+func (o RegistryOptions) withQuery(uri *url.URL) (RegistryOptions, error) {
+	query := uri.Query()
+	for option, value := range map[string]*string{registryOptionCAFile: &o.CAFile, registryOptionCert: &o.CertFile, registryOptionKey: &o.KeyFile} {
+		if _, ok := query[option]; ok {
+			*value = query.Get(option)
+		}
+	}
+	for option, value := range map[string]*bool{registryOptionPlainHTTP: &o.PlainHTTP, registryOptionInsecure: &o.Insecure} {
+		if s := query.Get(option); s != "" {
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return o, fmt.Errorf("invalid option %s=%s for remote %s", option, s, uri.Redacted())
+			}
+			*value = b
+		}
+	}
+	return o, nil
+}
+
+// tls whether any of the TLS options are set
+func (o RegistryOptions) tls() bool {
+	return o.Insecure || o.CAFile != "" || o.CertFile != "" || o.KeyFile != ""
+}
+
+// httpClient the http client for the options, retrying requests as needed; nil is the default client
+func (o RegistryOptions) httpClient() (*http.Client, error) {
+	client, err := o.tlsClient()
+	if err != nil || o.Retry.Attempts <= 0 {
+		return client, err
+	}
+	retrying := &http.Client{}
+	if client != nil {
+		*retrying = *client
+	}
+	base := retrying.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	retrying.Transport = retryTransport{base: base, opts: o.Retry}
+	return retrying, nil
+}
+
+// tlsClient the http client for the TLS options; nil is the default client
+func (o RegistryOptions) tlsClient() (*http.Client, error) {
+	if o.Client != nil {
+		if o.tls() {
+			return nil, errors.New("cannot set TLS options with a custom http client")
+		}
+		return o.Client, nil
+	}
+	if !o.tls() {
+		return nil, nil
+	}
+	if o.PlainHTTP {
+		return nil, errors.New("cannot set TLS options with plain http")
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: o.Insecure} //nolint:gosec // explicitly requested
+	if o.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		b, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA file: %v", err)
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates in CA file %s", o.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return nil, errors.New("client certificate and key must be set together")
+	}
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
+
 type Registry struct {
 	remotes.Resolver
-	ctx context.Context
+	ctx       context.Context
+	hosts     docker.RegistryHosts
+	chunkSize int64
+	uploads   *uploadSessions
 }
 
+// NewRegistry create a resolver for the registry given by each image name, with the default options
 func NewRegistry(ctx context.Context) (context.Context, *Registry, error) {
-	cli, err := auth.NewClient()
+	return NewRegistryWithOptions(ctx, RegistryOptions{})
+}
+
+// NewRegistryWithOptions create a resolver for the registry given by each image name, connecting with the options
+func NewRegistryWithOptions(ctx context.Context, opts RegistryOptions) (context.Context, *Registry, error) {
+	stored, err := opts.authClient()
 	if err != nil {
 		return nil, nil, fmt.Errorf("unable to get authenticating client to registry: %v", err)
 	}
-	resolver, err := cli.Resolver(ctx, nil, false)
+	creds := stored.Credential
+	if opts.Credentials != nil {
+		creds = func(host string) (string, string, error) {
+			username, secret, err := opts.Credentials(host)
+			if err != nil || username != "" || secret != "" {
+				return username, secret, err
+			}
+			return stored.Credential(host)
+		}
+	}
+	client, err := opts.httpClient()
 	if err != nil {
-		return nil, nil, fmt.Errorf("unable to get resolver for registry: %v", err)
+		return nil, nil, fmt.Errorf("invalid registry options: %v", err)
+	}
+	// registries on localhost use plain http, unless given a client or TLS options, e.g. for a local test registry
+	plainHTTP := docker.MatchLocalhost
+	switch {
+	case opts.PlainHTTP:
+		plainHTTP = docker.MatchAllHosts
+	case opts.Client != nil || opts.tls():
+		plainHTTP = func(string) (bool, error) { return false, nil }
+	}
+	if opts.ChunkSize < 0 {
+		return nil, nil, fmt.Errorf("invalid chunk size %d", opts.ChunkSize)
+	}
+	hosts := docker.ConfigureDefaultRegistries(
+		docker.WithAuthorizer(docker.NewDockerAuthorizer(docker.WithAuthClient(client), docker.WithAuthCreds(creds))),
+		docker.WithClient(client),
+		docker.WithPlainHTTP(plainHTTP),
+	)
+	resolver := docker.NewResolver(docker.ResolverOptions{Hosts: hosts})
+	return ctx, &Registry{Resolver: resolver, ctx: ctx, hosts: hosts, chunkSize: opts.ChunkSize, uploads: newUploadSessions(opts.UploadState)}, nil
+}
+
+// Pusher get a pusher for the image; with a chunk size, its blobs are uploaded in chunks, continuing an upload
+// that stopped partway
+func (r *Registry) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	pusher, err := r.Resolver.Pusher(ctx, ref)
+	if err != nil || r.chunkSize == 0 {
+		return pusher, err
 	}
-	return ctx, &Registry{Resolver: resolver, ctx: ctx}, nil
+	return newChunkedPusher(pusher, r.hosts, ref, r.chunkSize, r.uploads)
 }
 
 func (r *Registry) Finalize(ctx context.Context) error {
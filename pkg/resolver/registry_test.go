@@ -0,0 +1,213 @@
+package resolver_test
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ecresolver "github.com/lf-edge/edge-containers/pkg/resolver"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// registryHandler a registry with the single manifest lfedge/eci:current
+func registryHandler() (http.Handler, digest.Digest) {
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json"}`)
+	dgst := digest.FromBytes(manifest)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/lfedge/eci/manifests/current" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.Header().Set("Content-Length", fmt.Sprint(len(manifest)))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(manifest)
+		}
+	}), dgst
+}
+
+func TestRegistryOptions(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "edge-containers-registry")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+	// a non-default docker config, so the test does not depend on the credentials of the user
+	t.Setenv("DOCKER_CONFIG", tmpdir)
+
+	handler, dgst := registryHandler()
+	tlsServer := httptest.NewTLSServer(handler)
+	defer tlsServer.Close()
+	plainServer := httptest.NewServer(handler)
+	defer plainServer.Close()
+
+	caFile := filepath.Join(tmpdir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsServer.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0o644); err != nil {
+		t.Fatalf("unable to write CA file: %v", err)
+	}
+	configFile := filepath.Join(tmpdir, "registry.json")
+	if err := os.WriteFile(configFile, []byte(fmt.Sprintf(`{"caFile": %q}`, caFile)), 0o644); err != nil {
+		t.Fatalf("unable to write registry options: %v", err)
+	}
+	fromFile, err := ecresolver.LoadRegistryOptions(configFile)
+	if err != nil {
+		t.Fatalf("unable to load registry options: %v", err)
+	}
+	if fromFile.CAFile != caFile {
+		t.Errorf("mismatched CA file, actual %s expected %s", fromFile.CAFile, caFile)
+	}
+
+	host := func(s *httptest.Server) string {
+		return strings.TrimPrefix(strings.TrimPrefix(s.URL, "https://"), "http://")
+	}
+	tests := []struct {
+		name   string
+		server *httptest.Server
+		opts   ecresolver.RegistryOptions
+		valid  bool
+	}{
+		{"default", tlsServer, ecresolver.RegistryOptions{}, false},
+		{"ca file", tlsServer, fromFile, true},
+		{"insecure", tlsServer, ecresolver.RegistryOptions{Insecure: true}, true},
+		{"client", tlsServer, ecresolver.RegistryOptions{Client: tlsServer.Client()}, true},
+		{"plain http to tls", tlsServer, ecresolver.RegistryOptions{PlainHTTP: true}, false},
+		{"localhost", plainServer, ecresolver.RegistryOptions{}, true},
+		{"plain http", plainServer, ecresolver.RegistryOptions{PlainHTTP: true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, r, err := ecresolver.NewRegistryWithOptions(context.TODO(), tt.opts)
+			if err != nil {
+				t.Fatalf("unable to create registry resolver: %v", err)
+			}
+			_, desc, err := r.Resolve(context.TODO(), host(tt.server)+"/lfedge/eci:current")
+			switch {
+			case tt.valid && err != nil:
+				t.Fatalf("unable to resolve: %v", err)
+			case !tt.valid && err == nil:
+				t.Fatal("resolve did not fail")
+			case tt.valid && desc.Digest != dgst:
+				t.Errorf("mismatched digest, actual %s expected %s", desc.Digest, dgst)
+			}
+		})
+	}
+
+	// the same options as a remote, or on the context it is opened with
+	query := url.Values{"ca-file": {caFile}}
+	for _, remote := range []struct {
+		ctx context.Context
+		uri string
+	}{
+		{context.TODO(), "?" + query.Encode()},
+		{ecresolver.WithRegistryOptions(context.TODO(), fromFile), ""},
+		{ecresolver.WithRegistryOptions(context.TODO(), ecresolver.RegistryOptions{PlainHTTP: true}), "?plain-http=false&" + query.Encode()},
+	} {
+		_, r, err := ecresolver.Open(remote.ctx, remote.uri)
+		if err != nil {
+			t.Fatalf("%s: unable to open registry remote: %v", remote.uri, err)
+		}
+		if _, _, err := r.Resolve(context.TODO(), host(tlsServer)+"/lfedge/eci:current"); err != nil {
+			t.Errorf("%s: unable to resolve with registry remote: %v", remote.uri, err)
+		}
+	}
+
+	for _, opts := range []ecresolver.RegistryOptions{
+		{CertFile: caFile},
+		{CAFile: filepath.Join(tmpdir, "missing.pem")},
+		{CAFile: configFile},
+		{PlainHTTP: true, Insecure: true},
+		{Client: http.DefaultClient, CAFile: caFile},
+	} {
+		if _, _, err := ecresolver.NewRegistryWithOptions(context.TODO(), opts); err == nil {
+			t.Errorf("%+v: create did not fail", opts)
+		}
+	}
+	for _, uri := range []string{"?insecure=maybe", "?namespace=eve"} {
+		if _, _, err := ecresolver.Open(context.TODO(), uri); err == nil {
+			t.Errorf("%s: open did not fail", uri)
+		}
+	}
+}
+
+func TestRegistryCredentials(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "edge-containers-login")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+
+	handler, _ := registryHandler()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "eve" || password != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	ref := host + "/lfedge/eci:current"
+	stored := ecresolver.RegistryOptions{AuthConfig: filepath.Join(tmpdir, "config.json")}
+
+	resolve := func(opts ecresolver.RegistryOptions) error {
+		_, r, err := ecresolver.NewRegistryWithOptions(context.TODO(), opts)
+		if err != nil {
+			t.Fatalf("unable to create registry resolver: %v", err)
+		}
+		_, _, err = r.Resolve(context.TODO(), ref)
+		return err
+	}
+
+	if err := resolve(stored); err == nil {
+		t.Error("resolve without credentials did not fail")
+	}
+	if err := resolve(ecresolver.RegistryOptions{Credentials: ecresolver.StaticCredentials(host, "eve", "secret")}); err != nil {
+		t.Errorf("unable to resolve with explicit credentials: %v", err)
+	}
+	// explicit credentials are only for their registry
+	if err := resolve(ecresolver.RegistryOptions{Credentials: ecresolver.StaticCredentials("registry.example.com", "eve", "secret")}); err == nil {
+		t.Error("resolve with explicit credentials for another registry did not fail")
+	}
+
+	if err := ecresolver.Login(context.TODO(), host, "eve", "wrong", stored); err == nil {
+		t.Error("login with wrong password did not fail")
+	}
+	if err := ecresolver.Login(context.TODO(), host, "eve", "secret", stored); err != nil {
+		t.Fatalf("unable to log in: %v", err)
+	}
+	if err := resolve(stored); err != nil {
+		t.Errorf("unable to resolve with stored credentials: %v", err)
+	}
+	// explicit credentials take precedence over those stored
+	stored.Credentials = ecresolver.StaticCredentials(host, "eve", "wrong")
+	if err := resolve(stored); err == nil {
+		t.Error("resolve with wrong explicit credentials did not fail")
+	}
+	stored.Credentials = nil
+
+	if err := ecresolver.Logout(context.TODO(), host, stored); err != nil {
+		t.Fatalf("unable to log out: %v", err)
+	}
+	if err := resolve(stored); err == nil {
+		t.Error("resolve after logout did not fail")
+	}
+	if err := ecresolver.Logout(context.TODO(), host, stored); !errors.Is(err, ecresolver.ErrNotLoggedIn) {
+		t.Errorf("mismatched error logging out again, actual %v expected %v", err, ecresolver.ErrNotLoggedIn)
+	}
+}
@@ -0,0 +1,407 @@
+package resolver
+
+/*
+ Provides a github.com/containerd/containerd/remotes#Resolver that retries transfers from
+ an existing resolver that fail, or stall, partway, continuing each blob from where it stopped,
+ and an http.RoundTripper that retries registry requests that fail with a transient error.
+
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/remotes"
+	remoteserrors "github.com/containerd/containerd/remotes/errors"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// DefaultRetryBackoff the delay before the first retry, unless set
+	DefaultRetryBackoff = time.Second
+	// DefaultRetryMaxBackoff the longest delay between retries, unless set
+	DefaultRetryMaxBackoff = 30 * time.Second
+)
+
+// RetryOptions how to retry transfers that fail, or stall, partway
+type RetryOptions struct {
+	// Attempts the number of times to retry; 0 does not retry
+	Attempts int
+	// Backoff the delay before the first retry, doubled for each retry after it, default DefaultRetryBackoff.
+	// A registry that asks for a delay with Retry-After gets that instead.
+	Backoff time.Duration
+	// MaxBackoff the longest delay between retries, default DefaultRetryMaxBackoff
+	MaxBackoff time.Duration
+	// StallTimeout retry the transfer of a blob when no bytes arrive for this long; 0 waits forever
+	StallTimeout time.Duration
+}
+
+// backoff the delay before the attempt'th retry
+func (o RetryOptions) backoff(attempt int) time.Duration {
+	backoff, maxBackoff := o.Backoff, o.MaxBackoff
+	if backoff <= 0 {
+		backoff = DefaultRetryBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultRetryMaxBackoff
+	}
+	for i := 1; i < attempt && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff
+}
+
+// Wait wait for the backoff before the attempt'th retry, unless the context is done first
+func (o RetryOptions) Wait(ctx context.Context, attempt int) error {
+	return sleep(ctx, o.backoff(attempt))
+}
+
+// retryableStatus whether a request that failed with the http status may succeed if retried
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// IsRetryable whether the error is transient, e.g. a dropped connection or an http status 429 or 503,
+// so that the request that failed with it may succeed if retried
+func IsRetryable(err error) bool {
+	// every url.Error is a net.Error, whatever failed, e.g. verifying the certificate, so it is decided by that
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) && urlErr.Err != nil {
+		err = urlErr.Err
+	}
+	var status remoteserrors.ErrUnexpectedStatus
+	var netErr net.Error
+	switch {
+	case err == nil, errors.Is(err, context.Canceled):
+		return false
+	case errors.As(err, &status):
+		return retryableStatus(status.StatusCode)
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.EPIPE):
+		return true
+	case errors.As(err, &netErr):
+		return netErr.Timeout()
+	}
+	return false
+}
+
+// sleep wait for the delay, unless the context is done first
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// retryTransport retries requests that fail with a transient error, and can be sent again
+type retryTransport struct {
+	base http.RoundTripper
+	opts RetryOptions
+}
+
+func (t retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+		if attempt > t.opts.Attempts || !replayable || req.Context().Err() != nil {
+			return resp, err
+		}
+		delay := t.opts.backoff(attempt)
+		switch {
+		case err != nil:
+			if !IsRetryable(err) {
+				return resp, err
+			}
+		case retryableStatus(resp.StatusCode):
+			if after, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+				delay = after
+			}
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+			_ = resp.Body.Close()
+		default:
+			return resp, err
+		}
+		if err := sleep(req.Context(), delay); err != nil {
+			return nil, err
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// retryAfter the delay asked for by a Retry-After header, either in seconds or until a date
+func retryAfter(header string) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		delay := time.Until(date)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
+
+// Retry resolver that retries transfers with an existing resolver
+type Retry struct {
+	ResolverCloser
+	opts RetryOptions
+}
+
+// NewRetry create a resolver that retries the transfers of the resolver with the options
+func NewRetry(ctx context.Context, resolver ResolverCloser, opts RetryOptions) (context.Context, *Retry, error) {
+	return ctx, &Retry{ResolverCloser: resolver, opts: opts}, nil
+}
+
+// retry call f until it succeeds, fails with an error that is not transient, or runs out of attempts
+func (r *Retry) retry(ctx context.Context, f func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt > r.opts.Attempts || !IsRetryable(err) {
+			return err
+		}
+		if err := r.opts.Wait(ctx, attempt); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *Retry) Resolve(ctx context.Context, ref string) (name string, desc ocispec.Descriptor, err error) {
+	err = r.retry(ctx, func() error {
+		var err error
+		name, desc, err = r.ResolverCloser.Resolve(ctx, ref)
+		return err
+	})
+	return name, desc, err
+}
+
+func (r *Retry) Fetcher(ctx context.Context, ref string) (remotes.Fetcher, error) {
+	fetcher, err := r.ResolverCloser.Fetcher(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return retryFetcher{fetcher: fetcher, opts: r.opts}, nil
+}
+
+func (r *Retry) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	pusher, err := r.ResolverCloser.Pusher(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return retryPusher{pusher: pusher, retry: r}, nil
+}
+
+// retryPusher pusher that retries starting each push
+type retryPusher struct {
+	pusher remotes.Pusher
+	retry  *Retry
+}
+
+func (p retryPusher) Push(ctx context.Context, desc ocispec.Descriptor) (w content.Writer, err error) {
+	err = p.retry.retry(ctx, func() error {
+		var err error
+		w, err = p.pusher.Push(ctx, desc)
+		return err
+	})
+	return w, err
+}
+
+// retryFetcher fetcher whose readers continue from where they stopped when they fail or stall
+type retryFetcher struct {
+	fetcher remotes.Fetcher
+	opts    RetryOptions
+}
+
+func (f retryFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	return f.fetchFrom(ctx, desc, 0)
+}
+
+// fetchFrom fetch the blob from the offset, with a range request where the fetcher supports it, rather than
+// fetching it from the start and then moving there
+func (f retryFetcher) fetchFrom(ctx context.Context, desc ocispec.Descriptor, offset int64) (io.ReadCloser, error) {
+	r := &retryReader{ctx: ctx, fetcher: f.fetcher, desc: desc, opts: f.opts, offset: offset}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// retryReader reader of a blob that fetches it again, from the offset already read, when it fails or stalls
+type retryReader struct {
+	ctx     context.Context
+	fetcher remotes.Fetcher
+	desc    ocispec.Descriptor
+	opts    RetryOptions
+	// offset the bytes read so far
+	offset int64
+	// attempt the retries since the last progress
+	attempt int
+	rc      io.ReadCloser
+	cancel  context.CancelFunc
+	stall   *time.Timer
+	stalled atomic.Bool
+	lock    sync.Mutex
+}
+
+// open fetch the blob, continuing from the offset, retrying as needed
+func (r *retryReader) open() error {
+	for {
+		if r.attempt > 0 {
+			if err := r.opts.Wait(r.ctx, r.attempt); err != nil {
+				return err
+			}
+		}
+		ctx, cancel := context.WithCancel(r.ctx)
+		rc, err := r.fetcher.Fetch(ctx, r.desc)
+		if err == nil {
+			// an empty read sends the request of a reader that only does so when first read, e.g. that of
+			// a registry, so that its failure is retried here, rather than counted as a stall; there is none
+			// to send when nothing is left to read, e.g. of an empty blob, and io.EOF means the same
+			if err = skip(rc, r.offset); err == nil && r.offset < r.desc.Size {
+				if _, err = rc.Read(nil); err == io.EOF {
+					err = nil
+				}
+			}
+			if err != nil {
+				_ = rc.Close()
+			}
+		}
+		if err == nil {
+			r.rc, r.cancel = rc, cancel
+			r.stalled.Store(false)
+			return nil
+		}
+		cancel()
+		if r.attempt >= r.opts.Attempts || !IsRetryable(err) {
+			return err
+		}
+		r.attempt++
+	}
+}
+
+// skip move the reader past the first n bytes, with a range request where the reader supports it
+func skip(rc io.Reader, n int64) error {
+	if n == 0 {
+		return nil
+	}
+	if seeker, ok := rc.(io.Seeker); ok {
+		_, err := seeker.Seek(n, io.SeekStart)
+		return err
+	}
+	_, err := io.CopyN(io.Discard, rc, n)
+	return err
+}
+
+// close the current fetch
+func (r *retryReader) close() error {
+	if r.rc == nil {
+		return nil
+	}
+	err := r.rc.Close()
+	r.cancel()
+	r.rc = nil
+	return err
+}
+
+func (r *retryReader) Read(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for {
+		if r.rc == nil {
+			if err := r.open(); err != nil {
+				return 0, err
+			}
+		}
+		// a read that receives nothing before the stall timeout is cancelled, and retried
+		if r.opts.StallTimeout > 0 {
+			cancel := r.cancel
+			r.stall = time.AfterFunc(r.opts.StallTimeout, func() {
+				r.stalled.Store(true)
+				cancel()
+			})
+		}
+		n, err := r.rc.Read(p)
+		if r.stall != nil {
+			r.stall.Stop()
+		}
+		r.offset += int64(n)
+		if n > 0 {
+			r.attempt = 0
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		stalled := r.stalled.Load()
+		if stalled {
+			err = fmt.Errorf("no data received for %v: %w", r.opts.StallTimeout, err)
+		}
+		_ = r.close()
+		if r.attempt >= r.opts.Attempts || !(stalled || IsRetryable(err)) {
+			return n, err
+		}
+		r.attempt++
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// Seek move to the offset, e.g. where a write that continues an earlier one starts, fetching from there
+// with a range request where the fetcher supports it
+func (r *retryReader) Seek(offset int64, whence int) (int64, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	default:
+		return r.offset, fmt.Errorf("unsupported whence %d", whence)
+	}
+	if offset < 0 {
+		return r.offset, fmt.Errorf("negative offset %d", offset)
+	}
+	if offset != r.offset {
+		_ = r.close()
+		r.offset = offset
+	}
+	return r.offset, nil
+}
+
+func (r *retryReader) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.close()
+}
@@ -0,0 +1,258 @@
+package resolver_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ecresolver "github.com/lf-edge/edge-containers/pkg/resolver"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// flakyRegistry a registry serving a single blob, that fails each request in turn as given by failures,
+// and then succeeds
+type flakyRegistry struct {
+	blob     []byte
+	lock     sync.Mutex
+	failures []string
+	// requests the number of requests for the blob, and the ranges they asked for
+	requests []string
+}
+
+func (f *flakyRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	dgst := digest.FromBytes(f.blob)
+	if r.URL.Path != "/v2/lfedge/eci/blobs/"+dgst.String() {
+		http.NotFound(w, r)
+		return
+	}
+	f.lock.Lock()
+	f.requests = append(f.requests, r.Header.Get("Range"))
+	failure := ""
+	if len(f.failures) > 0 {
+		failure, f.failures = f.failures[0], f.failures[1:]
+	}
+	f.lock.Unlock()
+
+	half := len(f.blob) / 2
+	switch failure {
+	case "429":
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+	case "503":
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case "reset":
+		// send half the blob, then drop the connection
+		w.Header().Set("Content-Length", strconv.Itoa(len(f.blob)))
+		_, _ = w.Write(f.blob[:half])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	case "stall":
+		// send half the blob, then nothing more
+		w.Header().Set("Content-Length", strconv.Itoa(len(f.blob)))
+		_, _ = w.Write(f.blob[:half])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	case "hang":
+		// send nothing, until the request is cancelled
+		<-r.Context().Done()
+	default:
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(f.blob))
+	}
+}
+
+func TestRetry(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "edge-containers-retry")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+	t.Setenv("DOCKER_CONFIG", tmpdir)
+
+	blob := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromBytes(blob), Size: int64(len(blob))}
+	retry := ecresolver.RetryOptions{Attempts: 3, Backoff: time.Millisecond, StallTimeout: 200 * time.Millisecond}
+
+	tests := []struct {
+		name     string
+		failures []string
+		retry    ecresolver.RetryOptions
+		valid    bool
+		// minimum the least time the fetch must take, to honour Retry-After
+		minimum time.Duration
+	}{
+		{"no failures", nil, ecresolver.RetryOptions{}, true, 0},
+		{"no retries", []string{"503"}, ecresolver.RetryOptions{}, false, 0},
+		{"unavailable", []string{"503", "503"}, retry, true, 0},
+		{"too many requests", []string{"429"}, retry, true, time.Second},
+		{"reset", []string{"reset"}, retry, true, 0},
+		{"stall", []string{"stall"}, retry, true, 0},
+		{"stall without timeout", []string{"stall"}, ecresolver.RetryOptions{Attempts: 3, Backoff: time.Millisecond}, false, 0},
+		{"everything", []string{"503", "reset", "stall", "reset"}, ecresolver.RetryOptions{Attempts: 2, Backoff: time.Millisecond, StallTimeout: 200 * time.Millisecond}, true, 0},
+		{"too many failures", []string{"503", "503", "503", "503"}, retry, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := &flakyRegistry{blob: blob, failures: tt.failures}
+			server := httptest.NewServer(registry)
+			defer server.Close()
+			ref := strings.TrimPrefix(server.URL, "http://") + "/lfedge/eci:current"
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			_, r, err := ecresolver.NewRegistryWithOptions(ctx, ecresolver.RegistryOptions{Retry: tt.retry})
+			if err != nil {
+				t.Fatalf("unable to create registry resolver: %v", err)
+			}
+			_, rr, err := ecresolver.NewRetry(ctx, r, tt.retry)
+			if err != nil {
+				t.Fatalf("unable to create retry resolver: %v", err)
+			}
+			fetcher, err := rr.Fetcher(ctx, ref)
+			if err != nil {
+				t.Fatalf("unable to get fetcher: %v", err)
+			}
+
+			start := time.Now()
+			var actual []byte
+			rc, err := fetcher.Fetch(ctx, desc)
+			if err == nil {
+				actual, err = io.ReadAll(rc)
+				_ = rc.Close()
+			}
+			switch {
+			case !tt.valid:
+				if err == nil {
+					t.Fatal("fetch did not fail")
+				}
+				return
+			case err != nil:
+				t.Fatalf("unable to fetch: %v", err)
+			case !bytes.Equal(actual, blob):
+				t.Fatalf("mismatched blob, %d bytes, expected %d", len(actual), len(blob))
+			}
+			if elapsed := time.Since(start); elapsed < tt.minimum {
+				t.Errorf("retried after %v, before Retry-After %v", elapsed, tt.minimum)
+			}
+			// retries after a partial transfer continue from where it stopped
+			registry.lock.Lock()
+			defer registry.lock.Unlock()
+			for i, failure := range tt.failures {
+				if (failure == "reset" || failure == "stall") && i+1 < len(registry.requests) && registry.requests[i+1] == "" {
+					t.Errorf("request %d after %s did not ask for a range", i+1, failure)
+				}
+			}
+		})
+	}
+
+	ctx := context.Background()
+
+	// an empty blob, e.g. a layer with no files, is read as it is
+	empty := &flakyRegistry{blob: []byte{}}
+	emptyServer := httptest.NewServer(empty)
+	defer emptyServer.Close()
+	_, r, err := ecresolver.NewRegistryWithOptions(ctx, ecresolver.RegistryOptions{})
+	if err != nil {
+		t.Fatalf("unable to create registry resolver: %v", err)
+	}
+	_, rr, err := ecresolver.NewRetry(ctx, r, retry)
+	if err != nil {
+		t.Fatalf("unable to create retry resolver: %v", err)
+	}
+	fetcher, err := rr.Fetcher(ctx, strings.TrimPrefix(emptyServer.URL, "http://")+"/lfedge/eci:current")
+	if err != nil {
+		t.Fatalf("unable to get fetcher: %v", err)
+	}
+	emptyDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromBytes(nil), Size: 0}
+	rc, err := fetcher.Fetch(ctx, emptyDesc)
+	if err != nil {
+		t.Fatalf("unable to fetch empty blob: %v", err)
+	}
+	if actual, err := io.ReadAll(rc); err != nil || len(actual) != 0 {
+		t.Errorf("mismatched empty blob, %d bytes: %v", len(actual), err)
+	}
+	_ = rc.Close()
+
+	// a reader moved to where a partial write stopped fetches the rest with a range request
+	registry := &flakyRegistry{blob: blob}
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	fetcher, err = rr.Fetcher(ctx, strings.TrimPrefix(server.URL, "http://")+"/lfedge/eci:current")
+	if err != nil {
+		t.Fatalf("unable to get fetcher: %v", err)
+	}
+	rc, err = fetcher.Fetch(ctx, desc)
+	if err != nil {
+		t.Fatalf("unable to fetch: %v", err)
+	}
+	defer func() { _ = rc.Close() }()
+	half := int64(len(blob) / 2)
+	if _, err := rc.(io.Seeker).Seek(half, io.SeekStart); err != nil {
+		t.Fatalf("unable to seek: %v", err)
+	}
+	actual, err := io.ReadAll(rc)
+	switch {
+	case err != nil:
+		t.Fatalf("unable to read: %v", err)
+	case !bytes.Equal(actual, blob[half:]):
+		t.Errorf("mismatched blob after seek, %d bytes, expected %d", len(actual), len(blob)-int(half))
+	}
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	if last := registry.requests[len(registry.requests)-1]; last != "bytes="+strconv.FormatInt(half, 10)+"-" {
+		t.Errorf("mismatched range, actual %q", last)
+	}
+}
+
+func TestRetryCertificate(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "edge-containers-retry")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+	t.Setenv("DOCKER_CONFIG", tmpdir)
+
+	// a registry whose certificate is not trusted, counting the connections to it
+	var connections atomic.Int32
+	server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	ctx := context.Background()
+	retry := ecresolver.RetryOptions{Attempts: 3, Backoff: time.Millisecond}
+	_, r, err := ecresolver.NewRegistryWithOptions(ctx, ecresolver.RegistryOptions{Client: &http.Client{}, Retry: retry})
+	if err != nil {
+		t.Fatalf("unable to create registry resolver: %v", err)
+	}
+	_, rr, err := ecresolver.NewRetry(ctx, r, retry)
+	if err != nil {
+		t.Fatalf("unable to create retry resolver: %v", err)
+	}
+	_, _, err = rr.Resolve(ctx, strings.TrimPrefix(server.URL, "https://")+"/lfedge/eci:current")
+	switch {
+	case err == nil:
+		t.Fatal("resolve did not fail")
+	case ecresolver.IsRetryable(err):
+		t.Errorf("certificate error is retryable: %v", err)
+	}
+	if n := connections.Load(); n != 1 {
+		t.Errorf("mismatched connections, actual %d expected 1", n)
+	}
+}
@@ -0,0 +1,409 @@
+package resolver
+
+/*
+ The tar archive behind OCIArchive and DockerArchive.
+
+ An archive either is written or read, never both. Writing stages each blob in a temporary file of
+ its own, and appends it to the archive when it is committed, so that writers neither wait for each other
+ nor, when they fail or are abandoned, leave the archive incomplete. The archive is built as a temporary
+ file next to it, and moved into place when closed. Reading finds where each file is in the archive once,
+ and then reads it by seeking to it.
+*/
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// tarArchive a tar archive of blobs, stored under their names in an OCI image layout
+type tarArchive struct {
+	path string
+
+	// mu guards all of the below
+	mu sync.Mutex
+	// reading
+	file    *os.File
+	entries map[string]tarEntry
+	// writing
+	out     *os.File
+	tw      *tar.Writer
+	written map[digest.Digest]bool
+	err     error
+}
+
+// tarEntry the location of the content of a file in a tar archive
+type tarEntry struct {
+	offset int64
+	size   int64
+}
+
+// openReader open the archive for reading, and find where each file in it is, if not already done
+func (a *tarArchive) openReader() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.out != nil {
+		return fmt.Errorf("archive %s is open for writing", a.path)
+	}
+	if a.file != nil {
+		return nil
+	}
+	file, err := os.Open(a.path)
+	if err != nil {
+		return fmt.Errorf("could not open archive %s: %v", a.path, err)
+	}
+	entries, err := tarEntries(file)
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("could not read archive %s: %v", a.path, err)
+	}
+	a.file, a.entries = file, entries
+	return nil
+}
+
+// openWriter create the archive for writing, if not already done; returns whether it was created
+func (a *tarArchive) openWriter() (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		return false, fmt.Errorf("archive %s is open for reading", a.path)
+	}
+	if a.out != nil {
+		return false, nil
+	}
+	out, err := os.CreateTemp(filepath.Dir(a.path), filepath.Base(a.path)+"-*")
+	if err != nil {
+		return false, fmt.Errorf("could not create archive %s: %v", a.path, err)
+	}
+	a.out = out
+	a.tw = tar.NewWriter(out)
+	a.written = map[digest.Digest]bool{}
+	a.err = nil
+	return true, nil
+}
+
+// close when writing, call final, which may add files, close the archive and move it into place;
+// when reading, close it
+func (a *tarArchive) close(final func() error) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		err := a.file.Close()
+		a.file, a.entries = nil, nil
+		return err
+	}
+	if a.out == nil {
+		return nil
+	}
+	out := a.out
+	a.out = nil
+	defer func() { _ = os.Remove(out.Name()) }()
+	err := a.err
+	if err == nil && final != nil {
+		err = final()
+	}
+	if err == nil {
+		err = a.tw.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(out.Name(), 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("could not write archive %s: %v", a.path, err)
+	}
+	if err := os.Rename(out.Name(), a.path); err != nil {
+		return fmt.Errorf("could not move archive into place at %s: %v", a.path, err)
+	}
+	return syncDir(filepath.Dir(a.path))
+}
+
+// has whether the file is in the archive being read
+func (a *tarArchive) has(name string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.entries[name]
+	return ok
+}
+
+// open the file in the archive for reading
+func (a *tarArchive) open(name string) (*io.SectionReader, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil, fmt.Errorf("archive %s is not open for reading", a.path)
+	}
+	entry, ok := a.entries[name]
+	if !ok {
+		return nil, fmt.Errorf("%s not found in archive %s: %w", name, a.path, errdefs.ErrNotFound)
+	}
+	return io.NewSectionReader(a.file, entry.offset, entry.size), nil
+}
+
+// readJSON read the file in the archive and decode it into v
+func (a *tarArchive) readJSON(name string, v interface{}) error {
+	r, err := a.open(name)
+	if err != nil {
+		return err
+	}
+	if err := json.NewDecoder(r).Decode(v); err != nil {
+		return fmt.Errorf("could not convert %s in archive %s from json: %v", name, a.path, err)
+	}
+	return nil
+}
+
+// writeJSON write v as the file in the archive; must hold the lock
+func (a *tarArchive) writeJSON(name string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("could not convert %s to json: %v", name, err)
+	}
+	if err := a.tw.WriteHeader(tarHeader(name, int64(len(b)))); err != nil {
+		return err
+	}
+	_, err = a.tw.Write(b)
+	return err
+}
+
+// fetch the blob with the descriptor desc from the archive being read
+func (a *tarArchive) fetch(desc ocispec.Descriptor) (io.ReadCloser, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid digest %s: %v", desc.Digest, err)
+	}
+	r, err := a.open(blobName(desc.Digest))
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(r), nil
+}
+
+// push start writing the blob, to a temporary file of its own, which is appended to the archive when it is
+// committed. If the blob already is in the archive, existing is called, and ErrAlreadyExists returned.
+// Otherwise, committed is called once the blob is committed, with its content if it is a manifest or index.
+// Both are called holding the lock.
+func (a *tarArchive) push(ref string, desc ocispec.Descriptor, existing func(), committed func([]byte)) (content.Writer, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid digest %s: %v", desc.Digest, err)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.out == nil {
+		return nil, fmt.Errorf("archive %s is not open for writing", a.path)
+	}
+	if a.err != nil {
+		return nil, a.err
+	}
+	if a.written[desc.Digest] {
+		existing()
+		return nil, fmt.Errorf("blob %s: %w", desc.Digest, errdefs.ErrAlreadyExists)
+	}
+	staged, err := os.CreateTemp(filepath.Dir(a.path), filepath.Base(a.path)+"-"+desc.Digest.Encoded()+"-*")
+	if err != nil {
+		return nil, fmt.Errorf("could not create file for %s: %v", desc.Digest, err)
+	}
+	var cache []byte
+	if isIndex(desc.MediaType) || isManifest(desc.MediaType) {
+		cache = make([]byte, 0, desc.Size)
+	}
+	now := time.Now()
+	return &tarArchiveWriter{
+		archive:   a,
+		staged:    staged,
+		desc:      desc,
+		ref:       ref,
+		committed: committed,
+		cache:     cache,
+		digester:  desc.Digest.Algorithm().Digester(),
+		start:     now,
+		updated:   now,
+	}, nil
+}
+
+// tarEntries find where the content of every regular file in the archive is. archive/tar reads nothing
+// beyond the header, so the offset of the file after each header is where its content starts.
+func tarEntries(file *os.File) (map[string]tarEntry, error) {
+	entries := map[string]tarEntry{}
+	tr := tar.NewReader(file)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		offset, err := file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		entries[cleanTarName(hdr.Name)] = tarEntry{offset: offset, size: hdr.Size}
+	}
+}
+
+// cleanTarName normalize a name in a tar archive, e.g. ./blobs/sha256/abc to blobs/sha256/abc
+func cleanTarName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func tarHeader(name string, size int64) *tar.Header {
+	return &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  time.Unix(0, 0),
+	}
+}
+
+// blobName the name of the blob with the digest dgst in an OCI image layout
+func blobName(dgst digest.Digest) string {
+	return path.Join("blobs", dgst.Algorithm().String(), dgst.Encoded())
+}
+
+type tarArchiveWriter struct {
+	archive   *tarArchive
+	staged    *os.File
+	ref       string
+	desc      ocispec.Descriptor
+	committed func([]byte)
+	cache     []byte
+	digester  digest.Digester
+	done      bool
+	start     time.Time
+	updated   time.Time
+	total     int64
+}
+
+// Digest may return empty digest or panics until committed.
+func (w *tarArchiveWriter) Digest() digest.Digest {
+	return w.desc.Digest
+}
+
+// Close closes the writer; if it was not committed, what was written is discarded, and the archive is as it was.
+func (w *tarArchiveWriter) Close() error {
+	if w.done {
+		return nil
+	}
+	return w.finish()
+}
+
+// finish close the writer, removing its temporary file
+func (w *tarArchiveWriter) finish() error {
+	w.done = true
+	err := w.staged.Close()
+	if removeErr := os.Remove(w.staged.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+func (w *tarArchiveWriter) Write(p []byte) (n int, err error) {
+	if w.done {
+		return 0, fmt.Errorf("writer for %s is closed", w.desc.Digest)
+	}
+	n, err = w.staged.Write(p)
+	_, _ = w.digester.Hash().Write(p[:n])
+	if w.cache != nil {
+		w.cache = append(w.cache, p[:n]...)
+	}
+	w.total += int64(n)
+	w.updated = time.Now()
+	return n, err
+}
+
+// Commit commits the blob, once it is verified to match the size and digest it was pushed with, as well
+// as those passed, if any, by appending it to the archive. Only a failure to append leaves the archive
+// incomplete, so that it cannot be closed.
+// size and expected can be zero-value when unknown.
+// Commit always closes the writer, even on error.
+// ErrAlreadyExists aborts the writer.
+func (w *tarArchiveWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+	if w.done {
+		return nil
+	}
+	actual := w.digester.Digest()
+	var err error
+	switch {
+	case w.total != w.desc.Size || (size > 0 && w.total != size):
+		err = fmt.Errorf("unexpected commit size %d, expected %d: %w", w.total, w.desc.Size, errdefs.ErrFailedPrecondition)
+	case expected != "" && actual != expected:
+		err = fmt.Errorf("unexpected commit digest %s, expected %s: %w", actual, expected, errdefs.ErrFailedPrecondition)
+	case actual != w.desc.Digest:
+		err = fmt.Errorf("unexpected commit digest %s, expected %s: %w", actual, w.desc.Digest, errdefs.ErrFailedPrecondition)
+	}
+	if err == nil {
+		err = w.append()
+	}
+	if finishErr := w.finish(); err == nil && finishErr != nil {
+		err = fmt.Errorf("could not remove file for %s: %v", w.desc.Digest, finishErr)
+	}
+	return err
+}
+
+// append add the blob from the temporary file to the archive, unless another writer already has
+func (w *tarArchiveWriter) append() error {
+	a := w.archive
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch {
+	case a.out == nil:
+		return fmt.Errorf("archive %s is not open for writing", a.path)
+	case a.err != nil:
+		return a.err
+	case a.written[w.desc.Digest]:
+		w.committed(w.cache)
+		return nil
+	}
+	if _, err := w.staged.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("could not read file for %s: %v", w.desc.Digest, err)
+	}
+	if err := a.tw.WriteHeader(tarHeader(blobName(w.desc.Digest), w.desc.Size)); err != nil {
+		a.err = fmt.Errorf("could not add %s to archive: %v", w.desc.Digest, err)
+		return a.err
+	}
+	if _, err := io.Copy(a.tw, w.staged); err != nil {
+		a.err = fmt.Errorf("could not add %s to archive: %v", w.desc.Digest, err)
+		return a.err
+	}
+	a.written[w.desc.Digest] = true
+	w.committed(w.cache)
+	return nil
+}
+
+// Status returns the current state of write
+func (w *tarArchiveWriter) Status() (content.Status, error) {
+	return content.Status{
+		Ref:       w.ref,
+		Offset:    w.total,
+		Total:     w.desc.Size,
+		Expected:  w.desc.Digest,
+		StartedAt: w.start,
+		UpdatedAt: w.updated,
+	}, nil
+}
+
+// Truncate updates the size of the target blob
+func (w *tarArchiveWriter) Truncate(size int64) error {
+	return fmt.Errorf("unsupported")
+}
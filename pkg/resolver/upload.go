@@ -0,0 +1,452 @@
+package resolver
+
+/*
+ Provides a github.com/containerd/containerd/remotes#Pusher that uploads blobs to a registry in chunks, each with
+ a PATCH to the upload session, as in https://github.com/opencontainers/distribution-spec/blob/main/spec.md#pushing-a-blob-in-chunks,
+ rather than in a single request. The session of each upload is recorded as its chunks are acknowledged, so that an
+ upload that stops partway, e.g. on a dropped connection, or when the push is interrupted and run again, continues
+ from the last chunk the registry has, rather than starting over.
+
+ The writer reports where it continues from in its Status, so that content.Copy moves the reader of the blob there.
+*/
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	remoteserrors "github.com/containerd/containerd/remotes/errors"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// uploadSession the state of the chunked upload of a blob
+type uploadSession struct {
+	// Location where to send the next chunk
+	Location string `json:"location"`
+	// Offset how much of the blob the registry has acknowledged
+	Offset int64 `json:"offset"`
+}
+
+// uploadSessions the sessions of the uploads in progress, kept in memory, and in the directory, if any,
+// so that a later push continues them too
+type uploadSessions struct {
+	dir      string
+	lock     sync.Mutex
+	sessions map[string]uploadSession
+}
+
+func newUploadSessions(dir string) *uploadSessions {
+	return &uploadSessions{dir: dir, sessions: map[string]uploadSession{}}
+}
+
+// filename the file of the session with the key
+func (s *uploadSessions) filename(key string) string {
+	return filepath.Join(s.dir, digest.FromString(key).Encoded()+".json")
+}
+
+// get the session with the key, if any
+func (s *uploadSessions) get(key string) (uploadSession, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if session, ok := s.sessions[key]; ok {
+		return session, true
+	}
+	if s.dir == "" {
+		return uploadSession{}, false
+	}
+	var session uploadSession
+	b, err := os.ReadFile(s.filename(key))
+	if err != nil || json.Unmarshal(b, &session) != nil || session.Location == "" || session.Offset < 0 {
+		return uploadSession{}, false
+	}
+	return session, true
+}
+
+// put record the session with the key
+func (s *uploadSessions) put(key string, session uploadSession) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sessions[key] = session
+	if s.dir == "" {
+		return nil
+	}
+	b, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("could not convert upload session to json: %v", err)
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return fmt.Errorf("could not create upload state directory %s: %v", s.dir, err)
+	}
+	// replaced atomically, so that it always is the last one acknowledged
+	filename := s.filename(key)
+	tmp, err := os.CreateTemp(s.dir, filepath.Base(filename)+"-*")
+	if err != nil {
+		return fmt.Errorf("could not create upload session %s: %v", filename, err)
+	}
+	_, err = tmp.Write(b)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("could not write upload session %s: %v", filename, err)
+	}
+	return nil
+}
+
+// remove the session with the key
+func (s *uploadSessions) remove(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.sessions, key)
+	if s.dir == "" {
+		return nil
+	}
+	if err := os.Remove(s.filename(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not remove upload session: %v", err)
+	}
+	return nil
+}
+
+// chunkedPusher pusher that uploads blobs in chunks, and manifests with the pusher
+type chunkedPusher struct {
+	pusher     remotes.Pusher
+	host       docker.RegistryHost
+	refspec    reference.Spec
+	repository string
+	chunkSize  int64
+	sessions   *uploadSessions
+}
+
+// newChunkedPusher create a pusher of the blobs of ref, in chunks of chunkSize, to the first of the hosts that
+// can push, and of its manifests with pusher
+func newChunkedPusher(pusher remotes.Pusher, hosts docker.RegistryHosts, ref string, chunkSize int64, sessions *uploadSessions) (remotes.Pusher, error) {
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	registryHosts, err := hosts(refspec.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	for _, host := range registryHosts {
+		if host.Capabilities.Has(docker.HostCapabilityPush) {
+			if host.Client == nil {
+				host.Client = http.DefaultClient
+			}
+			return chunkedPusher{
+				pusher:     pusher,
+				host:       host,
+				refspec:    refspec,
+				repository: strings.TrimPrefix(refspec.Locator, refspec.Hostname()+"/"),
+				chunkSize:  chunkSize,
+				sessions:   sessions,
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("no host to push %s to: %w", ref, errdefs.ErrNotFound)
+}
+
+func (p chunkedPusher) Push(ctx context.Context, desc ocispec.Descriptor) (content.Writer, error) {
+	switch desc.MediaType {
+	case images.MediaTypeDockerSchema2Manifest, images.MediaTypeDockerSchema2ManifestList, ocispec.MediaTypeImageManifest, ocispec.MediaTypeImageIndex:
+		return p.pusher.Push(ctx, desc)
+	}
+	ctx, err := docker.ContextWithRepositoryScope(ctx, p.refspec, true)
+	if err != nil {
+		return nil, err
+	}
+	// a blob the registry already has is not uploaded again
+	resp, err := p.do(ctx, http.MethodHead, p.url("blobs", desc.Digest.String()), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil, fmt.Errorf("blob %s: %w", desc.Digest, errdefs.ErrAlreadyExists)
+	case http.StatusNotFound:
+	default:
+		return nil, remoteserrors.NewUnexpectedStatusErr(resp)
+	}
+
+	key := p.host.Host + "/" + p.repository + "@" + desc.Digest.String()
+	session, ok := p.sessions.get(key)
+	if ok {
+		if session, ok, err = p.status(ctx, session); err != nil {
+			return nil, err
+		}
+	}
+	if !ok {
+		if session, err = p.start(ctx); err != nil {
+			return nil, err
+		}
+		if err := p.sessions.put(key, session); err != nil {
+			return nil, err
+		}
+	}
+	now := time.Now()
+	return &chunkedWriter{pusher: p, ctx: ctx, key: key, desc: desc, session: session, started: now, updated: now}, nil
+}
+
+// url the url of the path within the repository
+func (p chunkedPusher) url(path ...string) string {
+	return p.host.Scheme + "://" + p.host.Host + p.host.Path + "/" + p.repository + "/" + strings.Join(path, "/")
+}
+
+// do send the request, authorizing it for the host, and sending it again if the registry asks for other credentials
+func (p chunkedPusher) do(ctx context.Context, method, u string, body []byte, header http.Header) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		// a body that can be read again, so that it is sent again on retries
+		var r io.Reader
+		if body != nil {
+			r = bytes.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, u, r)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range p.host.Header {
+			req.Header[k] = append(req.Header[k], v...)
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if p.host.Authorizer != nil {
+			if err := p.host.Authorizer.Authorize(ctx, req); err != nil {
+				return nil, err
+			}
+		}
+		resp, err := p.host.Client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 || p.host.Authorizer == nil {
+			return resp, nil
+		}
+		err = p.host.Authorizer.AddResponses(ctx, []*http.Response{resp})
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// location the absolute url of the Location of the response, which the registry may give relative to the request
+func location(resp *http.Response) (string, error) {
+	header := resp.Header.Get("Location")
+	if header == "" {
+		return "", fmt.Errorf("no location in response to %s %s", resp.Request.Method, resp.Request.URL.Redacted())
+	}
+	u, err := resp.Request.URL.Parse(header)
+	if err != nil {
+		return "", fmt.Errorf("invalid location %s: %v", header, err)
+	}
+	return u.String(), nil
+}
+
+// start a new upload session
+func (p chunkedPusher) start(ctx context.Context) (uploadSession, error) {
+	resp, err := p.do(ctx, http.MethodPost, p.url("blobs", "uploads")+"/", nil, nil)
+	if err != nil {
+		return uploadSession{}, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusAccepted {
+		return uploadSession{}, remoteserrors.NewUnexpectedStatusErr(resp)
+	}
+	loc, err := location(resp)
+	if err != nil {
+		return uploadSession{}, err
+	}
+	return uploadSession{Location: loc}, nil
+}
+
+// status ask the registry how much of the upload of the session it has, false if the session no longer exists
+func (p chunkedPusher) status(ctx context.Context, session uploadSession) (uploadSession, bool, error) {
+	resp, err := p.do(ctx, http.MethodGet, session.Location, nil, nil)
+	if err != nil {
+		return session, false, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+	case http.StatusNotFound, http.StatusBadRequest:
+		return session, false, nil
+	default:
+		return session, false, remoteserrors.NewUnexpectedStatusErr(resp)
+	}
+	if resp.Header.Get("Location") != "" {
+		if session.Location, err = location(resp); err != nil {
+			return session, false, err
+		}
+	}
+	// Range is inclusive, so 0-0 is either nothing or the first byte; only the recorded offset tells which.
+	// Some registries give 0--1 for nothing.
+	offset := int64(0)
+	if r := resp.Header.Get("Range"); r != "" {
+		_, end, found := strings.Cut(strings.TrimPrefix(r, "bytes="), "-")
+		last, err := strconv.ParseInt(end, 10, 64)
+		if !found || err != nil || last < -1 {
+			return session, false, nil
+		}
+		if offset = last + 1; last == 0 && session.Offset == 0 {
+			offset = 0
+		}
+	}
+	session.Offset = offset
+	return session, true, nil
+}
+
+// chunkedWriter writer of a blob that uploads it in chunks, recording the session as each is acknowledged
+type chunkedWriter struct {
+	pusher  chunkedPusher
+	ctx     context.Context
+	key     string
+	desc    ocispec.Descriptor
+	session uploadSession
+	// buf what was written, but not yet sent
+	buf     []byte
+	closed  bool
+	started time.Time
+	updated time.Time
+}
+
+func (w *chunkedWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("writer for %s is closed", w.desc.Digest)
+	}
+	w.buf = append(w.buf, p...)
+	w.updated = time.Now()
+	for int64(len(w.buf)) >= w.pusher.chunkSize {
+		if err := w.send(w.buf[:w.pusher.chunkSize]); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[:copy(w.buf, w.buf[w.pusher.chunkSize:])]
+	}
+	return len(p), nil
+}
+
+// send upload the chunk, which continues from the offset of the session
+func (w *chunkedWriter) send(chunk []byte) error {
+	header := http.Header{
+		"Content-Type":  []string{"application/octet-stream"},
+		"Content-Range": []string{fmt.Sprintf("%d-%d", w.session.Offset, w.session.Offset+int64(len(chunk))-1)},
+	}
+	resp, err := w.pusher.do(w.ctx, http.MethodPatch, w.session.Location, chunk, header)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusAccepted {
+		return remoteserrors.NewUnexpectedStatusErr(resp)
+	}
+	loc, err := location(resp)
+	if err != nil {
+		return err
+	}
+	w.session = uploadSession{Location: loc, Offset: w.session.Offset + int64(len(chunk))}
+	return w.pusher.sessions.put(w.key, w.session)
+}
+
+// Digest the digest of the blob being uploaded
+func (w *chunkedWriter) Digest() digest.Digest {
+	return w.desc.Digest
+}
+
+// Close closes the writer; if it was not committed, the session is kept, so that a later push continues it
+func (w *chunkedWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+// Commit sends what remains of the blob, and completes the upload. A blob the registry rejects is not continued.
+func (w *chunkedWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+	if w.closed {
+		return fmt.Errorf("writer for %s is closed", w.desc.Digest)
+	}
+	w.closed = true
+	if len(w.buf) > 0 {
+		if err := w.send(w.buf); err != nil {
+			return err
+		}
+		w.buf = nil
+	}
+	if size == 0 {
+		size = w.desc.Size
+	}
+	switch {
+	case size > 0 && w.session.Offset != size:
+		return fmt.Errorf("unexpected commit size %d, expected %d: %w", w.session.Offset, size, errdefs.ErrFailedPrecondition)
+	case expected != "" && expected != w.desc.Digest:
+		return fmt.Errorf("unexpected commit digest %s, expected %s: %w", w.desc.Digest, expected, errdefs.ErrFailedPrecondition)
+	}
+	u, err := url.Parse(w.session.Location)
+	if err != nil {
+		return fmt.Errorf("invalid location %s: %v", w.session.Location, err)
+	}
+	query := u.Query()
+	query.Set("digest", w.desc.Digest.String())
+	u.RawQuery = query.Encode()
+	resp, err := w.pusher.do(w.ctx, http.MethodPut, u.String(), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusNoContent:
+	case http.StatusBadRequest, http.StatusNotFound:
+		// the registry has the wrong blob, or has lost the upload, so it starts over the next time
+		_ = w.pusher.sessions.remove(w.key)
+		return remoteserrors.NewUnexpectedStatusErr(resp)
+	default:
+		return remoteserrors.NewUnexpectedStatusErr(resp)
+	}
+	return w.pusher.sessions.remove(w.key)
+}
+
+// Status returns the current state of the upload; its offset is where an upload that continues an earlier one starts
+func (w *chunkedWriter) Status() (content.Status, error) {
+	return content.Status{
+		Ref:       w.key,
+		Offset:    w.session.Offset + int64(len(w.buf)),
+		Total:     w.desc.Size,
+		Expected:  w.desc.Digest,
+		StartedAt: w.started,
+		UpdatedAt: w.updated,
+	}, nil
+}
+
+// Truncate starts the upload over, when size is 0; no other size is supported
+func (w *chunkedWriter) Truncate(size int64) error {
+	if size != 0 {
+		return fmt.Errorf("unsupported")
+	}
+	session, err := w.pusher.start(w.ctx)
+	if err != nil {
+		return err
+	}
+	w.session, w.buf = session, nil
+	return w.pusher.sessions.put(w.key, session)
+}
@@ -0,0 +1,240 @@
+package resolver_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	ctrcontent "github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	ecresolver "github.com/lf-edge/edge-containers/pkg/resolver"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// uploadRegistry a registry of the repository lfedge/eci that takes blobs in chunks, failing the PATCH of
+// each chunk numbered in failures
+type uploadRegistry struct {
+	lock     sync.Mutex
+	blobs    map[digest.Digest][]byte
+	uploads  map[string][]byte
+	failures map[int]bool
+	// posts the uploads started, patches the Content-Range of each chunk sent
+	posts     int
+	patches   []string
+	manifests int
+}
+
+func newUploadRegistry() *uploadRegistry {
+	return &uploadRegistry{blobs: map[digest.Digest][]byte{}, uploads: map[string][]byte{}, failures: map[int]bool{}}
+}
+
+func (u *uploadRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	const prefix = "/v2/lfedge/eci/"
+	path := strings.TrimPrefix(r.URL.Path, prefix)
+	id := strings.TrimPrefix(path, "blobs/uploads/")
+	switch {
+	case !strings.HasPrefix(r.URL.Path, prefix):
+		http.NotFound(w, r)
+	case strings.HasPrefix(path, "manifests/"):
+		switch r.Method {
+		case http.MethodPut:
+			manifest, _ := io.ReadAll(r.Body)
+			u.manifests++
+			w.Header().Set("Docker-Content-Digest", digest.FromBytes(manifest).String())
+			w.WriteHeader(http.StatusCreated)
+		default:
+			http.NotFound(w, r)
+		}
+	case r.Method == http.MethodHead && strings.HasPrefix(path, "blobs/") && id == path:
+		if _, ok := u.blobs[digest.Digest(strings.TrimPrefix(path, "blobs/"))]; !ok {
+			http.NotFound(w, r)
+		}
+	case r.Method == http.MethodPost && id == "":
+		u.posts++
+		id = fmt.Sprint(u.posts)
+		u.uploads[id] = nil
+		// relative, as given by most registries
+		w.Header().Set("Location", prefix+"blobs/uploads/"+id)
+		w.WriteHeader(http.StatusAccepted)
+	case id == path:
+		http.NotFound(w, r)
+	default:
+		upload, ok := u.uploads[id]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Location", prefix+"blobs/uploads/"+id)
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Range", fmt.Sprintf("0-%d", max(len(upload)-1, 0)))
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodPatch:
+			chunk, _ := io.ReadAll(r.Body)
+			u.patches = append(u.patches, r.Header.Get("Content-Range"))
+			if u.failures[len(u.patches)] {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if r.Header.Get("Content-Range") != fmt.Sprintf("%d-%d", len(upload), len(upload)+len(chunk)-1) {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			u.uploads[id] = append(upload, chunk...)
+			w.WriteHeader(http.StatusAccepted)
+		case http.MethodPut:
+			dgst := digest.Digest(r.URL.Query().Get("digest"))
+			if digest.FromBytes(upload) != dgst {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			delete(u.uploads, id)
+			u.blobs[dgst] = upload
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func TestChunkedUpload(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "edge-containers-upload")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+	t.Setenv("DOCKER_CONFIG", tmpdir)
+
+	blob := bytes.Repeat([]byte("0123456789abcdef"), 640)
+	desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromBytes(blob), Size: int64(len(blob))}
+	const chunkSize = 1024
+	ctx := context.Background()
+
+	registry := newUploadRegistry()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	ref := strings.TrimPrefix(server.URL, "http://") + "/lfedge/eci:current"
+	uploadState := tmpdir + "/uploads"
+
+	// push copies the blob to a new writer of the registry, returning where it continued from
+	push := func(r *ecresolver.Registry, desc ocispec.Descriptor, b []byte) (int64, error) {
+		t.Helper()
+		pusher, err := r.Pusher(ctx, ref)
+		if err != nil {
+			t.Fatalf("unable to get pusher: %v", err)
+		}
+		w, err := pusher.Push(ctx, desc)
+		if err != nil {
+			return 0, err
+		}
+		defer func() { _ = w.Close() }()
+		status, err := w.Status()
+		if err != nil {
+			t.Fatalf("unable to get status: %v", err)
+		}
+		return status.Offset, ctrcontent.Copy(ctx, w, bytes.NewReader(b), desc.Size, desc.Digest)
+	}
+	newRegistry := func(opts ecresolver.RegistryOptions) *ecresolver.Registry {
+		t.Helper()
+		_, r, err := ecresolver.NewRegistryWithOptions(ctx, opts)
+		if err != nil {
+			t.Fatalf("unable to create registry resolver: %v", err)
+		}
+		return r
+	}
+	// check that the registry has the blob, after the given uploads, and that the chunk sent after the failed one
+	// continued from offset
+	check := func(posts, failed int, offset int64) {
+		t.Helper()
+		registry.lock.Lock()
+		defer registry.lock.Unlock()
+		if !bytes.Equal(registry.blobs[desc.Digest], blob) {
+			t.Errorf("mismatched blob, %d bytes, expected %d", len(registry.blobs[desc.Digest]), len(blob))
+		}
+		if registry.posts != posts {
+			t.Errorf("mismatched uploads, actual %d expected %d", registry.posts, posts)
+		}
+		if len(registry.patches) <= failed || registry.patches[failed] != fmt.Sprintf("%d-%d", offset, offset+chunkSize-1) {
+			t.Errorf("chunk after the failed one did not continue from %d: %v", offset, registry.patches)
+		}
+		for _, p := range registry.patches {
+			var start, end int
+			if _, err := fmt.Sscanf(p, "%d-%d", &start, &end); err != nil || end-start+1 > chunkSize {
+				t.Errorf("invalid chunk %s of at most %d bytes", p, chunkSize)
+			}
+		}
+		delete(registry.blobs, desc.Digest)
+		registry.posts, registry.patches, registry.failures = 0, nil, map[int]bool{}
+	}
+
+	// a push that fails partway continues in the same registry
+	r := newRegistry(ecresolver.RegistryOptions{ChunkSize: chunkSize})
+	registry.failures[4] = true
+	if _, err := push(r, desc, blob); err == nil {
+		t.Fatal("push did not fail")
+	}
+	if offset, err := push(r, desc, blob); err != nil || offset != 3*chunkSize {
+		t.Fatalf("mismatched offset %d, expected %d: %v", offset, 3*chunkSize, err)
+	}
+	check(1, 4, 3*chunkSize)
+
+	// a blob the registry has is not pushed again
+	if _, err := push(r, desc, blob); err != nil {
+		t.Fatalf("unable to push: %v", err)
+	}
+	if _, err := push(r, desc, blob); !errors.Is(err, errdefs.ErrAlreadyExists) {
+		t.Errorf("mismatched errors, actual %v expected %v", err, errdefs.ErrAlreadyExists)
+	}
+	registry.lock.Lock()
+	registry.posts, registry.patches = 0, nil
+	delete(registry.blobs, desc.Digest)
+	registry.lock.Unlock()
+
+	// with the upload state, a push that fails partway continues in another registry, e.g. when run again
+	registry.failures[2] = true
+	if _, err := push(newRegistry(ecresolver.RegistryOptions{ChunkSize: chunkSize, UploadState: uploadState}), desc, blob); err == nil {
+		t.Fatal("push did not fail")
+	}
+	if offset, err := push(newRegistry(ecresolver.RegistryOptions{ChunkSize: chunkSize, UploadState: uploadState}), desc, blob); err != nil || offset != chunkSize {
+		t.Fatalf("mismatched offset %d, expected %d: %v", offset, chunkSize, err)
+	}
+	check(1, 2, chunkSize)
+	if entries, err := os.ReadDir(uploadState); err != nil || len(entries) != 0 {
+		t.Errorf("upload state not removed: %v %v", entries, err)
+	}
+
+	// an upload the registry no longer has starts over
+	registry.failures[2] = true
+	if _, err := push(newRegistry(ecresolver.RegistryOptions{ChunkSize: chunkSize, UploadState: uploadState}), desc, blob); err == nil {
+		t.Fatal("push did not fail")
+	}
+	registry.lock.Lock()
+	registry.uploads = map[string][]byte{}
+	registry.lock.Unlock()
+	if offset, err := push(newRegistry(ecresolver.RegistryOptions{ChunkSize: chunkSize, UploadState: uploadState}), desc, blob); err != nil || offset != 0 {
+		t.Fatalf("mismatched offset %d, expected 0: %v", offset, err)
+	}
+	check(2, 2, 0)
+
+	// manifests are pushed as a whole
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json"}`)
+	manifestDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(manifest), Size: int64(len(manifest))}
+	if _, err := push(r, manifestDesc, manifest); err != nil {
+		t.Fatalf("unable to push manifest: %v", err)
+	}
+	if registry.manifests != 1 || len(registry.patches) != 0 {
+		t.Errorf("manifest pushed %d times, in chunks %v", registry.manifests, registry.patches)
+	}
+}